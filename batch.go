@@ -0,0 +1,171 @@
+package fulmo
+
+import "time"
+
+// Entry is a key-value pair set with SetMany.
+type Entry[K Key, V any] struct {
+	Key   K
+	Value V
+	Cost  int64
+	// TTL works like in SetWithTTL.
+	TTL time.Duration
+}
+
+// GetMany works like Get for many keys at once.
+// It locks every shard of the store once and records the accesses in one go,
+// which is cheaper than calling Get in a loop.
+// The values and whether they were found are returned in the order of the keys.
+func (c *Cache[K, V]) GetMany(keys []K) ([]V, []bool) {
+	values := make([]V, len(keys))
+	if c == nil || c.isClosed.Load() || len(keys) == 0 {
+		return values, make([]bool, len(keys))
+	}
+
+	hashes := make([]uint64, len(keys))
+	lookups := make([]storeLookup, len(keys))
+	for idx, key := range keys {
+		lookups[idx] = c.lookup(key, nil)
+		hashes[idx] = lookups[idx].key
+	}
+
+	c.getBuf.PushMany(hashes)
+	items, found := c.storedItems.AccessMany(lookups)
+	for idx, item := range items {
+		c.accessed(keys[idx], lookups[idx], item, found[idx], nil)
+		values[idx] = item.value
+		if !found[idx] {
+			values[idx], found[idx] = c.promote(keys[idx])
+		}
+	}
+
+	return values, found
+}
+
+// SetMany works like SetWithTTL for many entries at once.
+// The entries are submitted to the set buffer as a single batch, so either all of them
+// are buffered or, if the buffer is full, all of them are dropped.
+// Entries of keys already in the cache are updated right away in both cases.
+// Whether each entry was buffered or updated is returned in the order of the entries.
+// The entries are passed to Config.Writer in one batch, if the Writer fails none are set.
+func (c *Cache[K, V]) SetMany(entries []Entry[K, V]) []bool {
+	results := make([]bool, len(entries))
+	if c == nil || c.isClosed.Load() || len(entries) == 0 {
+		return results
+	}
+
+	batch := make([]*Item[V], 0, len(entries))
+	idxs := make([]int, 0, len(entries))
+	var writes []Write[K, V]
+	if c.writer != nil {
+		writes = make([]Write[K, V], 0, len(entries))
+	}
+	for idx, e := range entries {
+		// items with a negative TTL are a no-op
+		if i := c.newItem(e.Key, e.Value, setOptions{cost: e.Cost, ttl: e.TTL}); i != nil {
+			c.dropDemoted(e.Key)
+			batch = append(batch, i)
+			idxs = append(idxs, idx)
+			writes = append(writes, Write[K, V]{Key: e.Key, Value: e.Value})
+		}
+	}
+	if !c.write(writes...) {
+		return results
+	}
+
+	if c.synchronous {
+		c.applyMu.Lock()
+		defer c.applyMu.Unlock()
+		for n, i := range batch {
+			c.updateStored(i)
+			results[idxs[n]] = c.applyItem(i)
+		}
+		return results
+	}
+
+	for _, i := range batch {
+		c.updateStored(i)
+	}
+	select {
+	case c.setBuf <- &Item[V]{batch: batch}:
+		for _, idx := range idxs {
+			results[idx] = true
+		}
+	default:
+		for n, i := range batch {
+			if i.flag == itemUpdate {
+				results[idxs[n]] = true
+			} else {
+				c.Metrics.add(dropSets, i.Key, 1)
+			}
+		}
+	}
+
+	return results
+}
+
+// DelMany works like Del for many keys at once,
+// locking every shard of the store once.
+func (c *Cache[K, V]) DelMany(keys []K) {
+	if c == nil || c.isClosed.Load() || len(keys) == 0 {
+		return
+	}
+
+	lookups := make([]storeLookup, len(keys))
+	var writes []Write[K, V]
+	if c.writer != nil {
+		writes = make([]Write[K, V], len(keys))
+	}
+	for idx, key := range keys {
+		lookups[idx] = c.lookup(key, nil)
+		if c.tier != nil {
+			c.tier.Del(key)
+		}
+		if writes != nil {
+			writes[idx] = Write[K, V]{Key: key, Deleted: true}
+		}
+	}
+	c.write(writes...)
+	c.delLookups(lookups)
+}
+
+// delLookups deletes the keys of the lookups and returns how many were found.
+func (c *Cache[K, V]) delLookups(lookups []storeLookup) int {
+	batch := make([]*Item[V], len(lookups))
+	for idx, l := range lookups {
+		batch[idx] = &Item[V]{
+			flag:        itemDelete,
+			Key:         l.key,
+			Conflict:    l.conflict,
+			OriginalKey: l.origKey,
+		}
+	}
+
+	count := 0
+	if c.synchronous {
+		c.applyMu.Lock()
+		defer c.applyMu.Unlock()
+		for _, i := range batch {
+			if c.applyItem(i) {
+				count++
+			}
+		}
+		return count
+	}
+
+	// delete immediately
+	costs := make([]int64, len(lookups))
+	for idx, l := range lookups {
+		costs[idx] = c.cachePolicy.Cost(l.key)
+	}
+	prevs, found := c.storedItems.DelMany(lookups)
+	for idx, prev := range prevs {
+		if found[idx] {
+			c.deleted(prev, costs[idx])
+			count++
+		}
+		c.onExit(prev.value)
+	}
+	// see Del for why the deletes are also buffered
+	c.setBuf <- &Item[V]{batch: batch}
+	return count
+}
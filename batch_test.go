@@ -0,0 +1,151 @@
+package fulmo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheGetMany(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters: 1000,
+		MaxCost:     1000,
+		BufferItems: 64,
+		Metrics:     true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for key := range 10 {
+		c.Set(key, key*10, 1)
+	}
+	c.Wait()
+
+	keys := []int{0, 5, 9, 10, 11, 5}
+	values, found := c.GetMany(keys)
+	require.Equal(t, []int{0, 50, 90, 0, 0, 50}, values)
+	require.Equal(t, []bool{true, true, true, false, false, true}, found)
+	require.Equal(t, uint64(4), c.Metrics.Hits())
+	require.Equal(t, uint64(2), c.Metrics.Misses())
+
+	values, found = c.GetMany(nil)
+	require.Empty(t, values)
+	require.Empty(t, found)
+
+	var nilCache *Cache[int, int]
+	values, found = nilCache.GetMany(keys)
+	require.Len(t, values, len(keys))
+	require.Equal(t, make([]bool, len(keys)), found)
+}
+
+func TestCacheSetMany(t *testing.T) {
+	evicted := make(map[uint64]int)
+	var exited []int
+	c, err := NewCache(&Config[int, int]{
+		NumCounters: 1000,
+		MaxCost:     1000,
+		BufferItems: 64,
+		Metrics:     true,
+		OnEvict: func(item *Item[int]) {
+			evicted[item.Key] = item.Value
+		},
+		OnExit: func(val int) {
+			exited = append(exited, val)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	c.Set(1, 1, 1)
+	c.Wait()
+
+	results := c.SetMany([]Entry[int, int]{
+		{Key: 1, Value: 10, Cost: 1},
+		{Key: 2, Value: 20, Cost: 1, TTL: time.Hour},
+		{Key: 3, Value: 30, Cost: 1, TTL: -1},
+		{Key: 4, Value: 40, Cost: 1},
+	})
+	require.Equal(t, []bool{true, true, false, true}, results)
+	c.Wait()
+
+	values, found := c.GetMany([]int{1, 2, 3, 4})
+	require.Equal(t, []int{10, 20, 0, 40}, values)
+	require.Equal(t, []bool{true, true, false, true}, found)
+	ttl, ok := c.GetTTL(2)
+	require.True(t, ok)
+	require.InDelta(t, time.Hour, ttl, float64(time.Minute))
+	require.Equal(t, uint64(3), c.Metrics.KeysAdded())
+	require.Equal(t, uint64(1), c.Metrics.KeysUpdated())
+
+	t.Run("full buffer", func(t *testing.T) {
+		// fill the buffer, so the batch is dropped except for updates
+		c.stop <- struct{}{}
+		<-c.done
+		for len(c.setBuf) < cap(c.setBuf) {
+			c.setBuf <- &Item[int]{flag: itemUpdate}
+		}
+
+		dropped := c.Metrics.SetsDropped()
+		results := c.SetMany([]Entry[int, int]{
+			{Key: 1, Value: 100, Cost: 1},
+			{Key: 5, Value: 50, Cost: 1},
+		})
+		require.Equal(t, []bool{true, false}, results)
+		require.Equal(t, dropped+1, c.Metrics.SetsDropped())
+
+		// clearing discards the buffered items, the new ones only reach OnExit
+		c.setBuf = make(chan *Item[int], setBufSize)
+		c.setBuf <- &Item[int]{batch: []*Item[int]{{flag: itemNew, Key: 6, Value: 60}}}
+		// stand in for the stopped processItems, so the batch stays buffered
+		go func() {
+			<-c.stop
+			c.done <- struct{}{}
+		}()
+		c.Clear()
+		require.NotContains(t, evicted, uint64(6))
+		require.Contains(t, exited, 60)
+		require.Equal(t, 100, evicted[c.lookup(1, nil).key])
+	})
+}
+
+func TestCacheDelMany(t *testing.T) {
+	for _, synchronous := range []bool{false, true} {
+		var removed []RemovalCause
+		c, err := NewCache(&Config[int, int]{
+			NumCounters: 1000,
+			MaxCost:     1000,
+			BufferItems: 64,
+			Metrics:     true,
+			Synchronous: synchronous,
+			OnRemove: func(item *Item[int], cause RemovalCause) {
+				removed = append(removed, cause)
+			},
+		})
+		require.NoError(t, err)
+
+		results := c.SetMany([]Entry[int, int]{
+			{Key: 1, Value: 1, Cost: 1},
+			{Key: 2, Value: 2, Cost: 1},
+			{Key: 3, Value: 3, Cost: 1},
+		})
+		require.Equal(t, []bool{true, true, true}, results)
+		c.Wait()
+
+		c.DelMany([]int{1, 3, 4})
+		_, found := c.GetMany([]int{1, 2, 3})
+		require.Equal(t, []bool{false, true, false}, found, "deletes should be visible right away")
+		c.Wait()
+
+		require.Equal(t, []RemovalCause{RemovalExplicit, RemovalExplicit}, removed)
+		require.Equal(t, int64(1000-1-itemSize), c.RemainingCost())
+
+		// a set of the same keys is followed by the delete
+		c.SetMany([]Entry[int, int]{{Key: 5, Value: 5, Cost: 1}})
+		c.DelMany([]int{5})
+		c.Wait()
+		_, ok := c.Get(5)
+		require.False(t, ok)
+		c.Close()
+	}
+}
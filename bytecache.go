@@ -0,0 +1,181 @@
+package fulmo
+
+import (
+	"errors"
+	"time"
+
+	"github.com/pchchv/fulmo/helpers"
+)
+
+// ByteCache is a cache of []byte values that keeps the values outside of the Go heap,
+// so that big caches don't make the garbage collector slower.
+// The values are copied into slabs allocated with helpers.Calloc,
+// which uses jemalloc when built with the jemalloc tag, and the slab chunks are freed
+// once the values leave the cache. Only the keys, the policy and small refs
+// to the chunks stay on the Go heap.
+//
+// Without the jemalloc tag the slabs are allocated by Go, but as they hold
+// no pointers the garbage collector doesn't scan them.
+//
+// The cost of each value is the size of the chunk it's stored in,
+// so MaxCost is in bytes. Values up to 64KB are rounded up to the next power
+// of two, no less than 64 bytes, bigger values are stored in their own allocation.
+// Freed chunks are kept for reuse until the cache is closed.
+type ByteCache[K Key] struct {
+	c     *Cache[K, slabRef]
+	slabs *slabAllocator
+	// Metrics contains a running log of important statistics like hits, misses,
+	// and dropped items, see Cache.Metrics.
+	Metrics *Metrics
+}
+
+// NewByteCache returns a new ByteCache instance and any configuration errors, if any.
+// The config is used like in NewCache, except that the callbacks, ShouldUpdate, Cost,
+// Policy, Loader, Refresh, RefreshAfter, SecondaryTier, the Writer options and MemoryGovernor
+// aren't supported.
+func NewByteCache[K Key](config *Config[K, []byte]) (*ByteCache[K], error) {
+	switch {
+	case config.OnEvict != nil || config.OnExpire != nil || config.OnReject != nil ||
+		config.OnExit != nil || config.OnRemove != nil:
+		return nil, errors.New("ByteCache doesn't support callbacks")
+	case config.ShouldUpdate != nil:
+		return nil, errors.New("ByteCache doesn't support ShouldUpdate")
+	case config.Cost != nil:
+		return nil, errors.New("ByteCache doesn't support Cost, the cost of a value is its size")
+	case config.Policy != nil:
+		return nil, errors.New("ByteCache doesn't support Policy")
+	case config.Loader != nil || config.Refresh != nil || config.RefreshAfter != 0:
+		return nil, errors.New("ByteCache doesn't support Loader and Refresh")
+	case config.SecondaryTier != nil:
+		return nil, errors.New("ByteCache doesn't support SecondaryTier")
+	case config.Writer != nil || config.WriteBehind != 0 || config.OnWriteError != nil:
+		return nil, errors.New("ByteCache doesn't support Writer")
+	case config.MemoryGovernor != nil:
+		return nil, errors.New("ByteCache doesn't support MemoryGovernor, its values are outside of the Go heap")
+	}
+
+	slabs := newSlabAllocator()
+	c, err := NewCache(&Config[K, slabRef]{
+		NumCounters:            config.NumCounters,
+		MaxCost:                config.MaxCost,
+		BufferItems:            config.BufferItems,
+		Metrics:                config.Metrics,
+		OnExit:                 slabs.free,
+		KeyToHash:              config.KeyToHash,
+		IgnoreInternalCost:     config.IgnoreInternalCost,
+		TtlTickerDurationInSec: config.TtlTickerDurationInSec,
+		TtlTickerDuration:      config.TtlTickerDuration,
+		Synchronous:            config.Synchronous,
+		Clock:                  config.Clock,
+		StoreKeys:              config.StoreKeys,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ByteCache[K]{c: c, slabs: slabs, Metrics: c.Metrics}, nil
+}
+
+// Get returns a copy of the value (if any) and whether the value was found, see Cache.Get.
+func (c *ByteCache[K]) Get(key K) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	ref, ok := c.c.Get(key)
+	if !ok {
+		return nil, false
+	}
+
+	// the chunk may have been freed since, then the value is gone
+	return c.slabs.get(ref, make([]byte, 0, ref.n))
+}
+
+// Set copies the value into the cache, see Cache.Set.
+// The caller keeps the ownership of value.
+func (c *ByteCache[K]) Set(key K, value []byte) bool {
+	return c.SetWithTTL(key, value, 0)
+}
+
+// SetWithTTL works like Set, but the value expires after ttl, see Cache.SetWithTTL.
+func (c *ByteCache[K]) SetWithTTL(key K, value []byte, ttl time.Duration) bool {
+	if c == nil || ttl < 0 {
+		return false
+	}
+
+	ref, cost, ok := c.slabs.put(value)
+	if !ok {
+		return false
+	}
+
+	if !c.c.SetWithTTL(key, ref, cost, ttl) {
+		// the chunk is already freed if the policy rejected the value,
+		// but not if the set was dropped
+		c.slabs.free(ref)
+		return false
+	}
+	return true
+}
+
+// Del deletes the value of the key, see Cache.Del.
+func (c *ByteCache[K]) Del(key K) {
+	if c != nil {
+		c.c.Del(key)
+	}
+}
+
+// Wait blocks until all buffered writes have been applied, see Cache.Wait.
+func (c *ByteCache[K]) Wait() {
+	if c != nil {
+		c.c.Wait()
+	}
+}
+
+// Clear empties the cache, see Cache.Clear.
+// The slabs are kept for reuse.
+func (c *ByteCache[K]) Clear() {
+	if c != nil {
+		c.c.Clear()
+	}
+}
+
+// Close stops the cache and releases all the memory of the values.
+func (c *ByteCache[K]) Close() {
+	if c == nil || c.c.isClosed.Load() {
+		return
+	}
+	c.c.Close()
+	c.slabs.close()
+}
+
+// MaxCost returns the max cost of the cache in bytes.
+func (c *ByteCache[K]) MaxCost() int64 {
+	if c != nil {
+		return c.c.MaxCost()
+	}
+	return 0
+}
+
+// UpdateMaxCost updates the max cost of the cache in bytes.
+func (c *ByteCache[K]) UpdateMaxCost(maxCost int64) {
+	if c != nil {
+		c.c.UpdateMaxCost(maxCost)
+	}
+}
+
+// Allocated returns the number of bytes allocated outside of the Go heap for the values,
+// including the free chunks kept for reuse.
+func (c *ByteCache[K]) Allocated() int64 {
+	if c != nil {
+		return c.slabs.allocated.Load()
+	}
+	return 0
+}
+
+// Leaks reports the memory allocated with helpers.Calloc that wasn't freed yet,
+// by allocation tag, see helpers.Leaks. The slabs of ByteCache are tagged
+// "fulmo.ByteCache", once all the caches are closed they shouldn't appear in it.
+// Leak detection needs the jemalloc build tag.
+func (c *ByteCache[K]) Leaks() string {
+	return helpers.Leaks()
+}
@@ -0,0 +1,136 @@
+package fulmo
+
+import (
+	"bytes"
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestByteCache(t *testing.T) {
+	c, err := NewByteCache(&Config[int, []byte]{
+		NumCounters:        1000,
+		MaxCost:            1 << 12,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Synchronous:        true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	value := []byte("value")
+	require.True(t, c.Set(1, value))
+	value[0] = 'V'
+	got, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, []byte("value"), got, "the value should be copied in")
+	got[0] = 'X'
+	got, _ = c.Get(1)
+	require.Equal(t, []byte("value"), got, "the value should be copied out")
+
+	require.True(t, c.Set(1, []byte("other")))
+	require.Equal(t, 1, c.slabs.inUse(), "the replaced value should be freed")
+
+	require.True(t, c.Set(2, nil))
+	got, ok = c.Get(2)
+	require.True(t, ok)
+	require.Empty(t, got)
+
+	c.Del(1)
+	_, ok = c.Get(1)
+	require.False(t, ok)
+	require.Zero(t, c.slabs.inUse())
+
+	require.False(t, c.SetWithTTL(3, value, -1))
+	require.True(t, c.SetWithTTL(3, value, time.Hour))
+	c.Clear()
+	require.Zero(t, c.slabs.inUse())
+	require.Equal(t, int64(slabSize), c.Allocated(), "the slabs should be kept for reuse")
+	require.Equal(t, int64(1<<12), c.MaxCost())
+	require.NotEmpty(t, c.Leaks())
+
+	c.Close()
+	require.Zero(t, c.Allocated())
+	_, ok = c.Get(2)
+	require.False(t, ok)
+	require.False(t, c.Set(1, value))
+}
+
+func TestByteCacheEviction(t *testing.T) {
+	c, err := NewByteCache(&Config[int, []byte]{
+		NumCounters:        1000,
+		MaxCost:            1 << 12,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Synchronous:        true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	for key := range 1000 {
+		c.Set(key, bytes.Repeat([]byte{byte(key)}, 100))
+	}
+	require.LessOrEqual(t, int64(c.slabs.inUse())*128, c.MaxCost(),
+		"evicted and rejected values should be freed")
+	require.Positive(t, c.Metrics.KeysEvicted()+c.Metrics.SetsRejected())
+
+	for key := range 1000 {
+		if value, ok := c.Get(key); ok {
+			require.Equal(t, bytes.Repeat([]byte{byte(key)}, 100), value)
+		}
+	}
+}
+
+func TestByteCacheConcurrent(t *testing.T) {
+	c, err := NewByteCache(&Config[int, []byte]{
+		NumCounters:        1000,
+		MaxCost:            1 << 12,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Synchronous:        false,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	var wg sync.WaitGroup
+	for range runtime.NumCPU() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rd := rand.New(rand.NewSource(time.Now().UnixNano()))
+			for range 10000 {
+				key := rd.Intn(100)
+				c.Set(key, bytes.Repeat([]byte{byte(key)}, 1+rd.Intn(200)))
+				if value, ok := c.Get(key); ok {
+					require.Equal(t, bytes.Repeat([]byte{byte(key)}, len(value)), value)
+				}
+				if rd.Intn(10) == 0 {
+					c.Del(key)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	c.Clear()
+	require.Zero(t, c.slabs.inUse(), "every value should be freed")
+}
+
+func TestByteCacheConfig(t *testing.T) {
+	for _, config := range []Config[int, []byte]{
+		{OnExit: func([]byte) {}},
+		{Cost: func([]byte) int64 { return 1 }},
+		{WriteBehind: time.Second},
+		{MaxCost: -1},
+	} {
+		config.NumCounters, config.BufferItems = 100, 64
+		if config.MaxCost == 0 {
+			config.MaxCost = 10
+		}
+		_, err := NewByteCache(&config)
+		require.Error(t, err)
+	}
+}
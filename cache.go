@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"iter"
 	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
 
+	"github.com/pchchv/fulmo/clock"
 	"github.com/pchchv/fulmo/helpers"
 )
 
@@ -30,6 +32,15 @@ const (
 	rejectSets
 	dropGets // keep track of how many gets were kept and dropped on the floor
 	keepGets
+	removeCapacity // keep track of removals by cause, in the order of RemovalCause
+	removeExpired
+	removeExplicit
+	removeReplaced
+	removeCleared
+	removeRejected
+	shrinkEvict    // keep track of keys evicted because MaxCost was lowered
+	governorShrink // keep track of the decisions of the memory governor
+	governorGrow
 	doNotUse // should be the final enum. Other enums should be set before this
 )
 
@@ -43,12 +54,31 @@ type Item[V any] struct {
 	Value      V
 	Cost       int64
 	Expiration time.Time
-	wait       chan struct{}
+	// OriginalKey is the key the item was set with.
+	// It's only available when Config.StoreKeys is set, otherwise it's nil.
+	OriginalKey any
+	wait        chan struct{}
+	// slide is the sliding TTL of the item, see SetWithSlidingTTL.
+	slide time.Duration
+	// result receives the outcome of the set, see SetWithResult.
+	result chan<- SetResult[V]
+	// batch holds the items of a SetMany or DelMany, applied together.
+	batch []*Item[V]
+	// tags are the tags of the item, see WithTags.
+	tags []string
+	// ns is the namespace of the item, see Cache.Namespace.
+	ns *namespace
+	// promoted is set for items read from the SecondaryTier,
+	// they stay in it if the policy rejects them.
+	promoted bool
 }
 
 // Key is the generic type to represent the keys type in key-value pair of the cache.
 type Key = helpers.Key
 
+// Clock is the source of time of the cache, see Config.Clock.
+type Clock = clock.Clock
+
 type itemFlag byte
 
 type metricType int
@@ -100,13 +130,25 @@ type Config[K Key, V any] struct {
 	// flag to true when testing or throughput performance isn't a major factor.
 	Metrics bool
 	// OnEvict is called for every eviction with the evicted item.
+	// Clear passes it the items in the cache, but not the new items still
+	// waiting in the buffers, those never made it into the cache and only reach OnExit.
 	OnEvict func(item *Item[V])
+	// OnExpire is called for every item whose TTL has passed, with its value,
+	// cost and expiration. It's called by the periodic cleanup, or by Get
+	// if it finds the expired item first. When OnExpire is set, expired items
+	// are no longer passed to OnEvict, so the two can be told apart.
+	OnExpire func(item *Item[V])
 	// OnReject is called for every rejection done via the policy.
 	OnReject func(item *Item[V])
 	// OnExit is called whenever a value is removed from cache. This can be
 	// used to do manual memory deallocation. Would also be called on eviction
 	// as well as on rejection of the value.
 	OnExit func(val V)
+	// OnRemove is called whenever an item leaves the cache, with the reason why.
+	// Unlike OnEvict, it's also called for deletions, replaced values, cleared
+	// and rejected items, so the removals can be told apart.
+	// Replaced items are passed without their cost.
+	OnRemove func(item *Item[V], cause RemovalCause)
 	// ShouldUpdate is called when a value already exists in cache and is being updated.
 	// If ShouldUpdate returns true, the cache continues with the update (Set). If the
 	// function returns false, no changes are made in the cache. If the value doesn't
@@ -138,6 +180,9 @@ type Config[K Key, V any] struct {
 	// To signal to Ristretto that you'd like to use this Cost function:
 	//   1. Set the Cost field to a non-nil function.
 	//   2. When calling Set for new items or item updates, use a `cost` of 0.
+	//
+	// EstimateCost can be used as Cost to charge values by their estimated memory size,
+	// so MaxCost becomes a bound in bytes.
 	Cost func(value V) int64
 	// IgnoreInternalCost set to true indicates to the cache that the cost of
 	// internally storing the value should be ignored. This is useful when the
@@ -145,7 +190,99 @@ type Config[K Key, V any] struct {
 	// this to true will increase the memory usage.
 	IgnoreInternalCost bool
 	// TtlTickerDurationInSec sets the value of time ticker for cleanup keys on TTL expiry.
+	//
+	// Deprecated: use TtlTickerDuration, which allows sub-second resolution.
 	TtlTickerDurationInSec int64
+	// TtlTickerDuration sets the resolution of TTL expiration: expired keys are
+	// removed at most one TtlTickerDuration after their TTL has passed.
+	// It takes precedence over TtlTickerDurationInSec and defaults to one second.
+	TtlTickerDuration time.Duration
+	// Synchronous applies sets and deletes inline instead of buffering them
+	// for the background goroutine, so they are never dropped and Set returns
+	// whether the policy actually admitted the item.
+	// It trades throughput for determinism and suits tests
+	// and services where correctness matters more than throughput.
+	//
+	// The callbacks of the items leaving the cache (OnEvict, OnExpire, OnReject,
+	// OnExit and OnRemove) then run while the cache applies the set or delete,
+	// under a lock the writes of the cache take: calling Set, Del, Compute,
+	// UpdateMaxCost or any other writing method from them deadlocks.
+	Synchronous bool
+	// Clock is the source of time for TTL expiration and metrics.
+	// It defaults to the system clock,
+	// tests can use clocktest.Fake to control the passage of time.
+	Clock Clock
+	// Policy replaces the default TinyLFU admission and SampledLFU eviction policy.
+	// When Policy is set, NumCounters and MaxCost are not used, the policy is
+	// expected to be sized by its creator. The cache takes ownership of the policy
+	// and closes it when the cache is closed.
+	//
+	// Use NewWTinyLFUPolicy to select Window TinyLFU, which handles
+	// recency-heavy workloads better than the default policy.
+	Policy Policy[V]
+	// StoreKeys set to true keeps the original key of every item next to its value.
+	// Lookups then compare the original keys in addition to the key hashes,
+	// so keys with colliding hashes can never return each other's values.
+	// This matters for integer keys, whose conflict hash is always zero,
+	// and for custom KeyToHash functions. The original key is also passed to
+	// the OnEvict, OnReject and OnRemove callbacks via Item.OriginalKey.
+	//
+	// Keep in mind that setting this to true increases the memory usage
+	// and []byte keys are copied on every Set.
+	StoreKeys bool
+	// Loader is called by GetOrLoad to fetch values for keys missing from the cache.
+	// Concurrent GetOrLoad calls for the same key share a single Loader call.
+	Loader Loader[K, V]
+	// RefreshAfter enables refresh-ahead: once a value is older than RefreshAfter,
+	// Get keeps returning it but also starts reloading it in the background,
+	// so hot keys are replaced before their TTL runs out instead of missing.
+	// Only one reload per key runs at a time. If it fails, the current value
+	// is served until its TTL passes and the next Get tries again.
+	// RefreshAfter should be shorter than the TTL of the refreshed values.
+	// Keys of namespaces aren't refreshed, as the Loader doesn't know their namespace.
+	RefreshAfter time.Duration
+	// Refresh reloads values for RefreshAfter, the returned cost and TTL are
+	// used like in SetWithTTL. It defaults to Loader.
+	Refresh Loader[K, V]
+	// SecondaryTier, if set, receives the items evicted for lack of room,
+	// and Get looks up the keys it misses there, moving the items found back
+	// into the cache. Items of namespaces and items with tags aren't moved to the tier,
+	// and Clear and InvalidatePrefix don't reach it. It requires StoreKeys.
+	SecondaryTier SecondaryTier[K, V]
+	// Writer, if set, receives the sets and deletes of the cache,
+	// so a backing store such as a database can be kept in sync with it.
+	// By default the writes are write-through: Set and Del call the Writer before
+	// changing the cache, and a set the Writer fails on isn't cached, Set returns false.
+	// Deletes remove the key from the cache even if the Writer fails on them.
+	//
+	// Only the keys set and deleted on the cache itself are written:
+	// the keys of namespaces, values from the Loader or the SecondaryTier,
+	// restored snapshots, evictions, expirations, Clear and invalidations aren't.
+	Writer Writer[K, V]
+	// WriteBehind, if positive, makes the writes asynchronous: they're buffered,
+	// coalesced by key so only the last write of a key is kept, and passed to
+	// the Writer in batches every WriteBehind. Close flushes the buffered writes once.
+	// Use Flush to write them right away.
+	WriteBehind time.Duration
+	// WriteRetries is the number of times a write the Writer failed on is retried.
+	// Writes that are still failing are passed to OnWriteError.
+	// Without WriteBehind, the retries run on the goroutine of the set or delete,
+	// which blocks for up to the sum of the WriteRetries waits of WriteBackoff
+	// on top of the Writer calls, for example about 100 seconds for 10 retries
+	// with the default WriteBackoff. With WriteBehind, Close doesn't retry:
+	// it flushes the buffered writes once and passes the failed ones to OnWriteError.
+	WriteRetries int
+	// WriteBackoff is the wait before the first retry of a failed write,
+	// it's doubled on every following retry up to 1024 times WriteBackoff.
+	// It defaults to 100ms. The waits follow Clock.
+	WriteBackoff time.Duration
+	// OnWriteError is called with the writes that ran out of retries
+	// and the last error the Writer returned for them.
+	OnWriteError func(writes []Write[K, V], err error)
+	// MemoryGovernor, if set, adjusts MaxCost to the memory pressure of the process,
+	// lowering it and evicting keys as the heap approaches the memory limit,
+	// and raising it back when there's room. See MemoryGovernor.
+	MemoryGovernor *MemoryGovernor
 }
 
 // Metrics is a snapshot of performance statistics for the lifetime of a cache instance.
@@ -227,6 +364,33 @@ func (p *Metrics) CostEvicted() uint64 {
 	return p.get(costEvict)
 }
 
+// Removals is the number of items removed from the cache with the cause.
+func (p *Metrics) Removals(cause RemovalCause) uint64 {
+	if cause < RemovalCapacity || cause > RemovalRejected {
+		return 0
+	}
+	return p.get(cause.metric())
+}
+
+// GovernorShrinks is the number of times the memory governor lowered MaxCost,
+// see Config.MemoryGovernor.
+func (p *Metrics) GovernorShrinks() uint64 {
+	return p.get(governorShrink)
+}
+
+// GovernorGrowths is the number of times the memory governor raised MaxCost,
+// see Config.MemoryGovernor.
+func (p *Metrics) GovernorGrowths() uint64 {
+	return p.get(governorGrow)
+}
+
+// ShrinkEvictions is the number of keys evicted because MaxCost was lowered
+// below the cost of the cache, rather than to make room for new keys.
+// They are also counted by KeysEvicted.
+func (p *Metrics) ShrinkEvictions() uint64 {
+	return p.get(shrinkEvict)
+}
+
 // Ratio is the number of Hits over all accesses (Hits + Misses).
 // This is the percentage of successful Get calls.
 func (p *Metrics) Ratio() float64 {
@@ -328,7 +492,7 @@ type Cache[K Key, V any] struct {
 	// storedItems is the central concurrent hashmap where key-value items are stored.
 	storedItems store[V]
 	// cachePolicy determines what gets let in to the cache and what gets kicked out.
-	cachePolicy *defaultPolicy[V]
+	cachePolicy Policy[V]
 	// getBuf is a custom ring buffer implementation that gets pushed to when
 	// keys are read.
 	getBuf *ringBuffer
@@ -339,8 +503,12 @@ type Cache[K Key, V any] struct {
 	onEvict func(*Item[V])
 	// onReject is called when an item is rejected via admission policy.
 	onReject func(*Item[V])
+	// onExpire is called for expired items, it's nil if Config.OnExpire isn't set.
+	onExpire func(*Item[V])
 	// onExit is called whenever a value goes out of scope from the cache.
 	onExit (func(V))
+	// onRemove is called whenever an item leaves the cache.
+	onRemove func(*Item[V], RemovalCause)
 	// KeyToHash function is used to customize the key hashing algorithm.
 	// Each key will be hashed using the provided function. If keyToHash value
 	// is not set, the default keyToHash function is used.
@@ -348,6 +516,8 @@ type Cache[K Key, V any] struct {
 	// stop is used to stop the processItems goroutine.
 	stop chan struct{}
 	done chan struct{}
+	// shrink tells processItems to evict keys after MaxCost was lowered.
+	shrink chan struct{}
 	// indicates whether cache is closed.
 	isClosed atomic.Bool
 	// cost calculates cost from a value.
@@ -355,8 +525,37 @@ type Cache[K Key, V any] struct {
 	// ignoreInternalCost dictates whether to ignore the cost of internally storing
 	// the item in the cost calculation.
 	ignoreInternalCost bool
+	// storeKeys dictates whether the original keys are kept and compared.
+	storeKeys bool
 	// cleanupTicker is used to periodically check for entries whose TTL has passed.
-	cleanupTicker *time.Ticker
+	cleanupTicker clock.Ticker
+	// clock is the source of time of the cache.
+	clock Clock
+	// synchronous dictates whether sets and deletes are applied inline.
+	synchronous bool
+	// applyMu serializes applying items to the policy and the store,
+	// which happens in processItems or inline in synchronous mode.
+	applyMu sync.Mutex
+	// startTs keeps the admission time of the items for the life expectancy metrics.
+	startTs map[uint64]time.Time
+	// tags indexes the keys by the tags they were set with.
+	tags *tagIndex
+	// namespaces keeps the namespaces of the cache and their keys.
+	namespaces *namespaces
+	// tier keeps the items evicted for lack of room, if set.
+	tier SecondaryTier[K, V]
+	// writer passes the sets and deletes to Config.Writer, it's nil if it isn't set.
+	writer *writer[K, V]
+	// governor adjusts MaxCost to the memory pressure, it's nil if it isn't set.
+	governor *governor
+	// loader fetches values for keys missing from the cache in GetOrLoad.
+	loader Loader[K, V]
+	// loads deduplicates concurrent loader calls for the same key.
+	loads *loadGroup[V]
+	// refreshAfter is the age after which Get reloads values in the background.
+	refreshAfter time.Duration
+	// refresher reloads values for refreshAfter.
+	refresher Loader[K, V]
 	// Metrics contains a running log of important statistics like hits, misses,
 	// and dropped items.
 	Metrics *Metrics
@@ -364,24 +563,72 @@ type Cache[K Key, V any] struct {
 
 // NewCache returns a new Cache instance and any configuration errors, if any.
 func NewCache[K Key, V any](config *Config[K, V]) (*Cache[K, V], error) {
+	policy := config.Policy
+	if policy == nil {
+		switch {
+		case config.NumCounters == 0:
+			return nil, errors.New("NumCounters can't be zero")
+		case config.NumCounters < 0:
+			return nil, errors.New("NumCounters can't be negative")
+		case config.MaxCost == 0:
+			return nil, errors.New("MaxCost can't be zero")
+		case config.MaxCost < 0:
+			return nil, errors.New("MaxCost can't be negative")
+		}
+	}
+
 	switch {
-	case config.NumCounters == 0:
-		return nil, errors.New("NumCounters can't be zero")
-	case config.NumCounters < 0:
-		return nil, errors.New("NumCounters can't be negative")
-	case config.MaxCost == 0:
-		return nil, errors.New("MaxCost can't be zero")
-	case config.MaxCost < 0:
-		return nil, errors.New("MaxCost can't be negative")
 	case config.BufferItems == 0:
 		return nil, errors.New("BufferItems can't be zero")
 	case config.BufferItems < 0:
 		return nil, errors.New("BufferItems can't be negative")
-	case config.TtlTickerDurationInSec == 0:
-		config.TtlTickerDurationInSec = bucketDurationSecs
+	case config.TtlTickerDurationInSec < 0:
+		return nil, errors.New("TtlTickerDurationInSec can't be negative")
+	case config.TtlTickerDuration < 0:
+		return nil, errors.New("TtlTickerDuration can't be negative")
+	case config.RefreshAfter < 0:
+		return nil, errors.New("RefreshAfter can't be negative")
+	case config.RefreshAfter > 0 && config.Refresh == nil && config.Loader == nil:
+		return nil, errors.New("RefreshAfter requires Refresh or Loader")
+	case config.SecondaryTier != nil && !config.StoreKeys:
+		return nil, errors.New("SecondaryTier requires StoreKeys")
+	case config.WriteBehind < 0:
+		return nil, errors.New("WriteBehind can't be negative")
+	case config.WriteBehind > 0 && config.Writer == nil:
+		return nil, errors.New("WriteBehind requires Writer")
+	case config.WriteRetries < 0:
+		return nil, errors.New("WriteRetries can't be negative")
+	case config.WriteBackoff < 0:
+		return nil, errors.New("WriteBackoff can't be negative")
+	}
+	if config.MemoryGovernor != nil {
+		if err := config.MemoryGovernor.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	refresher := config.Refresh
+	if refresher == nil {
+		refresher = config.Loader
+	}
+
+	ttlTick := config.TtlTickerDuration
+	if ttlTick == 0 {
+		ttlTick = time.Duration(config.TtlTickerDurationInSec) * time.Second
+	}
+	if ttlTick == 0 {
+		ttlTick = defaultTtlTick
+	}
+
+	if policy == nil {
+		policy = newPolicy[V](config.NumCounters, config.MaxCost)
+	}
+
+	clk := config.Clock
+	if clk == nil {
+		clk = clock.System()
 	}
 
-	policy := newPolicy[V](config.NumCounters, config.MaxCost)
 	cache := &Cache[K, V]{
 		storedItems:        newStore[V](),
 		cachePolicy:        policy,
@@ -390,11 +637,25 @@ func NewCache[K Key, V any](config *Config[K, V]) (*Cache[K, V], error) {
 		keyToHash:          config.KeyToHash,
 		stop:               make(chan struct{}),
 		done:               make(chan struct{}),
+		shrink:             make(chan struct{}, 1),
 		cost:               config.Cost,
 		ignoreInternalCost: config.IgnoreInternalCost,
-		cleanupTicker:      time.NewTicker(time.Duration(config.TtlTickerDurationInSec) * time.Second / 2),
+		storeKeys:          config.StoreKeys,
+		cleanupTicker:      clk.NewTicker(ttlTick),
+		clock:              clk,
+		loader:             config.Loader,
+		loads:              newLoadGroup[V](),
+		synchronous:        config.Synchronous,
+		refreshAfter:       config.RefreshAfter,
+		refresher:          refresher,
+		startTs:            make(map[uint64]time.Time),
+		tags:               newTagIndex(),
+		namespaces:         newNamespaces(),
+		tier:               config.SecondaryTier,
 	}
 	cache.storedItems.SetShouldUpdateFn(config.ShouldUpdate)
+	cache.storedItems.SetClock(clk)
+	cache.storedItems.SetExpirationTick(ttlTick)
 	cache.onExit = func(val V) {
 		if config.OnExit != nil {
 			config.OnExit(val)
@@ -406,15 +667,39 @@ func NewCache[K Key, V any](config *Config[K, V]) (*Cache[K, V], error) {
 		}
 		cache.onExit(item.Value)
 	}
+	if config.OnExpire != nil {
+		cache.onExpire = func(item *Item[V]) {
+			config.OnExpire(item)
+			cache.onExit(item.Value)
+		}
+	}
 	cache.onReject = func(item *Item[V]) {
 		if config.OnReject != nil {
 			config.OnReject(item)
 		}
+		cache.onRemove(item, RemovalRejected)
 		cache.onExit(item.Value)
 	}
+	cache.onRemove = func(item *Item[V], cause RemovalCause) {
+		cache.Metrics.add(cause.metric(), item.Key, 1)
+		if cause != RemovalReplaced && cause != RemovalRejected {
+			// replaced items are reindexed by the set replacing them,
+			// and rejected ones were never indexed
+			tagged := cache.tags.del(item.Key)
+			namespaced := cache.namespaces.removed(item.Key, cause)
+			if cause == RemovalCapacity && !tagged && !namespaced {
+				cache.demote(item)
+			}
+		}
+		if config.OnRemove != nil {
+			config.OnRemove(item, cause)
+		}
+	}
 	if cache.keyToHash == nil {
 		cache.keyToHash = helpers.KeyToHash[K]
 	}
+	cache.writer = newWriter(config, clk)
+	cache.governor = newGovernor(config.MemoryGovernor, policy.MaxCost(), clk)
 
 	if config.Metrics {
 		cache.collectMetrics()
@@ -435,17 +720,64 @@ func (c *Cache[K, V]) Get(key K) (V, bool) {
 	if c == nil || c.isClosed.Load() {
 		return zeroValue[V](), false
 	}
-	keyHash, conflictHash := c.keyToHash(key)
+	return c.get(key, nil)
+}
+
+// get implements Get for the keys of the namespace, or of the cache itself if ns is nil.
+func (c *Cache[K, V]) get(key K, ns *namespace) (V, bool) {
+	l := c.lookup(key, ns)
 
-	c.getBuf.Push(keyHash)
-	value, ok := c.storedItems.Get(keyHash, conflictHash)
+	c.getBuf.Push(l.key)
+	item, ok := c.storedItems.Access(l.key, l.conflict, l.origKey)
+	c.accessed(key, l, item, ok, ns)
+	if !ok && ns == nil {
+		return c.promote(key)
+	}
+	return item.value, ok
+}
+
+// accessed records the hit or miss of a lookup of the key of the namespace (nil for the cache itself),
+// refreshing the value if it's aging and expiring the key if it's expired.
+// Keys of namespaces aren't refreshed, the Loader only knows the keys of the cache.
+func (c *Cache[K, V]) accessed(key K, l storeLookup, item storeItem[V], ok bool, ns *namespace) {
 	if ok {
-		c.Metrics.add(hit, keyHash, 1)
+		c.Metrics.add(hit, l.key, 1)
+		if ns == nil && c.refreshAfter > 0 && c.clock.Now().Sub(time.Unix(0, item.written)) >= c.refreshAfter {
+			c.refresh(key, l.key, l.conflict)
+		}
 	} else {
-		c.Metrics.add(miss, keyHash, 1)
+		c.Metrics.add(miss, l.key, 1)
+		c.expireLazily(l.key, l.conflict, l.origKey)
 	}
+}
 
-	return value, ok
+// expireLazily removes the key if it's expired but wasn't cleaned up yet,
+// so the expiration is reported as soon as it's discovered.
+func (c *Cache[K, V]) expireLazily(keyHash, conflictHash uint64, origKey any) {
+	// the lock keeps the policy consistent with the store
+	// against a concurrent set of the same key being applied.
+	// Get doesn't wait for it, a busy cache leaves the key to the periodic cleanup,
+	// which also keeps Get usable from the callbacks.
+	// Most misses are of missing keys, which are told apart without the lock.
+	if !c.storedItems.HasExpired(keyHash, conflictHash, origKey) || !c.applyMu.TryLock() {
+		return
+	}
+	defer c.applyMu.Unlock()
+	c.expireKey(keyHash, conflictHash, origKey)
+}
+
+// expireKey removes the key if it's expired.
+// The caller must hold c.applyMu.
+func (c *Cache[K, V]) expireKey(keyHash, conflictHash uint64, origKey any) {
+	si, ok := c.storedItems.DelExpired(keyHash, conflictHash, origKey)
+	if !ok {
+		return
+	}
+
+	item := si.item()
+	item.Cost = max(c.cachePolicy.Cost(keyHash), 0)
+	c.cachePolicy.Del(keyHash)
+	c.expireItem(item)
 }
 
 // GetTTL returns the TTL for the specified key and a bool that is true if the
@@ -456,7 +788,7 @@ func (c *Cache[K, V]) GetTTL(key K) (time.Duration, bool) {
 	}
 
 	keyHash, conflictHash := c.keyToHash(key)
-	if _, ok := c.storedItems.Get(keyHash, conflictHash); !ok {
+	if _, ok := c.storedItems.Get(keyHash, conflictHash, c.lookupKey(key)); !ok {
 		// not found
 		return 0, false
 	}
@@ -467,12 +799,62 @@ func (c *Cache[K, V]) GetTTL(key K) (time.Duration, bool) {
 		return 0, true
 	}
 
-	if time.Now().After(expiration) {
+	now := c.clock.Now()
+	if now.After(expiration) {
 		// found but expired
 		return 0, false
 	}
 
-	return time.Until(expiration), true
+	return expiration.Sub(now), true
+}
+
+// Range calls f sequentially for each key, value and expiration time present
+// in the cache. If f returns false, Range stops the iteration.
+// Items without expiration have a zero expiration time and expired items are skipped.
+//
+// Range walks the cache shard by shard, copying each shard under its read lock,
+// so it doesn't correspond to any consistent snapshot of the whole cache and
+// f is free to call other methods of the cache.
+// Range requires Config.StoreKeys, as otherwise the original keys
+// aren't kept and there is nothing to iterate over.
+func (c *Cache[K, V]) Range(f func(key K, value V, exp time.Time) bool) {
+	if c == nil || c.isClosed.Load() || !c.storeKeys {
+		return
+	}
+
+	now := c.clock.Now()
+	c.rangeItems(func(item storeItem[V]) bool {
+		if item.origKey == nil {
+			return true
+		}
+
+		if !item.expiration.IsZero() && now.After(item.expiration) {
+			return true
+		}
+
+		return f(item.origKey.(K), item.value, item.expiration)
+	})
+}
+
+// All returns an iterator over the keys and values present in the cache.
+// See Range for the guarantees of the iteration.
+func (c *Cache[K, V]) All() iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		c.Range(func(key K, value V, _ time.Time) bool {
+			return yield(key, value)
+		})
+	}
+}
+
+// Keys returns a snapshot of the keys present in the cache.
+// See Range for the guarantees of the snapshot.
+func (c *Cache[K, V]) Keys() []K {
+	var keys []K
+	c.Range(func(key K, _ V, _ time.Time) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
 }
 
 // Set attempts to add the key-value item to the cache. If it returns false,
@@ -480,6 +862,8 @@ func (c *Cache[K, V]) GetTTL(key K) (time.Duration, bool) {
 // If it returns true, there's still a chance it could be dropped by the policy if
 // its determined that the key-value item isn't worth keeping,
 // but otherwise the item will be added and other items will be evicted in order to make room.
+// With Config.Synchronous the policy decision is made before Set returns,
+// so true means the item was admitted (or updated).
 //
 // To dynamically evaluate the items cost using the Config.Coster function,
 // set the cost parameter to 0 and Coster will be
@@ -501,37 +885,52 @@ func (c *Cache[K, V]) Set(key K, value V, cost int64) bool {
 //
 // See Set for more information.
 func (c *Cache[K, V]) SetWithTTL(key K, value V, cost int64, ttl time.Duration) bool {
+	return c.set(key, value, setOptions{cost: cost, ttl: ttl}, nil)
+}
+
+// SetWithSlidingTTL works like SetWithTTL, but every Get that finds the item
+// pushes its expiration forward, so the item only expires after it hasn't
+// been read for ttl. A zero or negative value is treated like in SetWithTTL.
+//
+// To keep reads cheap, the expiration is moved forward in steps
+// of a small fraction of ttl, rather than on every single read.
+func (c *Cache[K, V]) SetWithSlidingTTL(key K, value V, cost int64, ttl time.Duration) bool {
+	return c.set(key, value, setOptions{cost: cost, ttl: ttl, sliding: true}, nil)
+}
+
+// set implements SetWithTTL, SetWithSlidingTTL, SetWithOptions and SetWithResult.
+// If result isn't nil, the outcome of the set is sent to it once it's known.
+func (c *Cache[K, V]) set(key K, value V, o setOptions, result chan<- SetResult[V]) bool {
 	if c == nil || c.isClosed.Load() {
+		sendResult(result, SetDiscarded, nil)
 		return false
 	}
 
-	var expiration time.Time
-	switch {
-	case ttl == 0:
-		// no expiration
-		break
-	case ttl < 0:
+	i := c.newItem(key, value, o)
+	if i == nil {
 		// treat this a no-op
+		sendResult(result, SetDiscarded, nil)
 		return false
-	default:
-		expiration = time.Now().Add(ttl)
+	}
+	i.result = result
+	if o.ns == nil && !o.loaded && !c.write(Write[K, V]{Key: key, Value: value}) {
+		sendResult(result, SetWriteFailed, nil)
+		return false
+	}
+	if o.ns == nil && !o.promoted {
+		c.dropDemoted(key)
 	}
 
-	keyHash, conflictHash := c.keyToHash(key)
-	i := &Item[V]{
-		flag:       itemNew,
-		Key:        keyHash,
-		Conflict:   conflictHash,
-		Value:      value,
-		Cost:       cost,
-		Expiration: expiration,
+	if c.synchronous {
+		c.applyMu.Lock()
+		defer c.applyMu.Unlock()
+		c.updateStored(i)
+		return c.applyItem(i)
 	}
+
 	// cost is eventually updated. The expiration must also be immediately updated
 	// to prevent items from being prematurely removed from the map
-	if prev, ok := c.storedItems.Update(i); ok {
-		c.onExit(prev)
-		i.flag = itemUpdate
-	}
+	c.updateStored(i)
 	// attempt to send item to cachePolicy
 	select {
 	case c.setBuf <- i:
@@ -541,13 +940,59 @@ func (c *Cache[K, V]) SetWithTTL(key K, value V, cost int64, ttl time.Duration)
 			// return true if this was an update operation since, already updated the storedItems
 			// for all the other operations (set/delete),
 			// return false which means the item was not inserted
+			sendResult(result, SetUpdated, nil)
 			return true
 		}
-		c.Metrics.add(dropSets, keyHash, 1)
+		c.Metrics.add(dropSets, i.Key, 1)
+		i.ns.metricsAdd(dropSets, i.Key, 1)
+		sendResult(result, SetDroppedBufferFull, nil)
 		return false
 	}
 }
 
+// newItem returns the item to set for the key,
+// or nil if the TTL is negative and the set is a no-op.
+func (c *Cache[K, V]) newItem(key K, value V, o setOptions) *Item[V] {
+	var expiration time.Time
+	switch {
+	case o.ttl == 0:
+		// no expiration
+		break
+	case o.ttl < 0:
+		return nil
+	default:
+		expiration = c.clock.Now().Add(o.ttl)
+	}
+
+	l := c.lookup(key, o.ns)
+	i := &Item[V]{
+		flag:        itemNew,
+		Key:         l.key,
+		Conflict:    l.conflict,
+		Value:       value,
+		Cost:        o.cost,
+		Expiration:  expiration,
+		OriginalKey: c.storedKey(key),
+		tags:        o.tags,
+		ns:          o.ns,
+		promoted:    o.promoted,
+	}
+	if o.sliding {
+		i.slide = o.ttl
+	}
+	return i
+}
+
+// updateStored writes the item to the store right away if the key is already there,
+// turning the item into an update.
+func (c *Cache[K, V]) updateStored(i *Item[V]) {
+	if prev, ok := c.storedItems.Update(i); ok {
+		c.replaced(i, prev)
+		c.tags.set(i.Key, i.Conflict, i.tags)
+		i.flag = itemUpdate
+	}
+}
+
 // Clear empties the hashmap and zeroes all cachePolicy counters.
 // Note that this is not an atomic operation
 // (but that shouldn't be a problem as it's assumed that Set/Get calls won't be occurring until after this).
@@ -559,6 +1004,11 @@ func (c *Cache[K, V]) Clear() {
 	// block until processItems goroutine is returned
 	c.stop <- struct{}{}
 	<-c.done
+	// only reset metrics if they're enabled,
+	// before clearing so the cleared items are counted
+	if c.Metrics != nil {
+		c.Metrics.Clear()
+	}
 	// clear out the setBuf channel
 loop:
 	for {
@@ -568,10 +1018,11 @@ loop:
 				close(i.wait)
 				continue
 			}
-			if i.flag != itemUpdate {
-				// in itemUpdate, the value is already set in the storedItems
-				// so, no need to call onEvict here
-				c.onEvict(i)
+			if i.batch == nil {
+				c.discard(i)
+			}
+			for _, bi := range i.batch {
+				c.discard(bi)
 			}
 		default:
 			break loop
@@ -579,16 +1030,31 @@ loop:
 	}
 
 	// clear value hashmap and cachePolicy data
+	c.applyMu.Lock()
 	c.cachePolicy.Clear()
-	c.storedItems.Clear(c.onEvict)
-	// only reset metrics if they're enabled
-	if c.Metrics != nil {
-		c.Metrics.Clear()
-	}
+	c.storedItems.Clear(func(i *Item[V]) {
+		c.onEvict(i)
+		c.onRemove(i, RemovalCleared)
+	})
+	clear(c.startTs)
+	c.tags.clear()
+	c.namespaces.clear()
+	c.applyMu.Unlock()
 	// restart processItems goroutine
 	go c.processItems()
 }
 
+// discard drops a buffered item that won't be applied.
+func (c *Cache[K, V]) discard(i *Item[V]) {
+	// in itemUpdate, the value is already set in the storedItems and is cleared with them,
+	// and itemDelete was already applied to the storedItems
+	if i.flag == itemNew {
+		// the item never made it into the cache, so it isn't reported as removed
+		c.onExit(i.Value)
+	}
+	sendResult(i.result, SetDiscarded, nil)
+}
+
 // Close stops all goroutines and closes all channels.
 func (c *Cache[K, V]) Close() {
 	if c == nil || c.isClosed.Load() {
@@ -599,11 +1065,17 @@ func (c *Cache[K, V]) Close() {
 	// block until processItems goroutine is returned
 	c.stop <- struct{}{}
 	<-c.done
+	if c.writer != nil {
+		c.writer.close()
+	}
 	close(c.stop)
 	close(c.done)
 	close(c.setBuf)
 	c.cachePolicy.Close()
 	c.cleanupTicker.Stop()
+	if c.governor != nil {
+		c.governor.ticker.Stop()
+	}
 	c.isClosed.Store(true)
 }
 
@@ -627,9 +1099,30 @@ func (c *Cache[K, V]) MaxCost() int64 {
 }
 
 // UpdateMaxCost updates the maxCost of an existing cache.
+// If it's lowered, keys are evicted in the background until the cache fits it,
+// like keys evicted to make room for new ones, and counted by Metrics.ShrinkEvictions.
+// With Config.Synchronous they are evicted before UpdateMaxCost returns.
+// Custom policies that can't evict on their own only evict when new keys are added.
 func (c *Cache[K, V]) UpdateMaxCost(maxCost int64) {
-	if c != nil {
-		c.cachePolicy.UpdateMaxCost(maxCost)
+	if c == nil {
+		return
+	}
+
+	shrunk := maxCost < c.cachePolicy.MaxCost()
+	c.cachePolicy.UpdateMaxCost(maxCost)
+	if !shrunk || c.isClosed.Load() {
+		return
+	}
+	if c.synchronous {
+		c.applyMu.Lock()
+		c.evictOverflow()
+		c.applyMu.Unlock()
+		return
+	}
+	select {
+	case c.shrink <- struct{}{}:
+	default:
+		// processItems is already told to evict
 	}
 }
 
@@ -646,52 +1139,51 @@ func (c *Cache[K, V]) Del(key K) {
 	if c == nil || c.isClosed.Load() {
 		return
 	}
+	c.write(Write[K, V]{Key: key, Deleted: true})
+	c.del(key, nil)
+}
+
+// del implements Del for the keys of the namespace, or of the cache itself if ns is nil.
+func (c *Cache[K, V]) del(key K, ns *namespace) {
+	l := c.lookup(key, ns)
+	keyHash, conflictHash, origKey := l.key, l.conflict, l.origKey
+	if c.tier != nil && ns == nil {
+		c.tier.Del(key)
+	}
+	if c.synchronous {
+		c.applyMu.Lock()
+		defer c.applyMu.Unlock()
+		c.applyItem(&Item[V]{
+			flag:        itemDelete,
+			Key:         keyHash,
+			Conflict:    conflictHash,
+			OriginalKey: origKey,
+		})
+		return
+	}
 
-	keyHash, conflictHash := c.keyToHash(key)
 	// delete immediately
-	_, prev := c.storedItems.Del(keyHash, conflictHash)
-	c.onExit(prev)
+	cost := c.cachePolicy.Cost(keyHash)
+	prev, ok := c.storedItems.Del(keyHash, conflictHash, origKey)
+	if ok {
+		c.deleted(prev, cost)
+	}
+	c.onExit(prev.value)
 	// If an item is set, it will be applied slightly later.
 	// Therefore, it's necessary to push the same item in
 	// `setBuf` with the deletion flag.
 	// This ensures that if a set is followed by a delete,
 	// it will be applied in the correct order.
 	c.setBuf <- &Item[V]{
-		flag:     itemDelete,
-		Key:      keyHash,
-		Conflict: conflictHash,
+		flag:        itemDelete,
+		Key:         keyHash,
+		Conflict:    conflictHash,
+		OriginalKey: origKey,
 	}
 }
 
 // processItems is ran by goroutines processing the Set buffer.
 func (c *Cache[K, V]) processItems() {
-	startTs := make(map[uint64]time.Time)
-	numToKeep := 100000 // TODO: Make this configurable via options.
-	trackAdmission := func(key uint64) {
-		if c.Metrics == nil {
-			return
-		}
-
-		startTs[key] = time.Now()
-		if len(startTs) > numToKeep {
-			for k := range startTs {
-				if len(startTs) <= numToKeep {
-					break
-				}
-				delete(startTs, k)
-			}
-		}
-	}
-	onEvict := func(i *Item[V]) {
-		if ts, has := startTs[i.Key]; has {
-			c.Metrics.trackEviction(int64(time.Since(ts) / time.Second))
-			delete(startTs, i.Key)
-		}
-		if c.onEvict != nil {
-			c.onEvict(i)
-		}
-	}
-
 	for {
 		select {
 		case i := <-c.setBuf:
@@ -699,38 +1191,26 @@ func (c *Cache[K, V]) processItems() {
 				close(i.wait)
 				continue
 			}
-			// calculate item cost value if new or update
-			if i.Cost == 0 && c.cost != nil && i.flag != itemDelete {
-				i.Cost = c.cost(i.Value)
+			c.applyMu.Lock()
+			if i.batch == nil {
+				c.applyItem(i)
 			}
-			if !c.ignoreInternalCost {
-				// add the cost of internally storing the object
-				i.Cost += itemSize
+			for _, bi := range i.batch {
+				c.applyItem(bi)
 			}
-
-			switch i.flag {
-			case itemNew:
-				victims, added := c.cachePolicy.Add(i.Key, i.Cost)
-				if added {
-					c.storedItems.Set(i)
-					c.Metrics.add(keyAdd, i.Key, 1)
-					trackAdmission(i.Key)
-				} else {
-					c.onReject(i)
-				}
-				for _, victim := range victims {
-					victim.Conflict, victim.Value = c.storedItems.Del(victim.Key, 0)
-					onEvict(victim)
-				}
-			case itemUpdate:
-				c.cachePolicy.Update(i.Key, i.Cost)
-			case itemDelete:
-				c.cachePolicy.Del(i.Key) // Deals with metrics updates.
-				_, val := c.storedItems.Del(i.Key, i.Conflict)
-				c.onExit(val)
-			}
-		case <-c.cleanupTicker.C:
-			c.storedItems.Cleanup(c.cachePolicy, onEvict)
+			c.applyMu.Unlock()
+		case <-c.cleanupTicker.C():
+			c.applyMu.Lock()
+			c.storedItems.Cleanup(c.cachePolicy, c.expireItem)
+			c.applyMu.Unlock()
+		case <-c.writer.ticks():
+			c.writer.flush(false)
+		case <-c.shrink:
+			c.applyMu.Lock()
+			c.evictOverflow()
+			c.applyMu.Unlock()
+		case <-c.governor.ticks():
+			c.govern()
 		case <-c.stop:
 			c.done <- struct{}{}
 			return
@@ -738,6 +1218,202 @@ func (c *Cache[K, V]) processItems() {
 	}
 }
 
+// applyItem applies a buffered set or delete to the policy and the store.
+// It returns false if a new item wasn't admitted by the policy
+// or if the key of a delete wasn't found.
+// The caller must hold c.applyMu.
+func (c *Cache[K, V]) applyItem(i *Item[V]) bool {
+	// calculate item cost value if new or update
+	if i.Cost == 0 && c.cost != nil && i.flag != itemDelete {
+		i.Cost = c.cost(i.Value)
+	}
+	if !c.ignoreInternalCost {
+		// add the cost of internally storing the object
+		i.Cost += itemSize
+	}
+
+	switch i.flag {
+	case itemNew:
+		var victims []*Item[V]
+		added := c.fitQuota(i)
+		if added {
+			victims, added = c.cachePolicy.Add(i.Key, i.Cost)
+		} else {
+			c.Metrics.add(rejectSets, i.Key, 1)
+		}
+		status := SetAdmitted
+		if added {
+			// add the key to its namespace first, so walks of the store never take it for a key of the cache
+			c.namespaces.add(i.ns, i.Key, i.Cost)
+			c.storedItems.Set(i)
+			c.tags.set(i.Key, i.Conflict, i.tags)
+			c.dropDemotedItem(i)
+			c.Metrics.add(keyAdd, i.Key, 1)
+			c.trackAdmission(i.Key)
+		} else {
+			status = SetRejectedByPolicy
+			if i.Cost > c.cachePolicy.MaxCost() || (i.ns != nil && i.ns.maxCost > 0 && i.Cost > i.ns.maxCost) {
+				status = SetTooLarge
+			}
+			i.ns.metricsAdd(rejectSets, i.Key, 1)
+			if !i.promoted {
+				// rejected promoted items simply stay in the tier
+				c.onReject(i)
+			}
+		}
+		c.removeVictims(victims)
+		sendResult(i.result, status, victims)
+		return added
+	case itemUpdate:
+		c.cachePolicy.Update(i.Key, i.Cost)
+		c.namespaces.update(i.ns, i.Key, i.Cost)
+		c.fitQuota(i)
+		sendResult(i.result, SetUpdated, nil)
+	case itemDelete:
+		cost := c.cachePolicy.Cost(i.Key)
+		c.cachePolicy.Del(i.Key) // Deals with metrics updates.
+		si, ok := c.storedItems.Del(i.Key, i.Conflict, i.OriginalKey)
+		if ok {
+			c.deleted(si, cost)
+		}
+		c.onExit(si.value)
+		return ok
+	}
+	return true
+}
+
+// removeVictims removes the items the policy evicted from the store.
+// The caller must hold c.applyMu.
+func (c *Cache[K, V]) removeVictims(victims []*Item[V]) {
+	for _, victim := range victims {
+		si, _ := c.storedItems.Del(victim.Key, 0, nil)
+		victim.Conflict, victim.Value, victim.OriginalKey = si.conflict, si.value, si.origKey
+		victim.Expiration = si.expiration
+		c.evictItem(victim, RemovalCapacity)
+	}
+}
+
+// evictOverflow evicts keys until the cost of the cache fits its MaxCost,
+// which it may not after MaxCost was lowered. It returns the number of evicted keys,
+// policies that don't implement overflowEvicter evict nothing.
+// The caller must hold c.applyMu.
+func (c *Cache[K, V]) evictOverflow() int {
+	p, ok := c.cachePolicy.(overflowEvicter[V])
+	if !ok {
+		return 0
+	}
+
+	victims := p.evictOverflow()
+	for _, victim := range victims {
+		c.Metrics.add(shrinkEvict, victim.Key, 1)
+	}
+	c.removeVictims(victims)
+	return len(victims)
+}
+
+// trackAdmission records the admission time of the key for the life expectancy metrics.
+// The caller must hold c.applyMu.
+func (c *Cache[K, V]) trackAdmission(key uint64) {
+	if c.Metrics == nil {
+		return
+	}
+
+	numToKeep := 100000 // TODO: Make this configurable via options.
+	c.startTs[key] = c.clock.Now()
+	if len(c.startTs) > numToKeep {
+		for k := range c.startTs {
+			if len(c.startTs) <= numToKeep {
+				break
+			}
+			delete(c.startTs, k)
+		}
+	}
+}
+
+// trackRemoval records the life expectancy of a removed key.
+// The caller must hold c.applyMu.
+func (c *Cache[K, V]) trackRemoval(key uint64) {
+	if ts, has := c.startTs[key]; has {
+		c.Metrics.trackEviction(int64(c.clock.Now().Sub(ts) / time.Second))
+		delete(c.startTs, key)
+	}
+}
+
+// evictItem tracks the life expectancy of an evicted item and calls the onEvict callback.
+// The caller must hold c.applyMu.
+func (c *Cache[K, V]) evictItem(i *Item[V], cause RemovalCause) {
+	c.trackRemoval(i.Key)
+	if c.onEvict != nil {
+		c.onEvict(i)
+	}
+	c.onRemove(i, cause)
+}
+
+// expireItem reports an item whose TTL has passed to onExpire,
+// or to onEvict if there is no onExpire callback.
+// The caller must hold c.applyMu.
+func (c *Cache[K, V]) expireItem(i *Item[V]) {
+	if c.onExpire == nil {
+		c.evictItem(i, RemovalExpired)
+		return
+	}
+
+	c.trackRemoval(i.Key)
+	c.onExpire(i)
+	c.onRemove(i, RemovalExpired)
+}
+
+// replaced reports the previous value of an item that was set again.
+func (c *Cache[K, V]) replaced(i *Item[V], prev V) {
+	c.onRemove(&Item[V]{
+		Key:         i.Key,
+		Conflict:    i.Conflict,
+		Value:       prev,
+		OriginalKey: i.OriginalKey,
+	}, RemovalReplaced)
+	c.onExit(prev)
+}
+
+// deleted reports an item deleted with Del.
+func (c *Cache[K, V]) deleted(si storeItem[V], cost int64) {
+	item := si.item()
+	item.Cost = max(cost, 0)
+	c.onRemove(item, RemovalExplicit)
+}
+
+// storedKey returns the original key to keep alongside the value,
+// or nil if original keys aren't stored.
+// []byte keys are copied, as the caller may reuse the slice.
+func (c *Cache[K, V]) storedKey(key K) any {
+	if !c.storeKeys {
+		return nil
+	}
+
+	if b, ok := any(key).([]byte); ok {
+		return bytes.Clone(b)
+	}
+	return key
+}
+
+// lookup returns the hashes and the original key (if stored) to look the key up with.
+// Keys of a namespace are hashed apart from the keys of the cache and of other namespaces.
+func (c *Cache[K, V]) lookup(key K, ns *namespace) storeLookup {
+	keyHash, conflictHash := c.keyToHash(key)
+	if ns != nil {
+		keyHash, conflictHash = ns.hash(keyHash, conflictHash)
+	}
+	return storeLookup{key: keyHash, conflict: conflictHash, origKey: c.lookupKey(key)}
+}
+
+// lookupKey returns the original key to compare stored keys against,
+// or nil if original keys aren't stored.
+func (c *Cache[K, V]) lookupKey(key K) any {
+	if !c.storeKeys {
+		return nil
+	}
+	return key
+}
+
 // collectMetrics just creates a new *Metrics instance and
 // adds the pointers to the cache and policy instances.
 func (c *Cache[K, V]) collectMetrics() {
@@ -769,6 +1445,24 @@ func stringFor(t metricType) string {
 		return "gets-dropped"
 	case keepGets:
 		return "gets-kept"
+	case removeCapacity:
+		return "removed-capacity"
+	case removeExpired:
+		return "removed-expired"
+	case removeExplicit:
+		return "removed-explicit"
+	case removeReplaced:
+		return "removed-replaced"
+	case removeCleared:
+		return "removed-cleared"
+	case removeRejected:
+		return "removed-rejected"
+	case shrinkEvict:
+		return "shrink-evictions"
+	case governorShrink:
+		return "governor-shrinks"
+	case governorGrow:
+		return "governor-growths"
 	default:
 		return "unidentified"
 	}
@@ -7,9 +7,11 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/pchchv/fulmo/clock/clocktest"
 	"github.com/pchchv/fulmo/helpers"
 	"github.com/stretchr/testify/require"
 )
@@ -337,14 +339,14 @@ func TestCacheSet(t *testing.T) {
 	retrySet(t, c, 1, 1, 1, 0)
 
 	c.Set(1, 2, 2)
-	val, ok := c.storedItems.Get(helpers.KeyToHash(1))
+	key, conflict := helpers.KeyToHash(1)
+	val, ok := c.storedItems.Get(key, conflict, nil)
 	require.True(t, ok)
 	require.Equal(t, 2, val)
 
 	c.stop <- struct{}{}
 	<-c.done
 	for i := 0; i < setBufSize; i++ {
-		key, conflict := helpers.KeyToHash(1)
 		c.setBuf <- &Item[int]{
 			flag:     itemUpdate,
 			Key:      key,
@@ -414,6 +416,242 @@ func TestCacheSetWithTTL(t *testing.T) {
 	require.Zero(t, val)
 }
 
+func TestCacheSubSecondTTL(t *testing.T) {
+	evicted := make(chan uint64, 1)
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		TtlTickerDuration:  10 * time.Millisecond,
+		OnEvict: func(item *Item[int]) {
+			evicted <- item.Key
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	start := time.Now()
+	retrySet(t, c, 1, 1, 1, 250*time.Millisecond)
+	select {
+	case key := <-evicted:
+		require.Equal(t, uint64(1), key)
+		require.GreaterOrEqual(t, time.Since(start), 250*time.Millisecond)
+		require.Less(t, time.Since(start), 500*time.Millisecond)
+	case <-time.After(time.Second):
+		t.Fatal("item wasn't expired")
+	}
+
+	_, err = NewCache(&Config[int, int]{
+		NumCounters:       100,
+		MaxCost:           10,
+		BufferItems:       64,
+		TtlTickerDuration: -time.Second,
+	})
+	require.Error(t, err)
+}
+
+func TestCacheSynchronous(t *testing.T) {
+	var evicted []uint64
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            3,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+		Synchronous:        true,
+		OnEvict: func(item *Item[int]) {
+			evicted = append(evicted, item.Key)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// every set is applied before returning, without waiting
+	for i := 0; i < 3; i++ {
+		require.True(t, c.Set(i, i, 1))
+		val, ok := c.Get(i)
+		require.True(t, ok)
+		require.Equal(t, i, val)
+	}
+	require.Equal(t, uint64(3), c.Metrics.KeysAdded())
+	require.Equal(t, int64(0), c.RemainingCost())
+
+	// too large to be admitted
+	require.False(t, c.Set(3, 3, 4))
+	_, ok := c.Get(3)
+	require.False(t, ok)
+
+	// updates apply the new cost inline
+	require.True(t, c.Set(0, 10, 2))
+	val, ok := c.Get(0)
+	require.True(t, ok)
+	require.Equal(t, 10, val)
+	require.Equal(t, int64(2), c.cachePolicy.Cost(0))
+	require.Empty(t, evicted)
+
+	c.Del(0)
+	_, ok = c.Get(0)
+	require.False(t, ok)
+	require.Equal(t, int64(-1), c.cachePolicy.Cost(0))
+
+	// sets are never dropped, even with many more than the buffer holds
+	for i := 0; i < 10*setBufSize; i++ {
+		c.Set(i%10, i, 1)
+	}
+	require.Zero(t, c.Metrics.SetsDropped())
+}
+
+func TestCacheFakeClock(t *testing.T) {
+	clk := clocktest.NewFake(time.Unix(1000, 0))
+	evicted := make(chan uint64, 1)
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		TtlTickerDuration:  time.Second,
+		Clock:              clk,
+		OnEvict: func(item *Item[int]) {
+			evicted <- item.Key
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	retrySet(t, c, 1, 1, 1, time.Minute)
+	ttl, ok := c.GetTTL(1)
+	require.True(t, ok)
+	require.Equal(t, time.Minute, ttl)
+
+	clk.Advance(59 * time.Second)
+	ttl, ok = c.GetTTL(1)
+	require.True(t, ok)
+	require.Equal(t, time.Second, ttl)
+	require.Len(t, evicted, 0)
+
+	clk.Advance(time.Second + time.Nanosecond)
+	_, ok = c.Get(1)
+	require.False(t, ok)
+
+	// the cleanup is driven by the ticker of the fake clock
+	clk.Advance(time.Second)
+	select {
+	case key := <-evicted:
+		require.Equal(t, uint64(1), key)
+	case <-time.After(time.Second):
+		t.Fatal("item wasn't expired")
+	}
+}
+
+func TestCacheOnExpire(t *testing.T) {
+	clk := clocktest.NewFake(time.Unix(1000, 0))
+	expired := make(chan *Item[int], 2)
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		TtlTickerDuration:  time.Hour,
+		Clock:              clk,
+		OnExpire: func(item *Item[int]) {
+			expired <- item
+		},
+		OnEvict: func(item *Item[int]) {
+			t.Errorf("expired item %d passed to OnEvict", item.Key)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	retrySet(t, c, 1, 10, 2, time.Minute)
+	retrySet(t, c, 2, 20, 3, time.Minute)
+	clk.Set(time.Unix(1000, 0).Add(time.Minute + time.Nanosecond))
+
+	// Get finds the expired item before the cleanup, as the ticker didn't fire
+	_, ok := c.Get(1)
+	require.False(t, ok)
+	item := <-expired
+	require.Equal(t, 10, item.Value)
+	require.Equal(t, int64(2), item.Cost)
+	require.Equal(t, time.Unix(1060, 0), item.Expiration)
+	require.Equal(t, int64(-1), c.cachePolicy.Cost(item.Key))
+
+	// the cleanup reports the other one
+	clk.Advance(time.Hour)
+	select {
+	case item = <-expired:
+		require.Equal(t, 20, item.Value)
+		require.Equal(t, int64(3), item.Cost)
+	case <-time.After(time.Second):
+		t.Fatal("item wasn't expired")
+	}
+
+	_, ok = c.Get(1)
+	require.False(t, ok)
+	require.Len(t, expired, 0)
+	require.Equal(t, int64(10), c.RemainingCost())
+}
+
+func TestCacheSlidingTTL(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clk := clocktest.NewFake(start)
+	expired := make(chan uint64, 1)
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Synchronous:        true,
+		TtlTickerDuration:  time.Second,
+		Clock:              clk,
+		OnExpire: func(item *Item[int]) {
+			expired <- item.Key
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithSlidingTTL(1, 1, 1, 10*time.Second))
+	require.True(t, c.SetWithTTL(2, 2, 1, 10*time.Second))
+
+	// reads keep the sliding item alive past its initial expiration
+	for i := 0; i < 3; i++ {
+		clk.Advance(8 * time.Second)
+		_, ok := c.Get(1)
+		require.True(t, ok)
+	}
+	ttl, ok := c.GetTTL(1)
+	require.True(t, ok)
+	require.Equal(t, 10*time.Second, ttl)
+	_, ok = c.Get(2)
+	require.False(t, ok)
+	require.Equal(t, uint64(2), <-expired)
+
+	// GetTTL isn't an access
+	clk.Advance(5 * time.Second)
+	ttl, ok = c.GetTTL(1)
+	require.True(t, ok)
+	require.Equal(t, 5*time.Second, ttl)
+
+	// the cleanup rescheduled the item at its new expiration
+	clk.Advance(6 * time.Second)
+	select {
+	case key := <-expired:
+		require.Equal(t, uint64(1), key)
+	case <-time.After(time.Second):
+		t.Fatal("item wasn't expired")
+	}
+
+	// setting the key again with a plain TTL stops the sliding
+	require.True(t, c.SetWithSlidingTTL(3, 3, 1, 10*time.Second))
+	require.True(t, c.SetWithTTL(3, 3, 1, 10*time.Second))
+	clk.Advance(8 * time.Second)
+	c.Get(3)
+	ttl, _ = c.GetTTL(3)
+	require.Equal(t, 2*time.Second, ttl)
+}
+
 func TestMultipleClose(t *testing.T) {
 	var c *Cache[int, int]
 	c.Close()
@@ -678,7 +916,7 @@ func TestCacheProcessItems(t *testing.T) {
 	}
 	time.Sleep(wait)
 	key, conflict = helpers.KeyToHash(1)
-	val, ok := c.storedItems.Get(key, conflict)
+	val, ok := c.storedItems.Get(key, conflict, nil)
 	require.False(t, ok)
 	require.Zero(t, val)
 	require.False(t, c.cachePolicy.Has(1))
@@ -793,6 +1031,132 @@ func TestCacheKeyToHash(t *testing.T) {
 	require.Equal(t, 3, keyToHashCount)
 }
 
+func TestCacheStoreKeys(t *testing.T) {
+	m := &sync.Mutex{}
+	var evicted []any
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            1,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		StoreKeys:          true,
+		// every key collides
+		KeyToHash: func(key int) (uint64, uint64) {
+			return 1, 0
+		},
+		OnEvict: func(item *Item[int]) {
+			m.Lock()
+			defer m.Unlock()
+			evicted = append(evicted, item.OriginalKey)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	retrySet(t, c, 1, 1, 1, 0)
+	_, ok := c.Get(2)
+	require.False(t, ok)
+
+	// a colliding key doesn't delete the stored one
+	c.Del(2)
+	c.Wait()
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+
+	c.Clear()
+	m.Lock()
+	require.Equal(t, []any{1}, evicted)
+	m.Unlock()
+}
+
+func TestCacheStoreKeysBytes(t *testing.T) {
+	c, err := NewCache(&Config[[]byte, int]{
+		NumCounters: 100,
+		MaxCost:     1000,
+		BufferItems: 64,
+		StoreKeys:   true,
+		KeyToHash: func(key []byte) (uint64, uint64) {
+			return 1, 0
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	key := []byte("key")
+	require.True(t, c.Set(key, 1, 1))
+	c.Wait()
+
+	// the stored key is a copy
+	key[0] = 'x'
+	_, ok := c.Get(key)
+	require.False(t, ok)
+	val, ok := c.Get([]byte("key"))
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+}
+
+func TestCacheRange(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		StoreKeys:          true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 10; i++ {
+		retrySet(t, c, i, i*10, 1, 0)
+	}
+	retrySet(t, c, 10, 100, 1, time.Hour)
+	retrySet(t, c, 11, 110, 1, 5*wait)
+	time.Sleep(5 * wait)
+
+	seen := make(map[int]int)
+	c.Range(func(key int, value int, exp time.Time) bool {
+		seen[key] = value
+		if key == 10 {
+			require.False(t, exp.IsZero())
+		} else {
+			require.True(t, exp.IsZero())
+		}
+		return true
+	})
+	require.Len(t, seen, 11)
+	for k, v := range seen {
+		require.Equal(t, k*10, v)
+	}
+
+	count := 0
+	c.Range(func(int, int, time.Time) bool {
+		count++
+		return count < 3
+	})
+	require.Equal(t, 3, count)
+
+	all := make(map[int]int)
+	for k, v := range c.All() {
+		all[k] = v
+	}
+	require.Equal(t, seen, all)
+	require.ElementsMatch(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, c.Keys())
+}
+
+func TestCacheRangeWithoutKeys(t *testing.T) {
+	c, err := newTestCache()
+	require.NoError(t, err)
+	defer c.Close()
+
+	c.Set(1, 1, 1)
+	c.Wait()
+	require.Empty(t, c.Keys())
+
+	c = nil
+	require.Empty(t, c.Keys())
+}
+
 func TestUpdateMaxCost(t *testing.T) {
 	c, err := NewCache(&Config[int, int]{
 		NumCounters: 10,
@@ -819,6 +1183,73 @@ func TestUpdateMaxCost(t *testing.T) {
 	c.Del(1)
 }
 
+func TestUpdateMaxCostEvicts(t *testing.T) {
+	for _, synchronous := range []bool{false, true} {
+		t.Run(fmt.Sprintf("synchronous=%v", synchronous), func(t *testing.T) {
+			var evicted atomic.Int64
+			c, err := NewCache(&Config[int, int]{
+				NumCounters:        1000,
+				MaxCost:            100,
+				BufferItems:        64,
+				IgnoreInternalCost: true,
+				Synchronous:        synchronous,
+				Metrics:            true,
+				OnEvict: func(item *Item[int]) {
+					evicted.Add(1)
+				},
+			})
+			require.NoError(t, err)
+			defer c.Close()
+			for key := range 100 {
+				require.True(t, c.Set(key, key, 1))
+			}
+			c.Wait()
+			require.Zero(t, c.RemainingCost())
+
+			// the keys are evicted without adding new ones
+			c.UpdateMaxCost(30)
+			require.Eventually(t, func() bool {
+				return c.RemainingCost() == 0 && evicted.Load() == 70
+			}, time.Second, time.Millisecond)
+			require.Equal(t, uint64(70), c.Metrics.ShrinkEvictions())
+			require.Equal(t, uint64(70), c.Metrics.KeysEvicted())
+			require.Equal(t, uint64(70), c.Metrics.Removals(RemovalCapacity))
+
+			// growing evicts nothing
+			c.UpdateMaxCost(100)
+			c.Wait()
+			require.Equal(t, int64(70), c.RemainingCost())
+			require.Equal(t, uint64(70), c.Metrics.ShrinkEvictions())
+		})
+	}
+}
+
+func TestUpdateMaxCostWTinyLFU(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Synchronous:        true,
+		Policy:             NewWTinyLFUPolicy[int](1000, 100),
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	for key := range 100 {
+		require.True(t, c.Set(key, key, 1))
+	}
+
+	c.UpdateMaxCost(40)
+	require.Zero(t, c.RemainingCost())
+	found := 0
+	for key := range 100 {
+		if _, ok := c.Get(key); ok {
+			found++
+		}
+	}
+	require.Equal(t, 40, found)
+}
+
 func TestRemainingCost(t *testing.T) {
 	c, err := NewCache(&Config[int, int]{
 		NumCounters: 10,
@@ -1009,9 +1440,9 @@ func TestCallocTTL(t *testing.T) {
 	require.Zero(t, helpers.NumAllocBytes())
 }
 
-// Set bucketSizeSecs to 1 to avoid waiting too much during the tests.
+// Set defaultTtlTick to 100ms to avoid waiting too much during the tests.
 func init() {
-	bucketDurationSecs = 1
+	defaultTtlTick = 100 * time.Millisecond
 }
 
 func newTestCache() (*Cache[int, int], error) {
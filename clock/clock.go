@@ -0,0 +1,45 @@
+// Package clock abstracts the passage of time,
+// so the TTL handling of the cache can be driven by a fake clock in tests.
+package clock
+
+import "time"
+
+// Clock tells the current time and creates tickers.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTicker returns a new Ticker sending the current time
+	// on its channel every d. It panics if d isn't positive.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks at intervals.
+type Ticker interface {
+	// C returns the channel on which the ticks are delivered.
+	C() <-chan time.Time
+	// Stop turns off the ticker, no more ticks will be sent.
+	Stop()
+}
+
+type systemClock struct{}
+
+// System returns the Clock backed by the time package.
+func System() Clock {
+	return systemClock{}
+}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
@@ -0,0 +1,21 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSystem(t *testing.T) {
+	c := System()
+	require.WithinDuration(t, time.Now(), c.Now(), time.Second)
+
+	ticker := c.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	select {
+	case <-ticker.C():
+	case <-time.After(time.Second):
+		t.Fatal("ticker didn't fire")
+	}
+}
@@ -0,0 +1,100 @@
+// Package clocktest provides a manually advanced clock for tests.
+package clocktest
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pchchv/fulmo/clock"
+)
+
+// Fake is a clock.Clock whose time only changes when Advance or Set is called.
+// Like time.Ticker, its tickers drop ticks for slow receivers.
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+// NewFake returns a Fake clock set to now.
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now returns the current time of the clock.
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// NewTicker returns a ticker firing every d of the clock's time.
+func (f *Fake) NewTicker(d time.Duration) clock.Ticker {
+	if d <= 0 {
+		panic("clocktest: non-positive interval for NewTicker")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := &fakeTicker{
+		c:    make(chan time.Time, 1),
+		d:    d,
+		next: f.now.Add(d),
+	}
+	f.tickers = append(f.tickers, t)
+	return t
+}
+
+// Advance moves the clock forward by d and fires the tickers that are due.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	f.setLocked(f.now.Add(d))
+	f.mu.Unlock()
+}
+
+// Set sets the clock to now and fires the tickers that are due.
+// Setting the clock backwards doesn't fire any ticker.
+func (f *Fake) Set(now time.Time) {
+	f.mu.Lock()
+	f.setLocked(now)
+	f.mu.Unlock()
+}
+
+func (f *Fake) setLocked(now time.Time) {
+	f.now = now
+	tickers := f.tickers[:0]
+	for _, t := range f.tickers {
+		if t.stopped.Load() {
+			continue
+		}
+
+		tickers = append(tickers, t)
+		if now.Before(t.next) {
+			continue
+		}
+
+		select {
+		case t.c <- now:
+		default:
+		}
+		// skip the ticks that were missed, as time.Ticker does
+		t.next = t.next.Add((now.Sub(t.next)/t.d + 1) * t.d)
+	}
+	f.tickers = tickers
+}
+
+type fakeTicker struct {
+	c       chan time.Time
+	d       time.Duration
+	next    time.Time
+	stopped atomic.Bool
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.stopped.Store(true)
+}
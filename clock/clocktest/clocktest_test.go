@@ -0,0 +1,36 @@
+package clocktest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewFake(start)
+	require.Equal(t, start, c.Now())
+
+	ticker := c.NewTicker(time.Second)
+	c.Advance(500 * time.Millisecond)
+	require.Len(t, ticker.C(), 0)
+
+	// missed ticks are dropped
+	c.Advance(3 * time.Second)
+	require.Equal(t, start.Add(3500*time.Millisecond), <-ticker.C())
+	require.Len(t, ticker.C(), 0)
+
+	c.Advance(500 * time.Millisecond)
+	require.Equal(t, start.Add(4*time.Second), <-ticker.C())
+
+	// setting the clock backwards doesn't fire
+	c.Set(start)
+	require.Len(t, ticker.C(), 0)
+
+	ticker.Stop()
+	c.Advance(time.Hour)
+	require.Len(t, ticker.C(), 0)
+
+	require.Panics(t, func() { c.NewTicker(0) })
+}
@@ -0,0 +1,150 @@
+package fulmo
+
+// Op is the operation Compute performs on the key once the value is computed.
+type Op int
+
+const (
+	// OpKeep leaves the key as it is.
+	OpKeep Op = iota
+	// OpSet sets the key to the computed value.
+	OpSet
+	// OpDelete deletes the key.
+	OpDelete
+)
+
+// Compute atomically reads, modifies and writes the value of the key.
+// fn is called with the current value and whether the key was found,
+// and returns the new value, its cost and the operation to perform.
+// A zero cost is calculated by Config.Cost, like in Set.
+//
+// fn runs under the lock of the shard of the key, so concurrent calls of Compute,
+// Set or Del of the key never interleave with it, and it must not call the cache.
+// Compute waits for the buffered sets and deletes to be applied before calling fn,
+// so fn sees them. Updated keys keep their expiration, new keys don't expire.
+// Compute ignores Config.ShouldUpdate.
+//
+// Compute returns the value of the key and whether the key is in the cache afterwards.
+// New keys may still be rejected by the policy, like in Set.
+//
+// The set or delete is passed to Config.Writer once it's applied to the cache.
+// If the Writer fails, the key is removed from the cache.
+func (c *Cache[K, V]) Compute(key K, fn func(old V, found bool) (newValue V, cost int64, op Op)) (V, bool) {
+	if c == nil || c.isClosed.Load() {
+		return zeroValue[V](), false
+	}
+
+	value, ok, op := c.compute(key, fn)
+	if op != OpKeep && !c.write(Write[K, V]{Key: key, Value: value, Deleted: op == OpDelete}) {
+		// the cache mustn't keep a value the backing store doesn't have
+		c.del(key, nil)
+		return zeroValue[V](), false
+	}
+	return value, ok
+}
+
+// compute implements Compute, it also returns the operation fn chose.
+func (c *Cache[K, V]) compute(key K, fn func(old V, found bool) (V, int64, Op)) (V, bool, Op) {
+	if !c.synchronous {
+		// apply the buffered sets and deletes, so fn sees them
+		c.Wait()
+	}
+
+	l := c.lookup(key, nil)
+	c.applyMu.Lock()
+	defer c.applyMu.Unlock()
+	c.expireKey(l.key, l.conflict, l.origKey)
+
+	var (
+		value V
+		cost  int64
+		op    Op
+	)
+	prev, found := c.storedItems.Compute(l.key, l.conflict, l.origKey, func(item storeItem[V], found bool) (V, Op) {
+		value, cost, op = fn(item.value, found)
+		return value, op
+	})
+
+	switch {
+	case op == OpSet && found:
+		i := &Item[V]{
+			flag:        itemUpdate,
+			Key:         l.key,
+			Conflict:    l.conflict,
+			Value:       value,
+			Cost:        cost,
+			Expiration:  prev.expiration,
+			OriginalKey: prev.origKey,
+			slide:       prev.slide,
+		}
+		c.replaced(i, prev.value)
+		c.applyItem(i)
+		return value, true, op
+	case op == OpSet:
+		c.dropDemoted(key)
+		added := c.applyItem(&Item[V]{
+			flag:        itemNew,
+			Key:         l.key,
+			Conflict:    l.conflict,
+			Value:       value,
+			Cost:        cost,
+			OriginalKey: c.storedKey(key),
+		})
+		return value, added, op
+	case op == OpDelete && found:
+		cost := c.cachePolicy.Cost(l.key)
+		c.cachePolicy.Del(l.key)
+		c.deleted(prev, cost)
+		c.onExit(prev.value)
+		return zeroValue[V](), false, op
+	}
+
+	return prev.value, found, op
+}
+
+// SetIfAbsent sets the value of the key only if the key isn't in the cache.
+// It returns true if the value was set and admitted by the policy.
+// See Compute for the guarantees.
+func (c *Cache[K, V]) SetIfAbsent(key K, value V, cost int64) bool {
+	set := false
+	_, ok := c.Compute(key, func(_ V, found bool) (V, int64, Op) {
+		if found {
+			return zeroValue[V](), 0, OpKeep
+		}
+		set = true
+		return value, cost, OpSet
+	})
+	return set && ok
+}
+
+// CompareAndSwap sets the value of the key to new
+// only if the key is in the cache with a value equal to old.
+// It returns true if the value was swapped. See Compute for the guarantees.
+//
+// Like sync.Map.CompareAndSwap, it panics if the values aren't comparable.
+func (c *Cache[K, V]) CompareAndSwap(key K, old, new V, cost int64) bool {
+	swapped := false
+	_, ok := c.Compute(key, func(cur V, found bool) (V, int64, Op) {
+		if !found || any(cur) != any(old) {
+			return zeroValue[V](), 0, OpKeep
+		}
+		swapped = true
+		return new, cost, OpSet
+	})
+	return swapped && ok
+}
+
+// CompareAndDelete deletes the key only if it's in the cache with a value equal to old.
+// It returns true if the key was deleted. See Compute for the guarantees.
+//
+// Like sync.Map.CompareAndDelete, it panics if the values aren't comparable.
+func (c *Cache[K, V]) CompareAndDelete(key K, old V) bool {
+	deleted := false
+	c.Compute(key, func(cur V, found bool) (V, int64, Op) {
+		if !found || any(cur) != any(old) {
+			return zeroValue[V](), 0, OpKeep
+		}
+		deleted = true
+		return zeroValue[V](), 0, OpDelete
+	})
+	return deleted
+}
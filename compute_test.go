@@ -0,0 +1,152 @@
+package fulmo
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pchchv/fulmo/clock/clocktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheCompute(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            1000,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	inc := func(old int, found bool) (int, int64, Op) {
+		return old + 1, 1, OpSet
+	}
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				c.Compute(1, inc)
+			}
+		}()
+	}
+	wg.Wait()
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 1000, val, "no increment should be lost")
+
+	// buffered sets are seen by fn
+	c.Set(2, 10, 1)
+	val, ok = c.Compute(2, inc)
+	require.True(t, ok)
+	require.Equal(t, 11, val)
+
+	// the cost change reaches the policy
+	c.Compute(2, func(old int, found bool) (int, int64, Op) {
+		return old, 5, OpSet
+	})
+	require.Equal(t, int64(1000-1-5), c.RemainingCost())
+
+	val, ok = c.Compute(2, func(old int, found bool) (int, int64, Op) {
+		require.True(t, found)
+		return 0, 0, OpDelete
+	})
+	require.False(t, ok)
+	require.Zero(t, val)
+	_, ok = c.Get(2)
+	require.False(t, ok)
+	require.Equal(t, int64(1000-1), c.RemainingCost())
+
+	val, ok = c.Compute(3, func(old int, found bool) (int, int64, Op) {
+		require.False(t, found)
+		return 30, 1, OpKeep
+	})
+	require.False(t, ok)
+	require.Zero(t, val)
+	_, ok = c.Get(3)
+	require.False(t, ok)
+
+	var nilCache *Cache[int, int]
+	_, ok = nilCache.Compute(1, inc)
+	require.False(t, ok)
+}
+
+func TestCacheComputeKeepsExpiration(t *testing.T) {
+	clk := clocktest.NewFake(time.Now())
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            1000,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		Clock:              clk,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	c.SetWithTTL(1, 1, 1, time.Hour)
+	c.Compute(1, func(old int, found bool) (int, int64, Op) {
+		return old + 1, 1, OpSet
+	})
+
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 2, val)
+	ttl, ok := c.GetTTL(1)
+	require.True(t, ok)
+	require.Equal(t, time.Hour, ttl)
+
+	// expired keys are not found
+	c.SetWithTTL(2, 2, 1, time.Second)
+	c.Wait()
+	clk.Advance(2 * time.Second)
+	c.Compute(2, func(old int, found bool) (int, int64, Op) {
+		require.False(t, found)
+		return 0, 0, OpKeep
+	})
+	require.Equal(t, uint64(1), c.Metrics.Removals(RemovalExpired))
+}
+
+func TestCacheSetIfAbsent(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            1000,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	require.True(t, c.SetIfAbsent(1, 1, 1))
+	require.False(t, c.SetIfAbsent(1, 2, 1))
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+}
+
+func TestCacheCompareAndSwap(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            1000,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	require.False(t, c.CompareAndSwap(1, 0, 1, 1), "missing keys are not swapped")
+
+	c.Set(1, 1, 1)
+	require.False(t, c.CompareAndSwap(1, 2, 3, 1))
+	require.True(t, c.CompareAndSwap(1, 1, 3, 1))
+	val, _ := c.Get(1)
+	require.Equal(t, 3, val)
+
+	require.False(t, c.CompareAndDelete(1, 1))
+	require.True(t, c.CompareAndDelete(1, 3))
+	_, ok := c.Get(1)
+	require.False(t, ok)
+	require.False(t, c.CompareAndDelete(1, 3))
+}
@@ -0,0 +1,481 @@
+// Package disktier implements a fulmo.SecondaryTier keeping
+// the items evicted from a cache in append-only segment files on local disk.
+package disktier
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pchchv/fulmo"
+	"github.com/pchchv/fulmo/clock"
+)
+
+const (
+	segmentExt = ".seg"
+	// headerSize is the size of the fixed part of a record:
+	// checksum, op, key length, value length, cost and expiration.
+	headerSize = 4 + 1 + 4 + 4 + 8 + 8
+	// ops of the records
+	opPut byte = 1
+	opDel byte = 2
+)
+
+var (
+	// ErrClosed is returned by the methods of a closed Tier.
+	ErrClosed = errors.New("disk tier is closed")
+	// errCorrupt is returned when a record doesn't match its checksum.
+	errCorrupt = errors.New("corrupt disk tier record")
+)
+
+// Config is passed to New for creating a Tier.
+type Config struct {
+	// Dir is the directory the segment files are kept in.
+	// It's created if needed and the items already there are loaded.
+	Dir string
+	// MaxBytes is the capacity of the tier. Once the segments take more space,
+	// the oldest segment is dropped along with all its items.
+	MaxBytes int64
+	// SegmentBytes is the size after which a new segment is started.
+	// It defaults to an eighth of MaxBytes.
+	SegmentBytes int64
+	// TTL caps how long items are kept in the tier, zero keeps them for their own TTL.
+	TTL time.Duration
+	// Clock is the source of time for the TTLs, it defaults to the system clock.
+	Clock fulmo.Clock
+}
+
+// Tier is a fulmo.SecondaryTier storing items in append-only segment files.
+// Every put or removal appends a record to the newest segment, and an in-memory
+// index points every key to its latest record, so reads take a single disk read.
+// Space is reclaimed by dropping whole segments, oldest first.
+type Tier[K fulmo.Key, V any] struct {
+	mu       sync.Mutex
+	config   Config
+	codec    fulmo.Codec[K, V]
+	segments []*segment
+	index    map[string]location
+	size     int64
+	closed   bool
+}
+
+// segment is an open segment file.
+type segment struct {
+	id   uint64
+	file *os.File
+	size int64
+}
+
+// location is the position of the latest record of a key.
+type location struct {
+	segment  uint64
+	offset   int64
+	size     int64
+	cost     int64
+	expireAt int64
+}
+
+// record is a decoded record.
+type record struct {
+	op       byte
+	key      []byte
+	value    []byte
+	cost     int64
+	expireAt int64
+}
+
+// New opens the tier in config.Dir, loading the items already there.
+// Keys and values are encoded with codec.
+func New[K fulmo.Key, V any](codec fulmo.Codec[K, V], config Config) (*Tier[K, V], error) {
+	switch {
+	case config.Dir == "":
+		return nil, errors.New("Dir can't be empty")
+	case config.MaxBytes <= 0:
+		return nil, errors.New("MaxBytes must be positive")
+	case config.SegmentBytes < 0:
+		return nil, errors.New("SegmentBytes can't be negative")
+	case config.TTL < 0:
+		return nil, errors.New("TTL can't be negative")
+	}
+
+	if config.SegmentBytes == 0 {
+		config.SegmentBytes = max(config.MaxBytes/8, 1)
+	}
+	if config.Clock == nil {
+		config.Clock = clock.System()
+	}
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	t := &Tier[K, V]{
+		config: config,
+		codec:  codec,
+		index:  make(map[string]location),
+	}
+	if err := t.load(); err != nil {
+		t.closeSegments()
+		return nil, err
+	}
+	return t, nil
+}
+
+// Put stores the item with the TTL it has left, zero meaning it doesn't expire.
+// Items that can't be encoded or written are dropped.
+func (t *Tier[K, V]) Put(key K, value V, cost int64, ttl time.Duration) {
+	_ = t.put(key, value, cost, ttl)
+}
+
+// Get returns the item with the TTL it has left, without removing it.
+// Expired items are removed.
+func (t *Tier[K, V]) Get(key K) (value V, cost int64, ttl time.Duration, ok bool) {
+	k, err := t.codec.EncodeKey(key)
+	if err != nil {
+		return value, 0, 0, false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return value, 0, 0, false
+	}
+
+	loc, found := t.index[string(k)]
+	if !found {
+		return value, 0, 0, false
+	}
+
+	now := t.now()
+	if loc.expireAt != 0 && now >= loc.expireAt {
+		_ = t.remove(k)
+		return value, 0, 0, false
+	}
+	rec, err := t.read(loc)
+	if err != nil {
+		// the record is unreadable, drop it
+		_ = t.remove(k)
+		return value, 0, 0, false
+	}
+	if value, err = t.codec.DecodeValue(rec.value); err != nil {
+		return value, 0, 0, false
+	}
+
+	if loc.expireAt != 0 {
+		ttl = time.Duration(loc.expireAt - now)
+	}
+	return value, loc.cost, ttl, true
+}
+
+// Del removes the item from the tier, if it's there.
+func (t *Tier[K, V]) Del(key K) {
+	k, err := t.codec.EncodeKey(key)
+	if err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.closed {
+		_ = t.remove(k)
+	}
+}
+
+// Len returns the number of items in the tier, including the expired ones not dropped yet.
+func (t *Tier[K, V]) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.index)
+}
+
+// Size returns the total size of the segment files.
+func (t *Tier[K, V]) Size() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.size
+}
+
+// Close closes the segment files. The items stay on disk
+// and are loaded by the next Tier opened in the same directory.
+func (t *Tier[K, V]) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrClosed
+	}
+
+	t.closed = true
+	return t.closeSegments()
+}
+
+func (t *Tier[K, V]) put(key K, value V, cost int64, ttl time.Duration) error {
+	k, err := t.codec.EncodeKey(key)
+	if err != nil {
+		return err
+	}
+	v, err := t.codec.EncodeValue(value)
+	if err != nil {
+		return err
+	}
+
+	if t.config.TTL > 0 && (ttl <= 0 || ttl > t.config.TTL) {
+		ttl = t.config.TTL
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrClosed
+	}
+
+	var expireAt int64
+	if ttl > 0 {
+		expireAt = t.now() + int64(ttl)
+	}
+	loc, err := t.append(record{op: opPut, key: k, value: v, cost: cost, expireAt: expireAt})
+	if err != nil {
+		return err
+	}
+
+	t.index[string(k)] = loc
+	return t.shrink()
+}
+
+// remove appends a removal record for the key if it's in the index,
+// so the key stays removed when the tier is loaded again.
+// The caller must hold the lock.
+func (t *Tier[K, V]) remove(k []byte) error {
+	if _, ok := t.index[string(k)]; !ok {
+		return nil
+	}
+
+	delete(t.index, string(k))
+	if _, err := t.append(record{op: opDel, key: k}); err != nil {
+		return err
+	}
+	return t.shrink()
+}
+
+// append writes the record to the newest segment, starting a new one if it's full.
+// The caller must hold the lock.
+func (t *Tier[K, V]) append(rec record) (location, error) {
+	if len(t.segments) == 0 || t.segments[len(t.segments)-1].size >= t.config.SegmentBytes {
+		var id uint64
+		if len(t.segments) > 0 {
+			id = t.segments[len(t.segments)-1].id + 1
+		}
+		if err := t.openSegment(id, true); err != nil {
+			return location{}, err
+		}
+	}
+
+	seg := t.segments[len(t.segments)-1]
+	buf := encode(rec)
+	if _, err := seg.file.WriteAt(buf, seg.size); err != nil {
+		return location{}, err
+	}
+
+	loc := location{
+		segment:  seg.id,
+		offset:   seg.size,
+		size:     int64(len(buf)),
+		cost:     rec.cost,
+		expireAt: rec.expireAt,
+	}
+	seg.size += loc.size
+	t.size += loc.size
+	return loc, nil
+}
+
+// shrink drops the oldest segments until the tier fits in MaxBytes,
+// always keeping the newest segment.
+// The caller must hold the lock.
+func (t *Tier[K, V]) shrink() error {
+	for t.size > t.config.MaxBytes && len(t.segments) > 1 {
+		oldest := t.segments[0]
+		for k, loc := range t.index {
+			if loc.segment == oldest.id {
+				delete(t.index, k)
+			}
+		}
+
+		t.segments = t.segments[1:]
+		t.size -= oldest.size
+		oldest.file.Close()
+		if err := os.Remove(oldest.file.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read reads the record at the location.
+// The caller must hold the lock.
+func (t *Tier[K, V]) read(loc location) (record, error) {
+	i, found := slices.BinarySearchFunc(t.segments, loc.segment, func(s *segment, id uint64) int {
+		return cmp.Compare(s.id, id)
+	})
+	if !found {
+		return record{}, fmt.Errorf("segment %d not found", loc.segment)
+	}
+
+	buf := make([]byte, loc.size)
+	if _, err := t.segments[i].file.ReadAt(buf, loc.offset); err != nil {
+		return record{}, err
+	}
+
+	rec, _, err := decode(buf)
+	return rec, err
+}
+
+// load opens the segments of the directory and rebuilds the index from their records.
+func (t *Tier[K, V]) load() error {
+	entries, err := os.ReadDir(t.config.Dir)
+	if err != nil {
+		return err
+	}
+
+	var ids []uint64
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), segmentExt)
+		if !ok || e.IsDir() {
+			continue
+		}
+		if id, err := strconv.ParseUint(name, 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+
+	now := t.now()
+	for _, id := range ids {
+		if err := t.openSegment(id, false); err != nil {
+			return err
+		}
+
+		seg := t.segments[len(t.segments)-1]
+		data, err := io.ReadAll(io.NewSectionReader(seg.file, 0, seg.size))
+		if err != nil {
+			return err
+		}
+
+		var offset int64
+		for offset < int64(len(data)) {
+			rec, n, err := decode(data[offset:])
+			if err != nil {
+				// a torn write at the end of the segment, drop the rest of it
+				break
+			}
+
+			switch {
+			case rec.op == opDel, rec.expireAt != 0 && now >= rec.expireAt:
+				delete(t.index, string(rec.key))
+			default:
+				t.index[string(rec.key)] = location{
+					segment:  id,
+					offset:   offset,
+					size:     int64(n),
+					cost:     rec.cost,
+					expireAt: rec.expireAt,
+				}
+			}
+			offset += int64(n)
+		}
+
+		if offset < seg.size {
+			if err := seg.file.Truncate(offset); err != nil {
+				return err
+			}
+			t.size -= seg.size - offset
+			seg.size = offset
+		}
+	}
+	return t.shrink()
+}
+
+// openSegment opens the segment file with the id, creating it if create is set.
+// The caller must hold the lock.
+func (t *Tier[K, V]) openSegment(id uint64, create bool) error {
+	flag := os.O_RDWR
+	if create {
+		flag |= os.O_CREATE | os.O_EXCL
+	}
+
+	path := filepath.Join(t.config.Dir, fmt.Sprintf("%020d%s", id, segmentExt))
+	f, err := os.OpenFile(path, flag, 0o644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	t.segments = append(t.segments, &segment{id: id, file: f, size: info.Size()})
+	t.size += info.Size()
+	return nil
+}
+
+func (t *Tier[K, V]) closeSegments() error {
+	var errs []error
+	for _, seg := range t.segments {
+		errs = append(errs, seg.file.Close())
+	}
+	t.segments = nil
+	return errors.Join(errs...)
+}
+
+func (t *Tier[K, V]) now() int64 {
+	return t.config.Clock.Now().UnixNano()
+}
+
+// encode returns the record as it's written to a segment.
+func encode(rec record) []byte {
+	buf := make([]byte, headerSize+len(rec.key)+len(rec.value))
+	buf[4] = rec.op
+	binary.LittleEndian.PutUint32(buf[5:], uint32(len(rec.key)))
+	binary.LittleEndian.PutUint32(buf[9:], uint32(len(rec.value)))
+	binary.LittleEndian.PutUint64(buf[13:], uint64(rec.cost))
+	binary.LittleEndian.PutUint64(buf[21:], uint64(rec.expireAt))
+	copy(buf[headerSize:], rec.key)
+	copy(buf[headerSize+len(rec.key):], rec.value)
+	binary.LittleEndian.PutUint32(buf, crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+// decode decodes the record at the start of buf and returns its size.
+func decode(buf []byte) (record, int, error) {
+	if len(buf) < headerSize {
+		return record{}, 0, errCorrupt
+	}
+
+	keyLen := int(binary.LittleEndian.Uint32(buf[5:]))
+	valueLen := int(binary.LittleEndian.Uint32(buf[9:]))
+	n := headerSize + keyLen + valueLen
+	if keyLen < 0 || valueLen < 0 || n > len(buf) || n < headerSize {
+		return record{}, 0, errCorrupt
+	}
+	if binary.LittleEndian.Uint32(buf) != crc32.ChecksumIEEE(buf[4:n]) {
+		return record{}, 0, errCorrupt
+	}
+
+	rec := record{
+		op:       buf[4],
+		key:      buf[headerSize : headerSize+keyLen],
+		value:    buf[headerSize+keyLen : n],
+		cost:     int64(binary.LittleEndian.Uint64(buf[13:])),
+		expireAt: int64(binary.LittleEndian.Uint64(buf[21:])),
+	}
+	return rec, n, nil
+}
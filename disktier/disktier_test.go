@@ -0,0 +1,162 @@
+package disktier
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pchchv/fulmo"
+	"github.com/pchchv/fulmo/clock/clocktest"
+	"github.com/stretchr/testify/require"
+)
+
+func newTier(t *testing.T, config Config) *Tier[string, string] {
+	if config.Dir == "" {
+		config.Dir = t.TempDir()
+	}
+	if config.MaxBytes == 0 {
+		config.MaxBytes = 1 << 20
+	}
+
+	tier, err := New(fulmo.GobCodec[string, string]{}, config)
+	require.NoError(t, err)
+	t.Cleanup(func() { tier.Close() })
+	return tier
+}
+
+func TestTierPutGet(t *testing.T) {
+	tier := newTier(t, Config{})
+	tier.Put("a", "1", 3, 0)
+	tier.Put("b", "2", 4, 0)
+	tier.Put("a", "3", 5, 0)
+	require.Equal(t, 2, tier.Len())
+
+	value, cost, ttl, ok := tier.Get("a")
+	require.True(t, ok)
+	require.Equal(t, "3", value)
+	require.Equal(t, int64(5), cost)
+	require.Zero(t, ttl)
+
+	_, _, _, ok = tier.Get("a")
+	require.True(t, ok, "items should be kept until they're deleted")
+
+	tier.Del("a")
+	tier.Del("b")
+	_, _, _, ok = tier.Get("b")
+	require.False(t, ok)
+	require.Zero(t, tier.Len())
+}
+
+func TestTierTTL(t *testing.T) {
+	clk := clocktest.NewFake(time.Unix(1000, 0))
+	tier := newTier(t, Config{Clock: clk, TTL: time.Hour})
+	tier.Put("a", "1", 1, time.Minute)
+	tier.Put("b", "2", 1, 0)
+	tier.Put("c", "3", 1, 0)
+
+	clk.Advance(30 * time.Second)
+	_, _, ttl, ok := tier.Get("a")
+	require.True(t, ok)
+	require.Equal(t, 30*time.Second, ttl)
+
+	_, _, ttl, ok = tier.Get("b")
+	require.True(t, ok)
+	require.Equal(t, time.Hour-30*time.Second, ttl, "the TTL of the tier should cap the items")
+
+	clk.Advance(time.Hour)
+	_, _, _, ok = tier.Get("c")
+	require.False(t, ok)
+}
+
+func TestTierMaxBytes(t *testing.T) {
+	tier := newTier(t, Config{MaxBytes: 4096, SegmentBytes: 1024})
+	for i := range 100 {
+		tier.Put(string(rune('a'+i%26))+string(rune('a'+i/26)), "value", 1, 0)
+	}
+	require.LessOrEqual(t, tier.Size(), int64(4096))
+	require.Less(t, tier.Len(), 100)
+
+	// the newest items are kept
+	_, _, _, ok := tier.Get(string(rune('a'+99%26)) + string(rune('a'+99/26)))
+	require.True(t, ok)
+	_, _, _, ok = tier.Get("aa")
+	require.False(t, ok)
+
+	files, err := os.ReadDir(tier.config.Dir)
+	require.NoError(t, err)
+	require.LessOrEqual(t, len(files), 5)
+}
+
+func TestTierReopen(t *testing.T) {
+	dir := t.TempDir()
+	tier := newTier(t, Config{Dir: dir, SegmentBytes: 64})
+	tier.Put("a", "1", 1, 0)
+	tier.Put("b", "2", 2, 0)
+	tier.Put("c", "3", 3, 0)
+	tier.Del("b")
+	require.NoError(t, tier.Close())
+	require.ErrorIs(t, tier.Close(), ErrClosed)
+
+	// a torn write at the end of the newest segment is dropped
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	require.NoError(t, err)
+	f, err := os.OpenFile(files[len(files)-1], os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{1, 2, 3})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	tier = newTier(t, Config{Dir: dir, SegmentBytes: 64})
+	require.Equal(t, 2, tier.Len())
+	value, cost, _, ok := tier.Get("c")
+	require.True(t, ok)
+	require.Equal(t, "3", value)
+	require.Equal(t, int64(3), cost)
+	_, _, _, ok = tier.Get("b")
+	require.False(t, ok, "deleted items should stay deleted")
+
+	tier.Put("d", "4", 4, 0)
+	value, _, _, ok = tier.Get("d")
+	require.True(t, ok)
+	require.Equal(t, "4", value)
+}
+
+func TestTierConfig(t *testing.T) {
+	codec := fulmo.GobCodec[string, string]{}
+	for _, config := range []Config{
+		{MaxBytes: 1},
+		{Dir: t.TempDir()},
+		{Dir: t.TempDir(), MaxBytes: 1, SegmentBytes: -1},
+		{Dir: t.TempDir(), MaxBytes: 1, TTL: -1},
+	} {
+		_, err := New(codec, config)
+		require.Error(t, err)
+	}
+}
+
+func TestTierCache(t *testing.T) {
+	tier := newTier(t, Config{})
+	c, err := fulmo.NewCache(&fulmo.Config[string, string]{
+		NumCounters:        100,
+		MaxCost:            3,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		StoreKeys:          true,
+		Synchronous:        true,
+		SecondaryTier:      tier,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		require.True(t, c.Set(key, "value-"+key, 1))
+	}
+	require.Equal(t, 2, tier.Len(), "evicted items should be demoted")
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		value, ok := c.Get(key)
+		require.True(t, ok, "key %s should be found in one of the tiers", key)
+		require.Equal(t, "value-"+key, value)
+	}
+}
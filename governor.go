@@ -0,0 +1,181 @@
+package fulmo
+
+import (
+	"errors"
+	"math"
+	"runtime/metrics"
+	"time"
+
+	"github.com/pchchv/fulmo/clock"
+)
+
+const (
+	defaultGovernorInterval = time.Second
+	defaultGovernorTarget   = 0.8
+)
+
+// MemoryGovernor adjusts the MaxCost of a cache to the memory pressure of the process,
+// see Config.MemoryGovernor. It assumes the costs of the items are their sizes
+// in bytes, which EstimateCost helps with.
+//
+// Every Interval, it reads the live heap and the memory limit from runtime/metrics.
+// When the live heap is over Target of the limit, MaxCost is lowered by the excess
+// and the cache evicts keys right away until it fits, instead of waiting for new keys.
+// When the live heap is under the target, MaxCost is raised by half of the headroom.
+// As the live heap is only measured by the garbage collector,
+// MaxCost is changed at most once per collection.
+//
+// The decisions are counted by Metrics.GovernorShrinks, Metrics.GovernorGrowths
+// and Metrics.ShrinkEvictions.
+type MemoryGovernor struct {
+	// MinCost is the lowest MaxCost the governor sets. It defaults to a tenth of MaxCost.
+	MinCost int64
+	// MaxCost is the highest MaxCost the governor sets. It defaults to Config.MaxCost.
+	MaxCost int64
+	// Limit is the memory limit of the process in bytes. It defaults to the limit
+	// set with GOMEMLIMIT or debug.SetMemoryLimit. Without a limit,
+	// the governor keeps MaxCost at its highest.
+	Limit int64
+	// Target is the share of Limit the live heap should stay under, between 0 and 1.
+	// It defaults to 0.8.
+	Target float64
+	// Interval is how often the memory is read. It defaults to one second.
+	Interval time.Duration
+}
+
+// memReading is what the governor reads from runtime/metrics.
+type memReading struct {
+	live   int64
+	limit  int64
+	cycles uint64
+}
+
+// governor runs the MemoryGovernor of a cache from processItems.
+type governor struct {
+	MemoryGovernor
+	ticker clock.Ticker
+	read   func() memReading
+	// cycles is the number of garbage collections at the last reading.
+	cycles uint64
+}
+
+func (g *MemoryGovernor) validate() error {
+	switch {
+	case g.MinCost < 0:
+		return errors.New("MemoryGovernor.MinCost can't be negative")
+	case g.MaxCost < 0:
+		return errors.New("MemoryGovernor.MaxCost can't be negative")
+	case g.MaxCost > 0 && g.MinCost > g.MaxCost:
+		return errors.New("MemoryGovernor.MinCost can't be greater than MaxCost")
+	case g.Limit < 0:
+		return errors.New("MemoryGovernor.Limit can't be negative")
+	case g.Target < 0 || g.Target > 1:
+		return errors.New("MemoryGovernor.Target must be between 0 and 1")
+	case g.Interval < 0:
+		return errors.New("MemoryGovernor.Interval can't be negative")
+	}
+	return nil
+}
+
+// newGovernor returns the governor of the config, or nil if it isn't set.
+// maxCost is the initial MaxCost of the cache.
+func newGovernor(config *MemoryGovernor, maxCost int64, clk Clock) *governor {
+	if config == nil {
+		return nil
+	}
+
+	g := &governor{MemoryGovernor: *config, read: readMemory}
+	if g.MaxCost == 0 {
+		g.MaxCost = maxCost
+	}
+	if g.MinCost == 0 {
+		g.MinCost = max(g.MaxCost/10, 1)
+	}
+	if g.Target == 0 {
+		g.Target = defaultGovernorTarget
+	}
+	if g.Interval == 0 {
+		g.Interval = defaultGovernorInterval
+	}
+	g.ticker = clk.NewTicker(g.Interval)
+	return g
+}
+
+// readMemory reads the live heap, the memory limit and
+// the number of garbage collections of the process.
+func readMemory() memReading {
+	samples := []metrics.Sample{
+		{Name: "/gc/heap/live:bytes"},
+		{Name: "/gc/gomemlimit:bytes"},
+		{Name: "/gc/cycles/total:gc-cycles"},
+	}
+	metrics.Read(samples)
+
+	values := make([]uint64, len(samples))
+	for idx, s := range samples {
+		if s.Value.Kind() == metrics.KindUint64 {
+			values[idx] = s.Value.Uint64()
+		}
+	}
+	return memReading{
+		live:   int64(min(values[0], math.MaxInt64)),
+		limit:  int64(min(values[1], math.MaxInt64)),
+		cycles: values[2],
+	}
+}
+
+// next returns the MaxCost that keeps the live heap under the target of the limit.
+func (g *governor) next(maxCost int64, r memReading) int64 {
+	limit := g.Limit
+	if limit == 0 {
+		limit = r.limit
+	}
+	if limit <= 0 || limit == math.MaxInt64 {
+		// there's no limit to stay under
+		return g.MaxCost
+	}
+
+	target := int64(float64(limit) * g.Target)
+	if r.live > target {
+		maxCost -= r.live - target
+	} else {
+		maxCost += (target - r.live) / 2
+	}
+	return min(max(maxCost, g.MinCost), g.MaxCost)
+}
+
+// ticks returns the channel of the readings of processItems,
+// or nil if there's no governor.
+func (g *governor) ticks() <-chan time.Time {
+	if g == nil {
+		return nil
+	}
+	return g.ticker.C()
+}
+
+// govern reads the memory of the process and adjusts MaxCost to it,
+// evicting keys right away if it's lowered.
+func (c *Cache[K, V]) govern() {
+	g := c.governor
+	r := g.read()
+	if r.cycles == g.cycles {
+		// the live heap wasn't measured again since the last reading
+		return
+	}
+	g.cycles = r.cycles
+
+	maxCost := c.MaxCost()
+	next := g.next(maxCost, r)
+	switch {
+	case next < maxCost:
+		c.Metrics.add(governorShrink, uint64(next), 1)
+		// evict right away rather than through c.shrink, as this runs in processItems
+		c.cachePolicy.UpdateMaxCost(next)
+		c.applyMu.Lock()
+		c.evictOverflow()
+		c.applyMu.Unlock()
+	case next > maxCost:
+		c.Metrics.add(governorGrow, uint64(next), 1)
+		c.cachePolicy.UpdateMaxCost(next)
+	}
+}
@@ -0,0 +1,134 @@
+package fulmo
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/pchchv/fulmo/clock/clocktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGovernorNext(t *testing.T) {
+	g := newGovernor(&MemoryGovernor{MinCost: 10, MaxCost: 100, Limit: 1000, Target: 0.5}, 0, clocktest.NewFake(time.Now()))
+	defer g.ticker.Stop()
+	for _, tc := range []struct {
+		maxCost int64
+		live    int64
+		next    int64
+	}{
+		{100, 520, 80},
+		{100, 2000, 10},
+		{50, 400, 100},
+		{50, 480, 60},
+		{50, 500, 50},
+	} {
+		require.Equal(t, tc.next, g.next(tc.maxCost, memReading{live: tc.live}), "%+v", tc)
+	}
+
+	// the limit defaults to GOMEMLIMIT
+	g.Limit = 0
+	require.Equal(t, int64(80), g.next(100, memReading{live: 520, limit: 1000}))
+	require.Equal(t, int64(100), g.next(50, memReading{live: 520, limit: math.MaxInt64}),
+		"without a limit, MaxCost should be at its highest")
+}
+
+func TestGovernorShrink(t *testing.T) {
+	for name, policy := range map[string]Policy[int]{
+		"default":  nil,
+		"wtinylfu": NewWTinyLFUPolicy[int](1000, 100),
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, err := NewCache(&Config[int, int]{
+				NumCounters:        1000,
+				MaxCost:            100,
+				BufferItems:        64,
+				IgnoreInternalCost: true,
+				Synchronous:        true,
+				Metrics:            true,
+				Clock:              clocktest.NewFake(time.Now()),
+				Policy:             policy,
+				MemoryGovernor:     &MemoryGovernor{MinCost: 10, Limit: 1000, Target: 0.5},
+			})
+			require.NoError(t, err)
+			defer c.Close()
+			reading := memReading{live: 550, cycles: 1}
+			c.governor.read = func() memReading { return reading }
+			for key := range 100 {
+				require.True(t, c.Set(key, key, 1))
+			}
+
+			c.govern()
+			require.Equal(t, int64(50), c.MaxCost())
+			require.Equal(t, int64(50), c.MaxCost()-c.RemainingCost(), "keys should be evicted right away")
+			require.Equal(t, uint64(1), c.Metrics.GovernorShrinks())
+			require.Equal(t, uint64(50), c.Metrics.ShrinkEvictions())
+			require.Equal(t, uint64(50), c.Metrics.Removals(RemovalCapacity))
+			found := 0
+			for key := range 100 {
+				if _, ok := c.Get(key); ok {
+					found++
+				}
+			}
+			require.Equal(t, 50, found)
+
+			// nothing changes until the heap is measured again
+			reading.live = 400
+			c.govern()
+			require.Equal(t, int64(50), c.MaxCost())
+
+			reading.cycles++
+			c.govern()
+			require.Equal(t, int64(100), c.MaxCost())
+			require.Equal(t, uint64(1), c.Metrics.GovernorGrowths())
+		})
+	}
+}
+
+func TestGovernorTicks(t *testing.T) {
+	clk := clocktest.NewFake(time.Now())
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Synchronous:        true,
+		Metrics:            true,
+		Clock:              clk,
+		MemoryGovernor:     &MemoryGovernor{Limit: 1000, Target: 0.5, Interval: time.Minute},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	c.governor.read = func() memReading { return memReading{live: 540, cycles: 1} }
+	require.Equal(t, int64(10), c.governor.MinCost)
+
+	clk.Advance(time.Minute)
+	require.Eventually(t, func() bool {
+		return c.MaxCost() == 60
+	}, time.Second, time.Millisecond)
+}
+
+func TestGovernorConfig(t *testing.T) {
+	for _, g := range []MemoryGovernor{
+		{MinCost: -1},
+		{MaxCost: -1},
+		{MinCost: 10, MaxCost: 5},
+		{Limit: -1},
+		{Target: 1.5},
+		{Interval: -1},
+	} {
+		_, err := NewCache(&Config[int, int]{
+			NumCounters:    100,
+			MaxCost:        10,
+			BufferItems:    64,
+			MemoryGovernor: &g,
+		})
+		require.Error(t, err, "%+v", g)
+	}
+}
+
+func TestReadMemory(t *testing.T) {
+	r := readMemory()
+	require.GreaterOrEqual(t, r.live, int64(0))
+	require.Positive(t, r.limit)
+}
@@ -0,0 +1,173 @@
+package fulmo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrNoLoader is returned by GetOrLoad when the cache was created without a Loader.
+var ErrNoLoader = errors.New("Loader isn't set")
+
+// ErrLoaderPanic is returned by GetOrLoad to the callers sharing a Loader call that panicked.
+var ErrLoaderPanic = errors.New("Loader panicked")
+
+// Loader fetches the value for a key that is missing from the cache.
+// The returned cost and ttl are used to insert the value into the cache
+// the same way as SetWithTTL does.
+type Loader[K Key, V any] func(ctx context.Context, key K) (value V, cost int64, ttl time.Duration, err error)
+
+// loadKey identifies a key by both of its hashes,
+// so that keys that only share the first hash are not coalesced,
+// and by the key itself with Config.StoreKeys, so that colliding keys aren't either.
+type loadKey struct {
+	key      uint64
+	conflict uint64
+	// orig is the original key as returned by comparableKey,
+	// or nil if original keys aren't stored.
+	orig any
+}
+
+// loadCall is an in-flight or completed Loader call.
+type loadCall[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+	// panicked is the value the call panicked with, if it did.
+	panicked any
+}
+
+// loadGroup deduplicates concurrent loads of the same key.
+type loadGroup[V any] struct {
+	mu    sync.Mutex
+	calls map[loadKey]*loadCall[V]
+}
+
+func newLoadGroup[V any]() *loadGroup[V] {
+	return &loadGroup[V]{
+		calls: make(map[loadKey]*loadCall[V]),
+	}
+}
+
+// do runs fn for the key unless a call for the same key is already in flight,
+// and waits for the result of the call.
+// The call runs apart from its callers, so waiting stops early if ctx is done
+// while the call goes on for the others. If fn panics, the caller that started
+// the call panics with the same value and the others get ErrLoaderPanic.
+func (g *loadGroup[V]) do(ctx context.Context, k loadKey, fn func() (V, error)) (V, error) {
+	call, started := g.start(k, fn)
+	select {
+	case <-call.done:
+		if started && call.panicked != nil {
+			panic(call.panicked)
+		}
+		return call.value, call.err
+	case <-ctx.Done():
+		return zeroValue[V](), ctx.Err()
+	}
+}
+
+// doAsync runs fn for the key in a new goroutine,
+// unless a call for the same key is already in flight.
+// It reports whether fn was started.
+func (g *loadGroup[V]) doAsync(k loadKey, fn func() (V, error)) bool {
+	_, started := g.start(k, fn)
+	return started
+}
+
+// start runs fn for the key in a new goroutine, unless a call for the same key
+// is already in flight. It returns the call and whether fn was started.
+func (g *loadGroup[V]) start(k loadKey, fn func() (V, error)) (*loadCall[V], bool) {
+	g.mu.Lock()
+	if call, ok := g.calls[k]; ok {
+		g.mu.Unlock()
+		return call, false
+	}
+
+	call := &loadCall[V]{done: make(chan struct{})}
+	g.calls[k] = call
+	g.mu.Unlock()
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				call.panicked = r
+				call.err = fmt.Errorf("%w: %v", ErrLoaderPanic, r)
+			}
+			g.mu.Lock()
+			delete(g.calls, k)
+			g.mu.Unlock()
+			close(call.done)
+		}()
+
+		call.value, call.err = fn()
+	}()
+	return call, true
+}
+
+// GetOrLoad returns the value for the key,
+// calling Config.Loader to fetch it when the key is not in the cache.
+// Concurrent calls for the same key share a single Loader call and
+// all of them receive its value or error.
+// As the call is shared, the Loader gets a context that carries the values of ctx
+// but isn't canceled with it: if ctx is done, GetOrLoad returns its error
+// and the call goes on for the other callers.
+// If the Loader panics, the caller that started the call panics with the same value
+// and the others get ErrLoaderPanic.
+// A successfully loaded value is inserted through the normal admission path
+// with the cost and TTL returned by the Loader,
+// so it may still be rejected by the policy.
+func (c *Cache[K, V]) GetOrLoad(ctx context.Context, key K) (V, error) {
+	if c == nil || c.loader == nil {
+		return zeroValue[V](), ErrNoLoader
+	}
+
+	if value, ok := c.Get(key); ok {
+		return value, nil
+	}
+
+	keyHash, conflictHash := c.keyToHash(key)
+	return c.loads.do(ctx, c.loadKey(key, keyHash, conflictHash), func() (V, error) {
+		value, cost, ttl, err := c.loader(context.WithoutCancel(ctx), key)
+		if err != nil {
+			return zeroValue[V](), err
+		}
+
+		c.set(key, value, setOptions{cost: cost, ttl: ttl, loaded: true}, nil)
+		return value, nil
+	})
+}
+
+// refresh reloads the value of the key in the background,
+// unless a load of the key is already in flight.
+// If the reload fails, the current value is kept until it expires.
+func (c *Cache[K, V]) refresh(key K, keyHash, conflictHash uint64) {
+	c.loads.doAsync(c.loadKey(key, keyHash, conflictHash), func() (V, error) {
+		value, cost, ttl, err := c.refresher(context.Background(), key)
+		if err != nil {
+			return zeroValue[V](), err
+		}
+
+		c.set(key, value, setOptions{cost: cost, ttl: ttl, loaded: true}, nil)
+		return value, nil
+	})
+}
+
+// loadKey returns the loadKey of the key with the given hashes.
+func (c *Cache[K, V]) loadKey(key K, keyHash, conflictHash uint64) loadKey {
+	k := loadKey{key: keyHash, conflict: conflictHash}
+	if c.storeKeys {
+		k.orig = comparableKey(key)
+	}
+	return k
+}
+
+// comparableKey returns the key as a comparable value, []byte keys as strings.
+func comparableKey[K Key](key K) any {
+	if b, ok := any(key).([]byte); ok {
+		return string(b)
+	}
+	return key
+}
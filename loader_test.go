@@ -0,0 +1,316 @@
+package fulmo
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pchchv/fulmo/clock/clocktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetOrLoad(t *testing.T) {
+	var calls atomic.Int32
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Loader: func(ctx context.Context, key int) (int, int64, time.Duration, error) {
+			calls.Add(1)
+			return key * 2, 1, 0, nil
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	val, err := c.GetOrLoad(context.Background(), 1)
+	require.NoError(t, err)
+	require.Equal(t, 2, val)
+	require.Equal(t, int32(1), calls.Load())
+
+	c.Wait()
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 2, val)
+
+	// the value is cached, so the loader isn't called again
+	val, err = c.GetOrLoad(context.Background(), 1)
+	require.NoError(t, err)
+	require.Equal(t, 2, val)
+	require.Equal(t, int32(1), calls.Load())
+}
+
+func TestGetOrLoadCoalesce(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	c, err := NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Loader: func(ctx context.Context, key int) (int, int64, time.Duration, error) {
+			calls.Add(1)
+			<-release
+			return key, 1, 0, nil
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	const n = 16
+	var wg sync.WaitGroup
+	results := make([]int, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			val, err := c.GetOrLoad(context.Background(), 7)
+			require.NoError(t, err)
+			results[i] = val
+		}(i)
+	}
+
+	time.Sleep(wait)
+	close(release)
+	wg.Wait()
+	require.Equal(t, int32(1), calls.Load())
+	for _, val := range results {
+		require.Equal(t, 7, val)
+	}
+}
+
+func TestGetOrLoadError(t *testing.T) {
+	errLoad := errors.New("load failed")
+	c, err := NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Loader: func(ctx context.Context, key int) (int, int64, time.Duration, error) {
+			return 0, 0, 0, errLoad
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	_, err = c.GetOrLoad(context.Background(), 1)
+	require.ErrorIs(t, err, errLoad)
+
+	c.Wait()
+	_, ok := c.Get(1)
+	require.False(t, ok)
+}
+
+func TestGetOrLoadContext(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	c, err := NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Loader: func(ctx context.Context, key int) (int, int64, time.Duration, error) {
+			<-release
+			return key, 1, 0, nil
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	go c.GetOrLoad(context.Background(), 1)
+	time.Sleep(wait)
+
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	_, err = c.GetOrLoad(ctx, 1)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestGetOrLoadNoLoader(t *testing.T) {
+	c, err := newTestCache()
+	require.NoError(t, err)
+	defer c.Close()
+
+	_, err = c.GetOrLoad(context.Background(), 1)
+	require.ErrorIs(t, err, ErrNoLoader)
+
+	c = nil
+	_, err = c.GetOrLoad(context.Background(), 1)
+	require.ErrorIs(t, err, ErrNoLoader)
+}
+
+func TestRefreshAfter(t *testing.T) {
+	clk := clocktest.NewFake(time.Unix(1000, 0))
+	var calls atomic.Int32
+	release := make(chan error)
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Synchronous:        true,
+		Clock:              clk,
+		RefreshAfter:       20 * time.Second,
+		Refresh: func(ctx context.Context, key int) (int, int64, time.Duration, error) {
+			n := calls.Add(1)
+			if err := <-release; err != nil {
+				return 0, 0, 0, err
+			}
+			return key * 10 * int(n), 1, time.Minute, nil
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithTTL(1, 1, 1, time.Minute))
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	require.Zero(t, calls.Load())
+
+	// stale values are served while a single refresh runs
+	clk.Advance(30 * time.Second)
+	for i := 0; i < 10; i++ {
+		val, ok = c.Get(1)
+		require.True(t, ok)
+		require.Equal(t, 1, val)
+	}
+	release <- nil
+	require.Eventually(t, func() bool {
+		val, _ := c.Get(1)
+		return val == 10
+	}, time.Second, time.Millisecond)
+	require.Equal(t, int32(1), calls.Load())
+	ttl, _ := c.GetTTL(1)
+	require.Equal(t, time.Minute, ttl)
+
+	// a failed refresh keeps the old value until its TTL passes
+	clk.Advance(30 * time.Second)
+	val, _ = c.Get(1)
+	require.Equal(t, 10, val)
+	release <- errors.New("unavailable")
+	require.Eventually(t, func() bool {
+		c.loads.mu.Lock()
+		defer c.loads.mu.Unlock()
+		return len(c.loads.calls) == 0
+	}, time.Second, time.Millisecond)
+
+	// the next Get retries the refresh, which fails again
+	go func() { release <- errors.New("unavailable") }()
+	clk.Advance(20 * time.Second)
+	val, ok = c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 10, val)
+	require.Eventually(t, func() bool { return calls.Load() == 3 }, time.Second, time.Millisecond)
+
+	clk.Advance(20 * time.Second)
+	_, ok = c.Get(1)
+	require.False(t, ok)
+}
+
+func TestRefreshAfterConfig(t *testing.T) {
+	_, err := NewCache(&Config[int, int]{
+		NumCounters:  100,
+		MaxCost:      10,
+		BufferItems:  64,
+		RefreshAfter: time.Second,
+	})
+	require.Error(t, err)
+
+	_, err = NewCache(&Config[int, int]{
+		NumCounters:  100,
+		MaxCost:      10,
+		BufferItems:  64,
+		RefreshAfter: -time.Second,
+	})
+	require.Error(t, err)
+}
+
+func TestGetOrLoadShared(t *testing.T) {
+	release, releasePanic := make(chan struct{}), make(chan struct{})
+	c, err := NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Loader: func(ctx context.Context, key int) (int, int64, time.Duration, error) {
+			if key == 2 {
+				<-releasePanic
+				panic("boom")
+			}
+			<-release
+			return key, 1, 0, ctx.Err()
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// the load goes on for the others when the caller that started it gives up
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error)
+	go func() {
+		_, err := c.GetOrLoad(ctx, 1)
+		leader <- err
+	}()
+	time.Sleep(wait)
+	waiter := make(chan error)
+	go func() {
+		_, err := c.GetOrLoad(context.Background(), 1)
+		waiter <- err
+	}()
+	time.Sleep(wait)
+	cancel()
+	require.ErrorIs(t, <-leader, context.Canceled)
+	close(release)
+	require.NoError(t, <-waiter)
+
+	// a panic is passed on to the caller that started the load
+	panicked := make(chan any)
+	go func() {
+		defer func() { panicked <- recover() }()
+		c.GetOrLoad(context.Background(), 2)
+	}()
+	time.Sleep(wait)
+	go func() {
+		time.Sleep(wait)
+		close(releasePanic)
+	}()
+	_, err = c.GetOrLoad(context.Background(), 2)
+	require.Equal(t, "boom", <-panicked)
+	require.ErrorIs(t, err, ErrLoaderPanic)
+}
+
+func TestGetOrLoadStoreKeys(t *testing.T) {
+	release := make(chan struct{})
+	c, err := NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		StoreKeys:   true,
+		KeyToHash: func(key int) (uint64, uint64) {
+			// every key collides
+			return 1, 0
+		},
+		Loader: func(ctx context.Context, key int) (int, int64, time.Duration, error) {
+			<-release
+			return key * 100, 1, 0, nil
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// colliding keys aren't coalesced
+	results := make(chan int)
+	go func() {
+		val, _ := c.GetOrLoad(context.Background(), 1)
+		results <- val
+	}()
+	time.Sleep(wait)
+	go func() {
+		val, _ := c.GetOrLoad(context.Background(), 11)
+		results <- val
+	}()
+	time.Sleep(wait)
+	close(release)
+	require.ElementsMatch(t, []int{100, 1100}, []int{<-results, <-results})
+}
@@ -0,0 +1,384 @@
+package fulmo
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pchchv/fulmo/helpers"
+)
+
+// Namespace is a view of a cache with its own key space, see Cache.Namespace.
+// Namespaces share the capacity and the admission statistics of the cache,
+// but a key set in a namespace is never seen by the cache itself or by other namespaces.
+type Namespace[K Key, V any] struct {
+	c  *Cache[K, V]
+	ns *namespace
+	// Metrics contains the statistics of the keys of the namespace.
+	// It's nil if the cache doesn't collect metrics.
+	// Gets dropped and kept and life expectancy aren't tracked per namespace.
+	Metrics *Metrics
+}
+
+// NamespaceOption configures a namespace created with Cache.Namespace.
+type NamespaceOption func(*namespace)
+
+// WithMinCost keeps the items of the namespace from being evicted
+// to make room for other items while its cost is below minCost.
+// Only the default policy honors it.
+func WithMinCost(minCost int64) NamespaceOption {
+	return func(n *namespace) {
+		n.minCost = minCost
+	}
+}
+
+// WithMaxCost limits the total cost of the items of the namespace.
+// Once it's reached, new items of the namespace evict the namespace's
+// least frequently used items instead of items of other namespaces.
+func WithMaxCost(maxCost int64) NamespaceOption {
+	return func(n *namespace) {
+		n.maxCost = maxCost
+	}
+}
+
+// Namespace returns the namespace with the given name, creating it with the options if needed.
+// The options are ignored if the namespace already exists.
+func (c *Cache[K, V]) Namespace(name string, opts ...NamespaceOption) *Namespace[K, V] {
+	if c == nil {
+		return nil
+	}
+
+	n := c.namespaces.get(name, c.Metrics != nil, opts)
+	if n.minCost > 0 {
+		if p, ok := c.cachePolicy.(quotaPolicy); ok {
+			p.setQuotas(c.namespaces)
+		}
+	}
+	return &Namespace[K, V]{c: c, ns: n, Metrics: n.metrics}
+}
+
+// Name returns the name of the namespace.
+func (n *Namespace[K, V]) Name() string {
+	return n.ns.name
+}
+
+// Get works like Cache.Get for the keys of the namespace.
+func (n *Namespace[K, V]) Get(key K) (V, bool) {
+	if n == nil || n.c.isClosed.Load() {
+		return zeroValue[V](), false
+	}
+
+	value, ok := n.c.get(key, n.ns)
+	if ok {
+		n.Metrics.add(hit, n.ns.seed, 1)
+	} else {
+		n.Metrics.add(miss, n.ns.seed, 1)
+	}
+	return value, ok
+}
+
+// Set works like Cache.Set for the keys of the namespace.
+func (n *Namespace[K, V]) Set(key K, value V, cost int64) bool {
+	return n.SetWithTTL(key, value, cost, 0)
+}
+
+// SetWithTTL works like Cache.SetWithTTL for the keys of the namespace.
+func (n *Namespace[K, V]) SetWithTTL(key K, value V, cost int64, ttl time.Duration) bool {
+	if n == nil {
+		return false
+	}
+	return n.c.set(key, value, setOptions{cost: cost, ttl: ttl, ns: n.ns}, nil)
+}
+
+// Del works like Cache.Del for the keys of the namespace.
+func (n *Namespace[K, V]) Del(key K) {
+	if n == nil || n.c.isClosed.Load() {
+		return
+	}
+	n.c.del(key, n.ns)
+}
+
+// Cost returns the total cost of the items of the namespace.
+func (n *Namespace[K, V]) Cost() int64 {
+	if n == nil {
+		return 0
+	}
+
+	n.c.namespaces.Lock()
+	defer n.c.namespaces.Unlock()
+	return n.ns.used
+}
+
+// fitQuota evicts items of the namespace of the item until the item fits in its maximum cost.
+// New items have to be used at least as often as the items they evict,
+// it returns false if the item isn't admitted.
+// The caller must hold c.applyMu.
+func (c *Cache[K, V]) fitQuota(i *Item[V]) bool {
+	if i.ns == nil || i.ns.maxCost <= 0 {
+		return true
+	}
+	if i.Cost > i.ns.maxCost {
+		return false
+	}
+
+	p, _ := c.cachePolicy.(quotaPolicy)
+	for {
+		sample, used := c.namespaces.sample(i.ns, i.Key)
+		if used+i.Cost <= i.ns.maxCost || len(sample) == 0 {
+			return true
+		}
+
+		victim, victimHits := sample[0], int64(-1)
+		if p != nil {
+			for _, key := range sample {
+				if hits := p.frequency(key); victimHits < 0 || hits < victimHits {
+					victim, victimHits = key, hits
+				}
+			}
+			if i.flag == itemNew && p.frequency(i.Key) < victimHits {
+				return false
+			}
+		}
+
+		cost := c.cachePolicy.Cost(victim)
+		c.cachePolicy.Del(victim)
+		si, _ := c.storedItems.Del(victim, 0, nil)
+		c.evictItem(&Item[V]{
+			Key:         victim,
+			Conflict:    si.conflict,
+			Value:       si.value,
+			Cost:        max(cost, 0),
+			OriginalKey: si.origKey,
+		}, RemovalCapacity)
+	}
+}
+
+// rangeItems calls f for the items of the cache itself until f returns false,
+// skipping the keys of the namespaces.
+// Like Range, it walks the store shard by shard without holding its locks.
+func (c *Cache[K, V]) rangeItems(f func(item storeItem[V]) bool) {
+	c.storedItems.Range(func(item storeItem[V]) bool {
+		if c.namespaces.owns(item.key) {
+			return true
+		}
+		return f(item)
+	})
+}
+
+// quotaPolicy is implemented by policies supporting the quotas of namespaces.
+type quotaPolicy interface {
+	// setQuotas sets the namespaces whose min costs the policy honors when evicting.
+	setQuotas(quotas *namespaces)
+	// frequency returns the estimated number of accesses of the key.
+	frequency(key uint64) int64
+}
+
+// namespace is the state of a namespace shared by all its views.
+type namespace struct {
+	name string
+	// seed separates the hashes of the keys of the namespace from the others.
+	// It and the quotas don't change once the namespace is created.
+	seed    uint64
+	minCost int64
+	maxCost int64
+	metrics *Metrics
+	// used is the total cost of the keys of the namespace,
+	// keys maps them to their cost.
+	// Both are guarded by the lock of namespaces.
+	used int64
+	keys map[uint64]int64
+}
+
+// hash mixes the hashes of a key with the seed of the namespace.
+func (n *namespace) hash(keyHash, conflictHash uint64) (uint64, uint64) {
+	return mix64(keyHash ^ n.seed), mix64(conflictHash ^ n.seed)
+}
+
+// metricsAdd adds to the metrics of the namespace, if there is one.
+func (n *namespace) metricsAdd(t metricType, hash, delta uint64) {
+	if n != nil {
+		n.metrics.add(t, hash, delta)
+	}
+}
+
+// namespaces keeps the namespaces of a cache and the keys admitted into them.
+type namespaces struct {
+	sync.Mutex
+	byName map[string]*namespace
+	byKey  map[uint64]*namespace
+}
+
+func newNamespaces() *namespaces {
+	return &namespaces{
+		byName: make(map[string]*namespace),
+		byKey:  make(map[uint64]*namespace),
+	}
+}
+
+// get returns the namespace with the name, creating it if needed.
+func (ns *namespaces) get(name string, withMetrics bool, opts []NamespaceOption) *namespace {
+	ns.Lock()
+	defer ns.Unlock()
+	n, ok := ns.byName[name]
+	if !ok {
+		seed, _ := helpers.KeyToHash(name)
+		n = &namespace{name: name, seed: seed, keys: make(map[uint64]int64)}
+		for _, opt := range opts {
+			opt(n)
+		}
+		if withMetrics {
+			n.metrics = newMetrics()
+		}
+		ns.byName[name] = n
+	}
+	return n
+}
+
+// add records a key admitted into the namespace.
+func (ns *namespaces) add(n *namespace, key uint64, cost int64) {
+	if n == nil {
+		return
+	}
+
+	ns.Lock()
+	defer ns.Unlock()
+	ns.byKey[key] = n
+	n.keys[key] = cost
+	n.used += cost
+	n.metrics.add(keyAdd, key, 1)
+	n.metrics.add(costAdd, key, uint64(cost))
+}
+
+// update records the new cost of a key of the namespace.
+func (ns *namespaces) update(n *namespace, key uint64, cost int64) {
+	if n == nil {
+		return
+	}
+
+	ns.Lock()
+	defer ns.Unlock()
+	prev, ok := n.keys[key]
+	if !ok {
+		return
+	}
+
+	n.keys[key] = cost
+	n.used += cost - prev
+	n.metrics.add(keyUpdate, key, 1)
+	// a negative difference wraps around, like in the policy
+	n.metrics.add(costAdd, key, uint64(cost-prev))
+}
+
+// removed records a key removed from the cache.
+// It returns whether the key belonged to a namespace.
+func (ns *namespaces) removed(key uint64, cause RemovalCause) bool {
+	ns.Lock()
+	defer ns.Unlock()
+	n, ok := ns.byKey[key]
+	if !ok {
+		return false
+	}
+
+	cost := n.keys[key]
+	delete(ns.byKey, key)
+	delete(n.keys, key)
+	n.used -= cost
+	n.metrics.add(keyEvict, key, 1)
+	n.metrics.add(costEvict, key, uint64(cost))
+	n.metrics.add(cause.metric(), key, 1)
+	return true
+}
+
+// owns reports whether the key belongs to a namespace.
+func (ns *namespaces) owns(key uint64) bool {
+	ns.Lock()
+	defer ns.Unlock()
+	_, ok := ns.byKey[key]
+	return ok
+}
+
+// sample returns up to lfuSample keys of the namespace other than key,
+// and the total cost of the namespace without key.
+func (ns *namespaces) sample(n *namespace, key uint64) ([]uint64, int64) {
+	ns.Lock()
+	defer ns.Unlock()
+	sample := make([]uint64, 0, lfuSample)
+	for k := range n.keys {
+		if len(sample) == lfuSample {
+			break
+		}
+		if k != key {
+			sample = append(sample, k)
+		}
+	}
+	return sample, n.used - n.keys[key]
+}
+
+// evictCheck tells which keys a policy call may evict without
+// taking their namespaces below their minimum costs.
+// The keys evicted by the call are only removed from their namespaces
+// once it returns, until then their costs are counted as pending.
+type evictCheck struct {
+	ns      *namespaces
+	pending map[*namespace]int64
+}
+
+// evictCheck returns the check of a policy call, or nil if ns is nil.
+func (ns *namespaces) evictCheck() *evictCheck {
+	if ns == nil {
+		return nil
+	}
+	return &evictCheck{ns: ns}
+}
+
+// evictable reports whether the key may be evicted.
+// All keys may if the check is nil.
+func (e *evictCheck) evictable(key uint64) bool {
+	if e == nil {
+		return true
+	}
+
+	e.ns.Lock()
+	defer e.ns.Unlock()
+	n, ok := e.ns.byKey[key]
+	return !ok || n.used-e.pending[n]-n.keys[key] >= n.minCost
+}
+
+// evicted records that the key was evicted by the call.
+func (e *evictCheck) evicted(key uint64) {
+	if e == nil {
+		return
+	}
+
+	e.ns.Lock()
+	defer e.ns.Unlock()
+	if n, ok := e.ns.byKey[key]; ok {
+		if e.pending == nil {
+			e.pending = make(map[*namespace]int64)
+		}
+		e.pending[n] += n.keys[key]
+	}
+}
+
+// clear forgets the keys of all the namespaces.
+func (ns *namespaces) clear() {
+	ns.Lock()
+	defer ns.Unlock()
+	clear(ns.byKey)
+	for _, n := range ns.byName {
+		clear(n.keys)
+		n.used = 0
+		if n.metrics != nil {
+			n.metrics.Clear()
+		}
+	}
+}
+
+// mix64 is the finalizer of splitmix64, spreading the bits of x.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
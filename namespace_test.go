@@ -0,0 +1,262 @@
+package fulmo
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pchchv/fulmo/clock/clocktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamespaceIsolation(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Synchronous:        true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	users := c.Namespace("users")
+	posts := c.Namespace("posts")
+	require.Equal(t, "users", users.Name())
+
+	require.True(t, c.Set(1, 10, 1))
+	require.True(t, users.Set(1, 20, 2))
+	require.True(t, posts.Set(1, 30, 3))
+
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 10, val)
+	val, ok = users.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 20, val)
+	val, ok = c.Namespace("posts").Get(1)
+	require.True(t, ok)
+	require.Equal(t, 30, val, "views of the same namespace should share its keys")
+
+	users.Del(1)
+	_, ok = users.Get(1)
+	require.False(t, ok)
+	_, ok = posts.Get(1)
+	require.True(t, ok)
+	_, ok = c.Get(1)
+	require.True(t, ok)
+
+	require.Equal(t, int64(100-1-3), c.RemainingCost(), "namespaces should share the budget")
+	require.Zero(t, users.Cost())
+	require.Equal(t, int64(3), posts.Cost())
+
+	var nilCache *Cache[int, int]
+	require.Nil(t, nilCache.Namespace("users"))
+}
+
+func TestNamespaceMetrics(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Synchronous:        true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	users := c.Namespace("users")
+	c.Set(1, 1, 1)
+	users.Set(1, 1, 5)
+	users.Set(1, 2, 7)
+	users.Set(2, 2, 1)
+	users.Get(1)
+	users.Get(3)
+	users.Del(2)
+
+	require.Equal(t, uint64(1), users.Metrics.Hits())
+	require.Equal(t, uint64(1), users.Metrics.Misses())
+	require.Equal(t, uint64(2), users.Metrics.KeysAdded())
+	require.Equal(t, uint64(1), users.Metrics.KeysUpdated())
+	require.Equal(t, uint64(1), users.Metrics.KeysEvicted())
+	require.Equal(t, uint64(8), users.Metrics.CostAdded())
+	require.Equal(t, uint64(1), users.Metrics.Removals(RemovalExplicit))
+	require.Equal(t, int64(7), users.Cost())
+	require.Equal(t, uint64(3), c.Metrics.KeysAdded(), "the cache should count the keys of all namespaces")
+
+	c.Clear()
+	require.Zero(t, users.Metrics.KeysAdded())
+	require.Zero(t, users.Cost())
+}
+
+func TestNamespaceMaxCost(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Synchronous:        true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	noisy := c.Namespace("noisy", WithMaxCost(10))
+	quiet := c.Namespace("quiet")
+	for key := range 10 {
+		require.True(t, quiet.Set(key, key, 5))
+	}
+
+	for key := range 100 {
+		// access the keys before setting them, so they win over older keys
+		noisy.Get(key)
+		noisy.Get(key)
+		noisy.Set(key, key, 1)
+	}
+	require.Equal(t, int64(10), noisy.Cost())
+	require.Equal(t, int64(50), quiet.Cost(), "a namespace at its max cost should only evict its own keys")
+	require.Equal(t, uint64(90), noisy.Metrics.Removals(RemovalCapacity))
+
+	require.False(t, noisy.Set(1000, 1, 11), "items bigger than the max cost should be rejected")
+}
+
+func TestNamespaceMinCost(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Synchronous:        true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	protected := c.Namespace("protected", WithMinCost(4))
+	for key := range 4 {
+		require.True(t, protected.Set(key, key, 1))
+	}
+
+	for key := range 100 {
+		for range 10 {
+			c.Get(key)
+		}
+		c.Set(key, key, 1)
+	}
+	require.Equal(t, int64(4), protected.Cost(), "items of a namespace under its min cost shouldn't be evicted")
+	for key := range 4 {
+		_, ok := protected.Get(key)
+		require.True(t, ok)
+	}
+}
+
+func TestNamespaceRefresh(t *testing.T) {
+	clk := clocktest.NewFake(time.Unix(1000, 0))
+	var refreshed atomic.Int32
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Synchronous:        true,
+		Clock:              clk,
+		RefreshAfter:       time.Second,
+		Refresh: func(ctx context.Context, key int) (int, int64, time.Duration, error) {
+			refreshed.Add(1)
+			return key * 10, 1, 0, nil
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	users, posts := c.Namespace("users"), c.Namespace("posts")
+	require.True(t, users.Set(42, 1, 1))
+	require.True(t, posts.Set(42, 2, 1))
+	require.True(t, c.Set(42, 3, 1))
+
+	clk.Advance(2 * time.Second)
+	users.Get(42)
+	posts.Get(42)
+	c.Get(42)
+	require.Eventually(t, func() bool {
+		val, _ := c.Get(42)
+		return val == 420
+	}, time.Second, time.Millisecond)
+
+	// the Refresh doesn't know the namespace of the key, so namespaced keys aren't refreshed
+	val, _ := users.Get(42)
+	require.Equal(t, 1, val)
+	val, _ = posts.Get(42)
+	require.Equal(t, 2, val)
+	require.Equal(t, int32(1), refreshed.Load())
+}
+
+func TestNamespaceWalks(t *testing.T) {
+	c, err := NewCache(&Config[string, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Synchronous:        true,
+		StoreKeys:          true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	require.True(t, c.Set("b", 1, 1))
+	require.True(t, c.Namespace("users").Set("a", 2, 1))
+	require.True(t, c.Namespace("posts").Set("a", 3, 1))
+
+	require.Equal(t, []string{"b"}, c.Keys(), "keys of namespaces shouldn't be seen by the cache")
+
+	var buf bytes.Buffer
+	require.NoError(t, c.SaveTo(&buf, GobCodec[string, int]{}))
+	r, err := NewCache(&Config[string, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Synchronous:        true,
+		StoreKeys:          true,
+	})
+	require.NoError(t, err)
+	defer r.Close()
+	require.NoError(t, r.LoadFrom(&buf, GobCodec[string, int]{}))
+	require.Equal(t, []string{"b"}, r.Keys())
+
+	require.Zero(t, c.InvalidatePrefix("a"))
+	val, ok := c.Namespace("users").Get("a")
+	require.True(t, ok)
+	require.Equal(t, 2, val)
+}
+
+func TestNamespaceMinCostVictims(t *testing.T) {
+	for range 20 {
+		c, err := NewCache(&Config[int, int]{
+			NumCounters:        1000,
+			MaxCost:            10,
+			BufferItems:        64,
+			IgnoreInternalCost: true,
+			Synchronous:        true,
+			Metrics:            true,
+		})
+		require.NoError(t, err)
+		protected := c.Namespace("protected", WithMinCost(4))
+		for key := range 6 {
+			require.True(t, protected.Set(key, key, 1))
+		}
+		for key := range 4 {
+			require.True(t, c.Set(key, key, 1))
+		}
+
+		// one set evicting many keys stops at the min cost
+		for range 10 {
+			c.Get(100)
+		}
+		require.False(t, c.Set(100, 100, 8), "there's no room without going below the min cost")
+		require.GreaterOrEqual(t, protected.Cost(), int64(4))
+
+		c.UpdateMaxCost(2)
+		require.Equal(t, int64(4), protected.Cost())
+		require.Equal(t, int64(4), c.MaxCost()-c.RemainingCost())
+		c.Close()
+	}
+}
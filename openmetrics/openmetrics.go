@@ -0,0 +1,211 @@
+// Package openmetrics exports the metrics of one or many caches
+// in the OpenMetrics text format, which Prometheus scrapes natively.
+package openmetrics
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pchchv/fulmo"
+)
+
+// ContentType is the content type of the exposition served by the Exporter.
+const ContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// Costs reports the cost gauges of a cache, *fulmo.Cache satisfies it.
+type Costs interface {
+	MaxCost() int64
+	RemainingCost() int64
+}
+
+type counter struct {
+	name string
+	help string
+	get  func(m *fulmo.Metrics) uint64
+}
+
+var counters = []counter{
+	{"hits", "Number of Get calls that found the key.", (*fulmo.Metrics).Hits},
+	{"misses", "Number of Get calls that didn't find the key.", (*fulmo.Metrics).Misses},
+	{"keys_added", "Number of keys added to the cache.", (*fulmo.Metrics).KeysAdded},
+	{"keys_updated", "Number of updates of keys already in the cache.", (*fulmo.Metrics).KeysUpdated},
+	{"keys_evicted", "Number of keys evicted from the cache.", (*fulmo.Metrics).KeysEvicted},
+	{"cost_added", "Total cost of the keys added to the cache.", (*fulmo.Metrics).CostAdded},
+	{"cost_evicted", "Total cost of the keys evicted from the cache.", (*fulmo.Metrics).CostEvicted},
+	{"sets_dropped", "Number of sets dropped because the set buffer was full.", (*fulmo.Metrics).SetsDropped},
+	{"sets_rejected", "Number of sets rejected by the admission policy.", (*fulmo.Metrics).SetsRejected},
+	{"gets_dropped", "Number of key accesses dropped because the get buffer was full.", (*fulmo.Metrics).GetsDropped},
+	{"gets_kept", "Number of key accesses recorded by the policy.", (*fulmo.Metrics).GetsKept},
+	{"governor_shrinks", "Number of times the memory governor lowered the max cost.", (*fulmo.Metrics).GovernorShrinks},
+	{"governor_growths", "Number of times the memory governor raised the max cost.", (*fulmo.Metrics).GovernorGrowths},
+	{"shrink_evictions", "Number of keys evicted because the max cost was lowered.", (*fulmo.Metrics).ShrinkEvictions},
+}
+
+type source struct {
+	metrics *fulmo.Metrics
+	costs   Costs
+}
+
+// Exporter serves the metrics of the registered caches over HTTP.
+// Every metric has a cache label with the name the cache was registered with.
+type Exporter struct {
+	mu      sync.RWMutex
+	prefix  string
+	sources map[string]source
+}
+
+// New returns an Exporter whose metric names start with prefix,
+// e.g. "fulmo" exports fulmo_hits_total.
+func New(prefix string) *Exporter {
+	return &Exporter{
+		prefix:  prefix,
+		sources: make(map[string]source),
+	}
+}
+
+// Register adds a cache to the exporter.
+// The metrics may be nil if Config.Metrics isn't set, in which case only
+// the cost gauges are exported. Costs may be nil as well.
+func (e *Exporter) Register(name string, metrics *fulmo.Metrics, costs Costs) error {
+	if name == "" {
+		return errors.New("cache name can't be empty")
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.sources[name]; ok {
+		return fmt.Errorf("cache %q is already registered", name)
+	}
+
+	e.sources[name] = source{metrics: metrics, costs: costs}
+	return nil
+}
+
+// Unregister removes a cache from the exporter.
+func (e *Exporter) Unregister(name string) {
+	e.mu.Lock()
+	delete(e.sources, name)
+	e.mu.Unlock()
+}
+
+// ServeHTTP writes the metrics of the registered caches.
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	e.WriteTo(w)
+}
+
+// WriteTo writes the metrics of the registered caches
+// in the OpenMetrics text format.
+func (e *Exporter) WriteTo(w io.Writer) (int64, error) {
+	e.mu.RLock()
+	names := make([]string, 0, len(e.sources))
+	sources := make(map[string]source, len(e.sources))
+	for name, s := range e.sources {
+		names = append(names, name)
+		sources[name] = s
+	}
+	e.mu.RUnlock()
+	slices.Sort(names)
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, c := range counters {
+		e.family(bw, c.name, "counter", c.help)
+		for _, name := range names {
+			if m := sources[name].metrics; m != nil {
+				fmt.Fprintf(bw, "%s_total{cache=%s} %d\n", e.name(c.name), quote(name), c.get(m))
+			}
+		}
+	}
+
+	e.family(bw, "removals", "counter", "Number of items removed from the cache, by cause.")
+	for _, name := range names {
+		m := sources[name].metrics
+		if m == nil {
+			continue
+		}
+
+		for cause := fulmo.RemovalCapacity; cause <= fulmo.RemovalRejected; cause++ {
+			fmt.Fprintf(bw, "%s_total{cache=%s,cause=%q} %d\n", e.name("removals"), quote(name), cause, m.Removals(cause))
+		}
+	}
+
+	gauges := []struct {
+		name string
+		help string
+		get  func(Costs) int64
+	}{
+		{"max_cost", "Maximum total cost of the cache.", Costs.MaxCost},
+		{"remaining_cost", "Cost that can be added before the cache starts evicting.", Costs.RemainingCost},
+	}
+	for _, g := range gauges {
+		e.family(bw, g.name, "gauge", g.help)
+		for _, name := range names {
+			if costs := sources[name].costs; costs != nil {
+				fmt.Fprintf(bw, "%s{cache=%s} %d\n", e.name(g.name), quote(name), g.get(costs))
+			}
+		}
+	}
+
+	const life = "life_expectancy_seconds"
+	e.family(bw, life, "histogram", "Time the evicted keys spent in the cache.")
+	for _, name := range names {
+		m := sources[name].metrics
+		if m == nil {
+			continue
+		}
+
+		h := m.LifeExpectancySeconds()
+		var cumulative int64
+		for i, bound := range h.Bounds {
+			// the buckets hold the lifetimes below their bound while le is inclusive,
+			// as lifetimes are whole seconds the bucket holds the ones up to bound-1
+			cumulative += h.CountPerBucket[i]
+			fmt.Fprintf(bw, "%s_bucket{cache=%s,le=%q} %d\n",
+				e.name(life), quote(name), strconv.FormatFloat(bound-1, 'f', -1, 64), cumulative)
+		}
+		fmt.Fprintf(bw, "%s_bucket{cache=%s,le=\"+Inf\"} %d\n", e.name(life), quote(name), h.Count)
+		fmt.Fprintf(bw, "%s_sum{cache=%s} %d\n", e.name(life), quote(name), h.Sum)
+		fmt.Fprintf(bw, "%s_count{cache=%s} %d\n", e.name(life), quote(name), h.Count)
+	}
+
+	bw.WriteString("# EOF\n")
+	err := bw.Flush()
+	return cw.n, err
+}
+
+func (e *Exporter) name(metric string) string {
+	if e.prefix == "" {
+		return metric
+	}
+	return e.prefix + "_" + metric
+}
+
+func (e *Exporter) family(w io.Writer, metric, typ, help string) {
+	fmt.Fprintf(w, "# TYPE %s %s\n# HELP %s %s\n", e.name(metric), typ, e.name(metric), help)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quote returns the label value escaped as OpenMetrics requires.
+func quote(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,116 @@
+package openmetrics
+
+import (
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pchchv/fulmo"
+	"github.com/pchchv/fulmo/clock/clocktest"
+	"github.com/stretchr/testify/require"
+)
+
+func newCache(t *testing.T, metrics bool) *fulmo.Cache[int, int] {
+	c, err := fulmo.NewCache(&fulmo.Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            metrics,
+		Synchronous:        true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(c.Close)
+	return c
+}
+
+func TestExporter(t *testing.T) {
+	users := newCache(t, true)
+	require.True(t, users.Set(1, 1, 4))
+	users.Get(1)
+	users.Get(2)
+
+	plain := newCache(t, false)
+
+	e := New("fulmo")
+	require.NoError(t, e.Register("users", users.Metrics, users))
+	require.NoError(t, e.Register(`we"ird`, plain.Metrics, plain))
+	require.Error(t, e.Register("users", users.Metrics, users))
+	require.Error(t, e.Register("", nil, nil))
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, ContentType, rec.Header().Get("Content-Type"))
+	body := rec.Body.String()
+
+	for _, line := range []string{
+		"# TYPE fulmo_hits counter",
+		`fulmo_hits_total{cache="users"} 1`,
+		`fulmo_misses_total{cache="users"} 1`,
+		`fulmo_keys_added_total{cache="users"} 1`,
+		`fulmo_cost_added_total{cache="users"} 4`,
+		`fulmo_governor_shrinks_total{cache="users"} 0`,
+		`fulmo_shrink_evictions_total{cache="users"} 0`,
+		`fulmo_removals_total{cache="users",cause="capacity"} 0`,
+		`fulmo_removals_total{cache="users",cause="rejected"} 0`,
+		"# TYPE fulmo_max_cost gauge",
+		`fulmo_max_cost{cache="users"} 10`,
+		`fulmo_remaining_cost{cache="users"} 6`,
+		`fulmo_max_cost{cache="we\"ird"} 10`,
+		"# TYPE fulmo_life_expectancy_seconds histogram",
+		`fulmo_life_expectancy_seconds_bucket{cache="users",le="1"} 0`,
+		`fulmo_life_expectancy_seconds_bucket{cache="users",le="+Inf"} 0`,
+		`fulmo_life_expectancy_seconds_count{cache="users"} 0`,
+	} {
+		require.Contains(t, body, line+"\n")
+	}
+	require.True(t, strings.HasSuffix(body, "# EOF\n"))
+	// caches without metrics only export the costs
+	require.NotContains(t, body, `fulmo_hits_total{cache="we\"ird"}`)
+
+	e.Unregister("users")
+	var sb strings.Builder
+	n, err := e.WriteTo(&sb)
+	require.NoError(t, err)
+	require.Equal(t, int64(sb.Len()), n)
+	require.NotContains(t, sb.String(), `cache="users"`)
+}
+
+func TestExporterHistogram(t *testing.T) {
+	clk := clocktest.NewFake(time.Now())
+	c, err := fulmo.NewCache(&fulmo.Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            1,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		Synchronous:        true,
+		Clock:              clk,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// every new key evicts the previous one two seconds after it was added
+	for i := 0; i < 4; i++ {
+		c.Set(i, i, 1)
+		clk.Advance(2 * time.Second)
+	}
+
+	e := New("")
+	require.NoError(t, e.Register("c", c.Metrics, nil))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	body, err := io.ReadAll(rec.Body)
+	require.NoError(t, err)
+
+	evicted := c.Metrics.KeysEvicted()
+	require.NotZero(t, evicted)
+	// the evicted keys lived for two seconds, which is a bound of the buckets
+	require.Contains(t, string(body), "life_expectancy_seconds_bucket{cache=\"c\",le=\"1\"} 0\n")
+	require.Contains(t, string(body), fmt.Sprintf("life_expectancy_seconds_bucket{cache=\"c\",le=\"3\"} %d\n", evicted))
+	require.Contains(t, string(body), fmt.Sprintf("life_expectancy_seconds_count{cache=\"c\"} %d\n", evicted))
+	require.NotContains(t, string(body), "max_cost{")
+}
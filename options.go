@@ -0,0 +1,63 @@
+package fulmo
+
+import "time"
+
+// SetOption configures a set made with SetWithOptions.
+type SetOption func(*setOptions)
+
+type setOptions struct {
+	cost    int64
+	ttl     time.Duration
+	sliding bool
+	tags    []string
+	// ns is the namespace of the key, nil for keys set on the cache itself.
+	ns *namespace
+	// loaded is set for values coming from elsewhere, such as the Loader,
+	// which aren't passed to the Writer.
+	loaded bool
+	// promoted is set for items read from the SecondaryTier, see Cache.promote.
+	promoted bool
+}
+
+// WithCost sets the cost of the item, see Set.
+// Without it the cost is zero and Config.Cost is used.
+func WithCost(cost int64) SetOption {
+	return func(o *setOptions) {
+		o.cost = cost
+	}
+}
+
+// WithTTL sets the TTL of the item, see SetWithTTL.
+func WithTTL(ttl time.Duration) SetOption {
+	return func(o *setOptions) {
+		o.ttl, o.sliding = ttl, false
+	}
+}
+
+// WithSlidingTTL sets a sliding TTL on the item, see SetWithSlidingTTL.
+func WithSlidingTTL(ttl time.Duration) SetOption {
+	return func(o *setOptions) {
+		o.ttl, o.sliding = ttl, true
+	}
+}
+
+// WithTags tags the item, so it can be removed along with
+// all the other items with the same tag using InvalidateTag.
+// Setting a key again replaces its tags, so a key set without tags loses them.
+func WithTags(tags ...string) SetOption {
+	return func(o *setOptions) {
+		o.tags = append(o.tags, tags...)
+	}
+}
+
+// SetWithOptions works like Set, but the cost, TTL and tags of the item are given as options.
+// Without options it's identical to calling Set with a zero cost.
+//
+// See Set for more information.
+func (c *Cache[K, V]) SetWithOptions(key K, value V, opts ...SetOption) bool {
+	var o setOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return c.set(key, value, o, nil)
+}
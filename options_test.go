@@ -0,0 +1,42 @@
+package fulmo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheSetWithOptions(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Synchronous:        true,
+		Cost: func(value int) int64 {
+			return 7
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithOptions(1, 1))
+	require.Equal(t, int64(100-7), c.RemainingCost(), "the cost should default to Config.Cost")
+	ttl, ok := c.GetTTL(1)
+	require.True(t, ok)
+	require.Zero(t, ttl)
+
+	require.True(t, c.SetWithOptions(2, 2, WithCost(3), WithTTL(time.Hour)))
+	require.Equal(t, int64(100-7-3), c.RemainingCost())
+	ttl, ok = c.GetTTL(2)
+	require.True(t, ok)
+	require.InDelta(t, time.Hour, ttl, float64(time.Minute))
+
+	require.True(t, c.SetWithOptions(3, 3, WithSlidingTTL(time.Hour)))
+	require.Equal(t, time.Hour, c.storedItems.(*shardedMap[int]).shards[3%numShards].data[3].slide)
+
+	require.False(t, c.SetWithOptions(4, 4, WithTTL(-1)))
+	_, ok = c.Get(4)
+	require.False(t, ok)
+}
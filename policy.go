@@ -12,15 +12,53 @@ import (
 // 5 seems to be the most optimal number [citation needed].
 const lfuSample = 5
 
+// Policy is the interface for cache admission and eviction policies.
+// It decides which items are let into the cache and which ones are kicked out.
+// Keys are the hashes produced by Config.KeyToHash and costs already include
+// the internal cost of storing an item, unless Config.IgnoreInternalCost is set.
+//
+// Every Policy implementation must be safe for concurrent usage.
+type Policy[V any] interface {
+	// Add decides whether the item with the given key and cost should be accepted.
+	// It returns the list of victims that have been evicted and a boolean
+	// indicating whether the incoming item should be accepted.
+	Add(key uint64, cost int64) ([]*Item[V], bool)
+	// Update updates the cost of the key if it's already tracked by the policy.
+	Update(key uint64, cost int64)
+	// Del removes the key from the policy.
+	Del(key uint64)
+	// Has returns true if the key is tracked by the policy.
+	Has(key uint64) bool
+	// Cost returns the cost of the key or -1 if the key isn't tracked.
+	Cost(key uint64) int64
+	// Cap returns the remaining capacity of the policy.
+	Cap() int64
+	// Push records a batch of key accesses.
+	// It returns false if the batch was dropped.
+	Push(keys []uint64) bool
+	// Clear removes all keys and access statistics from the policy.
+	Clear()
+	// Close stops all goroutines started by the policy.
+	Close()
+	// MaxCost returns the current capacity of the policy.
+	MaxCost() int64
+	// UpdateMaxCost changes the capacity of the policy.
+	UpdateMaxCost(maxCost int64)
+	// CollectMetrics sets the metrics instance the policy reports to.
+	CollectMetrics(metrics *Metrics)
+}
+
 type policyPair struct {
 	key  uint64
 	cost int64
 }
 
-func newPolicy[V any](numCounters, maxCost int64) *defaultPolicy[V] {
+func newPolicy[V any](numCounters, maxCost int64) Policy[V] {
 	return newDefaultPolicy[V](numCounters, maxCost)
 }
 
+// defaultPolicy is the default Policy implementation,
+// it uses TinyLFU for admission and SampledLFU for eviction.
 type defaultPolicy[V any] struct {
 	sync.Mutex
 	isClosed bool
@@ -30,6 +68,8 @@ type defaultPolicy[V any] struct {
 	stop     chan struct{}
 	done     chan struct{}
 	itemsCh  chan []uint64
+	// quotas are the namespaces whose min costs are honored, nil if none has one.
+	quotas *namespaces
 }
 
 func newDefaultPolicy[V any](numCounters, maxCost int64) *defaultPolicy[V] {
@@ -184,12 +224,13 @@ func (p *defaultPolicy[V]) Add(key uint64, cost int64) ([]*Item[V], bool) {
 	sample := make([]*policyPair, 0, lfuSample)
 	// as items are evicted they will be appended to victims
 	victims := make([]*Item[V], 0)
+	check := p.quotas.evictCheck()
 
 	// delete victims until there's enough space or
 	// a minKey is found that has more hits than incoming item
 	for ; room < 0; room = p.evict.roomLeft(cost) {
 		// fill up empty slots in sample
-		sample = p.evict.fillSample(sample)
+		sample = p.evict.fillSample(sample, check.evictable)
 
 		// find minimally used item in sample
 		minKey, minHits, minId, minCost := uint64(0), int64(math.MaxInt64), 0, int64(0)
@@ -206,11 +247,16 @@ func (p *defaultPolicy[V]) Add(key uint64, cost int64) ([]*Item[V], bool) {
 			return victims, false
 		}
 
-		// delete the victim from metadata
-		p.evict.del(minKey)
 		// delete the victim from sample
 		sample[minId] = sample[len(sample)-1]
 		sample = sample[:len(sample)-1]
+		if !check.evictable(minKey) {
+			// the victims so far took its namespace down to its min cost
+			continue
+		}
+		// delete the victim from metadata
+		p.evict.del(minKey)
+		check.evicted(minKey)
 		// store victim in evicted victims slice
 		victims = append(victims, &Item[V]{
 			Key:      minKey,
@@ -224,6 +270,68 @@ func (p *defaultPolicy[V]) Add(key uint64, cost int64) ([]*Item[V], bool) {
 	return victims, true
 }
 
+// overflowEvicter is implemented by policies that can evict keys
+// until their cost fits their MaxCost again, after MaxCost was lowered.
+type overflowEvicter[V any] interface {
+	// evictOverflow evicts the least valuable keys until the cost fits MaxCost
+	// and returns them.
+	evictOverflow() []*Item[V]
+}
+
+func (p *defaultPolicy[V]) evictOverflow() []*Item[V] {
+	p.Lock()
+	defer p.Unlock()
+
+	var victims []*Item[V]
+	sample := make([]*policyPair, 0, lfuSample)
+	check := p.quotas.evictCheck()
+	for p.evict.roomLeft(0) < 0 {
+		if sample = p.evict.fillSample(sample, check.evictable); len(sample) == 0 {
+			// none of the keys may be evicted
+			break
+		}
+
+		minId, minHits := 0, int64(math.MaxInt64)
+		for i, pair := range sample {
+			if hits := p.admit.Estimate(pair.key); hits < minHits {
+				minId, minHits = i, hits
+			}
+		}
+
+		victim := sample[minId]
+		sample[minId] = sample[len(sample)-1]
+		sample = sample[:len(sample)-1]
+		if _, ok := p.evict.keyCosts[victim.key]; !ok {
+			// the sample may hold a key twice, it was evicted already
+			continue
+		}
+		if !check.evictable(victim.key) {
+			// the victims so far took its namespace down to its min cost
+			continue
+		}
+		p.evict.del(victim.key)
+		check.evicted(victim.key)
+		victims = append(victims, &Item[V]{
+			Key:      victim.key,
+			Conflict: 0,
+			Cost:     victim.cost,
+		})
+	}
+	return victims
+}
+
+func (p *defaultPolicy[V]) setQuotas(quotas *namespaces) {
+	p.Lock()
+	p.quotas = quotas
+	p.Unlock()
+}
+
+func (p *defaultPolicy[V]) frequency(key uint64) int64 {
+	p.Lock()
+	defer p.Unlock()
+	return p.admit.Estimate(key)
+}
+
 func (p *defaultPolicy[V]) processItems() {
 	for {
 		select {
@@ -373,12 +481,16 @@ func (p *sampledLFU) roomLeft(cost int64) int64 {
 	return p.getMaxCost() - (p.used + cost)
 }
 
-func (p *sampledLFU) fillSample(in []*policyPair) []*policyPair {
+// fillSample fills the sample with keys that are evictable, if evictable isn't nil.
+func (p *sampledLFU) fillSample(in []*policyPair, evictable func(key uint64) bool) []*policyPair {
 	if len(in) >= lfuSample {
 		return in
 	}
 
 	for key, cost := range p.keyCosts {
+		if evictable != nil && !evictable(key) {
+			continue
+		}
 		in = append(in, &policyPair{key, cost})
 		if len(in) >= lfuSample {
 			return in
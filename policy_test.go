@@ -100,16 +100,20 @@ func TestSampledLFUSample(t *testing.T) {
 		{1, 1},
 		{2, 2},
 		{3, 3},
-	})
+	}, nil)
 	k := sample[len(sample)-1].key
 	require.Equal(t, 5, len(sample))
 	require.NotEqual(t, 1, k)
 	require.NotEqual(t, 2, k)
 	require.NotEqual(t, 3, k)
-	require.Equal(t, len(sample), len(e.fillSample(sample)))
+	require.Equal(t, len(sample), len(e.fillSample(sample, nil)))
 	e.del(5)
-	sample = e.fillSample(sample[:len(sample)-2])
+	sample = e.fillSample(sample[:len(sample)-2], nil)
 	require.Equal(t, 4, len(sample))
+
+	// keys that aren't evictable are skipped
+	sample = e.fillSample(nil, func(key uint64) bool { return key != 4 })
+	require.Empty(t, sample)
 }
 
 func TestPolicy(t *testing.T) {
@@ -259,3 +263,34 @@ func TestPolicyAdd(t *testing.T) {
 	require.NotNil(t, victims)
 	require.False(t, added)
 }
+
+// countingPolicy wraps the default policy and counts admission requests.
+type countingPolicy struct {
+	*defaultPolicy[int]
+	adds int
+}
+
+func (p *countingPolicy) Add(key uint64, cost int64) ([]*Item[int], bool) {
+	p.adds++
+	return p.defaultPolicy.Add(key, cost)
+}
+
+func TestCustomPolicy(t *testing.T) {
+	p := &countingPolicy{defaultPolicy: newDefaultPolicy[int](100, 10)}
+	c, err := NewCache(&Config[int, int]{
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Policy:             p,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.Equal(t, int64(10), c.MaxCost())
+	require.True(t, c.Set(1, 1, 1))
+	c.Wait()
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	require.Equal(t, 1, p.adds)
+	require.Equal(t, int64(9), c.RemainingCost())
+}
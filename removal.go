@@ -0,0 +1,44 @@
+package fulmo
+
+// RemovalCause is the reason an item left the cache.
+type RemovalCause int
+
+const (
+	// RemovalCapacity means the item was evicted by the policy to make room for another one.
+	RemovalCapacity RemovalCause = iota
+	// RemovalExpired means the TTL of the item has passed.
+	RemovalExpired
+	// RemovalExplicit means the item was deleted with Del.
+	RemovalExplicit
+	// RemovalReplaced means the value was replaced by a set of the same key.
+	RemovalReplaced
+	// RemovalCleared means the item was removed by Clear or Close.
+	RemovalCleared
+	// RemovalRejected means the admission policy didn't let the item into the cache.
+	RemovalRejected
+)
+
+// String returns the name of the cause.
+func (c RemovalCause) String() string {
+	switch c {
+	case RemovalCapacity:
+		return "capacity"
+	case RemovalExpired:
+		return "expired"
+	case RemovalExplicit:
+		return "explicit"
+	case RemovalReplaced:
+		return "replaced"
+	case RemovalCleared:
+		return "cleared"
+	case RemovalRejected:
+		return "rejected"
+	default:
+		return "unidentified"
+	}
+}
+
+// metric returns the metric counting the removals with the cause.
+func (c RemovalCause) metric() metricType {
+	return removeCapacity + metricType(c)
+}
@@ -0,0 +1,98 @@
+package fulmo
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pchchv/fulmo/clock/clocktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheOnRemove(t *testing.T) {
+	var mu sync.Mutex
+	removed := make(map[RemovalCause][]int)
+	clk := clocktest.NewFake(time.Unix(1000, 0))
+	expired := make(chan struct{}, 1)
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            2,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+		Synchronous:        true,
+		Clock:              clk,
+		OnRemove: func(item *Item[int], cause RemovalCause) {
+			mu.Lock()
+			defer mu.Unlock()
+			removed[cause] = append(removed[cause], item.Value)
+			if cause == RemovalExpired {
+				expired <- struct{}{}
+			}
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.Set(1, 1, 1))
+	require.True(t, c.Set(1, 10, 1))
+	require.True(t, c.SetWithTTL(2, 2, 1, time.Second))
+	c.Del(1)
+	require.False(t, c.Set(3, 3, 5))
+
+	clk.Advance(2 * time.Second)
+	<-expired
+
+	require.True(t, c.Set(4, 4, 1))
+	require.True(t, c.Set(5, 5, 1))
+	// make room for a new key
+	require.True(t, c.Set(6, 6, 1))
+	c.Clear()
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, []int{1}, removed[RemovalReplaced])
+	require.Equal(t, []int{10}, removed[RemovalExplicit])
+	require.Equal(t, []int{3}, removed[RemovalRejected])
+	require.Equal(t, []int{2}, removed[RemovalExpired])
+	require.Len(t, removed[RemovalCapacity], 1)
+	require.Len(t, removed[RemovalCleared], 2)
+	require.Equal(t, uint64(2), c.Metrics.Removals(RemovalCleared))
+	require.Zero(t, c.Metrics.Removals(RemovalCause(-1)))
+}
+
+func TestRemovalCauseString(t *testing.T) {
+	require.Equal(t, "capacity", RemovalCapacity.String())
+	require.Equal(t, "rejected", RemovalRejected.String())
+	require.Equal(t, "unidentified", RemovalCause(100).String())
+}
+
+func TestCacheDiscard(t *testing.T) {
+	var removed, evicted, exited []int
+	c, err := NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Metrics:     true,
+		OnRemove: func(item *Item[int], _ RemovalCause) {
+			removed = append(removed, item.Value)
+		},
+		OnEvict: func(item *Item[int]) {
+			evicted = append(evicted, item.Value)
+		},
+		OnExit: func(val int) {
+			exited = append(exited, val)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// buffered items dropped by Clear were never in the cache
+	c.discard(&Item[int]{flag: itemNew, Key: 1, Value: 1})
+	c.discard(&Item[int]{flag: itemUpdate, Key: 2, Value: 2})
+	c.discard(&Item[int]{flag: itemDelete, Key: 3})
+	require.Empty(t, removed)
+	require.Empty(t, evicted)
+	require.Equal(t, []int{1}, exited, "the values of new items should be released")
+	require.Zero(t, c.Metrics.Removals(RemovalCleared))
+}
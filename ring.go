@@ -43,6 +43,16 @@ func (b *ringBuffer) Push(item uint64) {
 	b.pool.Put(stripe)
 }
 
+// PushMany adds the elements to one of the internal stripes,
+// draining it as many times as it becomes full.
+func (b *ringBuffer) PushMany(items []uint64) {
+	stripe := b.pool.Get().(*ringStripe)
+	for _, item := range items {
+		stripe.Push(item)
+	}
+	b.pool.Put(stripe)
+}
+
 // ringStripe is a singular ring buffer that is not concurrent safe.
 type ringStripe struct {
 	cons ringConsumer
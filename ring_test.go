@@ -69,3 +69,19 @@ func TestRingReset(t *testing.T) {
 	}
 	require.Equal(t, 0, drains, "testConsumer shouldn't be draining")
 }
+
+func TestRingPushMany(t *testing.T) {
+	var drained []uint64
+	r := newRingBuffer(&testConsumer{
+		push: func(items []uint64) {
+			drained = append(drained, items...)
+		},
+		save: true,
+	}, 4)
+	items := make([]uint64, 10)
+	for i := range items {
+		items[i] = uint64(i)
+	}
+	r.PushMany(items)
+	require.Equal(t, items[:8], drained, "full stripes should be drained in order")
+}
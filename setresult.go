@@ -0,0 +1,85 @@
+package fulmo
+
+import "time"
+
+// SetStatus is the outcome of a set.
+type SetStatus int
+
+const (
+	// SetAdmitted means the item was added to the cache.
+	SetAdmitted SetStatus = iota
+	// SetUpdated means the item replaced the value of a key already in the cache.
+	SetUpdated
+	// SetRejectedByPolicy means the admission policy decided
+	// the item isn't worth keeping over the items already in the cache.
+	SetRejectedByPolicy
+	// SetDroppedBufferFull means the set was dropped
+	// because the set buffer was full under contention.
+	SetDroppedBufferFull
+	// SetTooLarge means the cost of the item exceeds the MaxCost of the cache.
+	SetTooLarge
+	// SetDiscarded means the set was a no-op: the TTL was negative,
+	// the cache was closed, or it was cleared before the set was processed.
+	SetDiscarded
+	// SetWriteFailed means the Writer failed to write the value through,
+	// so it wasn't cached, see Config.Writer.
+	SetWriteFailed
+)
+
+// String returns the name of the status.
+func (s SetStatus) String() string {
+	switch s {
+	case SetAdmitted:
+		return "admitted"
+	case SetUpdated:
+		return "updated"
+	case SetRejectedByPolicy:
+		return "rejected by policy"
+	case SetDroppedBufferFull:
+		return "dropped, buffer full"
+	case SetTooLarge:
+		return "too large"
+	case SetDiscarded:
+		return "discarded"
+	case SetWriteFailed:
+		return "write failed"
+	default:
+		return "unidentified"
+	}
+}
+
+// SetResult reports what happened to a set once the cache processed it.
+type SetResult[V any] struct {
+	Status SetStatus
+	// Victims are the items evicted while trying to make room for the new item.
+	// The policy may evict items and still reject the new one.
+	Victims []*Item[V]
+}
+
+// Cached reports whether the value is in the cache after the set.
+func (r SetResult[V]) Cached() bool {
+	return r.Status == SetAdmitted || r.Status == SetUpdated
+}
+
+// SetWithResult works like SetWithTTL, but blocks until the set is processed
+// and reports whether the value was actually cached, along with the items
+// evicted to make room for it.
+//
+// Unlike Set, SetWithResult waits for the set buffer to be applied,
+// so it's meant for callers that need to know the outcome rather than hot paths.
+func (c *Cache[K, V]) SetWithResult(key K, value V, cost int64, ttl time.Duration) SetResult[V] {
+	if c == nil {
+		return SetResult[V]{Status: SetDiscarded}
+	}
+
+	result := make(chan SetResult[V], 1)
+	c.set(key, value, setOptions{cost: cost, ttl: ttl}, result)
+	return <-result
+}
+
+// sendResult reports the outcome of a set, if the setter waits for it.
+func sendResult[V any](result chan<- SetResult[V], status SetStatus, victims []*Item[V]) {
+	if result != nil {
+		result <- SetResult[V]{Status: status, Victims: victims}
+	}
+}
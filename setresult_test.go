@@ -0,0 +1,91 @@
+package fulmo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetWithResult(t *testing.T) {
+	for _, synchronous := range []bool{false, true} {
+		c, err := NewCache(&Config[int, int]{
+			NumCounters:        100,
+			MaxCost:            2,
+			IgnoreInternalCost: true,
+			BufferItems:        64,
+			Synchronous:        synchronous,
+		})
+		require.NoError(t, err)
+
+		r := c.SetWithResult(1, 1, 1, 0)
+		require.Equal(t, SetAdmitted, r.Status)
+		require.True(t, r.Cached())
+		require.Empty(t, r.Victims)
+		val, ok := c.Get(1)
+		require.True(t, ok)
+		require.Equal(t, 1, val)
+
+		r = c.SetWithResult(1, 2, 1, 0)
+		require.Equal(t, SetUpdated, r.Status)
+		require.True(t, r.Cached())
+
+		r = c.SetWithResult(2, 2, 3, 0)
+		require.Equal(t, SetTooLarge, r.Status)
+		require.False(t, r.Cached())
+
+		r = c.SetWithResult(2, 2, 1, -1)
+		require.Equal(t, SetDiscarded, r.Status)
+
+		// make the key already in the cache more popular, so the new key replaces the other one
+		policy := c.cachePolicy.(*defaultPolicy[int])
+		increment := func(key int) {
+			k, _ := c.keyToHash(key)
+			policy.Lock()
+			policy.admit.Increment(k)
+			policy.Unlock()
+		}
+		increment(1)
+		require.Equal(t, SetAdmitted, c.SetWithResult(2, 2, 1, 0).Status)
+		r = c.SetWithResult(3, 3, 1, 0)
+		require.Equal(t, SetAdmitted, r.Status)
+		require.Len(t, r.Victims, 1)
+		require.Equal(t, 2, r.Victims[0].Value)
+
+		// the new key is less popular than both keys in the cache
+		increment(3)
+		r = c.SetWithResult(4, 4, 1, 0)
+		require.Equal(t, SetRejectedByPolicy, r.Status)
+		require.Empty(t, r.Victims)
+
+		c.Close()
+		require.Equal(t, SetDiscarded, c.SetWithResult(1, 1, 1, 0).Status)
+	}
+}
+
+func TestSetWithResultBufferFull(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// stop the processing goroutine and fill the buffer
+	c.stop <- struct{}{}
+	<-c.done
+	for i := 0; i < setBufSize; i++ {
+		c.setBuf <- &Item[int]{flag: itemDelete}
+	}
+
+	r := c.SetWithResult(1, 1, 1, 0)
+	require.Equal(t, SetDroppedBufferFull, r.Status)
+	go c.processItems()
+}
+
+func TestSetStatusString(t *testing.T) {
+	require.Equal(t, "admitted", SetAdmitted.String())
+	require.Equal(t, "too large", SetTooLarge.String())
+	require.Equal(t, "unidentified", SetStatus(-1).String())
+}
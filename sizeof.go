@@ -0,0 +1,241 @@
+package fulmo
+
+import (
+	"reflect"
+	"sync"
+	"unsafe"
+)
+
+// mapHeaderSize approximates the size of the header of a map,
+// and mapSlotOverhead the control byte of each slot of its table.
+const (
+	mapHeaderSize   = 48
+	mapSlotOverhead = 1
+)
+
+// Sizer is implemented by values that know their memory size better than
+// EstimateCost does, such as values holding memory allocated outside of the Go heap.
+type Sizer interface {
+	// SizeOf returns the size of the value in bytes, including the memory it references.
+	SizeOf() int64
+}
+
+var sizerType = reflect.TypeFor[Sizer]()
+
+// typeSizer computes the memory a value of a type references,
+// beyond the size of the value itself.
+type typeSizer struct {
+	// flat is set for types that reference no memory, such as integers
+	// and structs of them, their values don't need to be walked.
+	flat bool
+	fn   func(v reflect.Value, vs *visitSet) int64
+}
+
+// typeSizers caches the typeSizer of every type EstimateCost has seen.
+var typeSizers sync.Map // map[reflect.Type]*typeSizer
+
+// EstimateCost estimates the memory size of the value in bytes,
+// so it can be used as Config.Cost to make MaxCost a bound in bytes:
+//
+//	Cost: fulmo.EstimateCost[*User],
+//
+// Strings, slices, maps, pointers and interfaces are followed to add the memory they reference,
+// each pointer only once. Channels, functions and unsafe pointers aren't followed.
+// Values and nested values implementing Sizer are measured by their SizeOf method instead.
+// Maps are estimated from their number of entries, and the way types are walked
+// is cached, so values made only of fixed-size fields are measured in constant time.
+//
+// The estimate doesn't include the internal cost of storing the item, see Config.IgnoreInternalCost.
+func EstimateCost[V any](value V) int64 {
+	v := reflect.ValueOf(&value).Elem()
+	size := int64(v.Type().Size())
+	if ts := sizerFor(v.Type()); !ts.flat {
+		size += ts.fn(v, &visitSet{})
+	}
+	return size
+}
+
+// sizerFor returns the cached typeSizer of the type, building it if needed.
+// The typeSizers built along with it are only cached once all of them are complete,
+// as those of recursive types refer to each other while they're built.
+func sizerFor(t reflect.Type) *typeSizer {
+	if ts, ok := typeSizers.Load(t); ok {
+		return ts.(*typeSizer)
+	}
+
+	built := make(map[reflect.Type]*typeSizer)
+	ts := buildSizer(t, built)
+	for bt, bts := range built {
+		typeSizers.LoadOrStore(bt, bts)
+	}
+	return ts
+}
+
+// buildSizer builds the typeSizer of the type, adding it to built.
+// Types already in built are returned as they are, so recursive types
+// refer to their own typeSizer before it's complete.
+func buildSizer(t reflect.Type, built map[reflect.Type]*typeSizer) *typeSizer {
+	if ts, ok := typeSizers.Load(t); ok {
+		return ts.(*typeSizer)
+	}
+	if ts, ok := built[t]; ok {
+		return ts
+	}
+
+	ts := &typeSizer{}
+	built[t] = ts
+	ts.flat, ts.fn = buildSizerFn(t, built)
+	return ts
+}
+
+func buildSizerFn(t reflect.Type, built map[reflect.Type]*typeSizer) (bool, func(reflect.Value, *visitSet) int64) {
+	// pointers to values implementing Sizer are measured like other pointers
+	if t.Implements(sizerType) && t.Kind() != reflect.Interface &&
+		(t.Kind() != reflect.Pointer || !t.Elem().Implements(sizerType)) {
+		inline := int64(t.Size())
+		return false, func(v reflect.Value, _ *visitSet) int64 {
+			if v.Kind() == reflect.Pointer && v.IsNil() {
+				return 0
+			}
+			if !v.CanInterface() {
+				// values of unexported fields can only be read through their address
+				if !v.CanAddr() {
+					return 0
+				}
+				v = reflect.NewAt(t, unsafe.Pointer(v.UnsafeAddr())).Elem()
+			}
+			return max(v.Interface().(Sizer).SizeOf()-inline, 0)
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return false, func(v reflect.Value, _ *visitSet) int64 {
+			return int64(v.Len())
+		}
+	case reflect.Slice:
+		elem := buildSizer(t.Elem(), built)
+		elemSize := int64(t.Elem().Size())
+		return false, func(v reflect.Value, vs *visitSet) int64 {
+			size := int64(v.Cap()) * elemSize
+			if !elem.flat {
+				for idx := range v.Len() {
+					size += elem.fn(v.Index(idx), vs)
+				}
+			}
+			return size
+		}
+	case reflect.Array:
+		elem := buildSizer(t.Elem(), built)
+		if elem.flat || t.Len() == 0 {
+			return true, nil
+		}
+		return false, func(v reflect.Value, vs *visitSet) int64 {
+			var size int64
+			for idx := range v.Len() {
+				size += elem.fn(v.Index(idx), vs)
+			}
+			return size
+		}
+	case reflect.Struct:
+		type field struct {
+			idx int
+			ts  *typeSizer
+		}
+		var fields []field
+		for idx := range t.NumField() {
+			if ts := buildSizer(t.Field(idx).Type, built); !ts.flat {
+				fields = append(fields, field{idx, ts})
+			}
+		}
+		if len(fields) == 0 {
+			return true, nil
+		}
+		return false, func(v reflect.Value, vs *visitSet) int64 {
+			var size int64
+			for _, f := range fields {
+				size += f.ts.fn(v.Field(f.idx), vs)
+			}
+			return size
+		}
+	case reflect.Pointer:
+		elem := buildSizer(t.Elem(), built)
+		elemSize := int64(t.Elem().Size())
+		return false, func(v reflect.Value, vs *visitSet) int64 {
+			if v.IsNil() || visited(v, vs) {
+				return 0
+			}
+			size := elemSize
+			if !elem.flat {
+				size += elem.fn(v.Elem(), vs)
+			}
+			return size
+		}
+	case reflect.Map:
+		key, elem := buildSizer(t.Key(), built), buildSizer(t.Elem(), built)
+		slotSize := int64(t.Key().Size()+t.Elem().Size()) + mapSlotOverhead
+		return false, func(v reflect.Value, vs *visitSet) int64 {
+			if v.IsNil() || visited(v, vs) {
+				return 0
+			}
+			// maps keep their load under 7/8 of their slots
+			size := mapHeaderSize + (int64(v.Len())*8/7+1)*slotSize
+			if !key.flat || !elem.flat {
+				iter := v.MapRange()
+				for iter.Next() {
+					if !key.flat {
+						size += key.fn(iter.Key(), vs)
+					}
+					if !elem.flat {
+						size += elem.fn(iter.Value(), vs)
+					}
+				}
+			}
+			return size
+		}
+	case reflect.Interface:
+		return false, func(v reflect.Value, vs *visitSet) int64 {
+			if v.IsNil() {
+				return 0
+			}
+			elem := v.Elem()
+			ts := sizerFor(elem.Type())
+			var size int64
+			if elem.Kind() != reflect.Pointer {
+				// values other than pointers are boxed
+				size = int64(elem.Type().Size())
+			}
+			if !ts.flat {
+				size += ts.fn(elem, vs)
+			}
+			return size
+		}
+	default:
+		// numbers, booleans, channels, functions and unsafe pointers
+		return true, nil
+	}
+}
+
+// visitSet holds the pointers and maps already measured by EstimateCost.
+type visitSet struct {
+	seen map[visitKey]struct{}
+}
+
+// visitKey tells apart the pointers to a struct and to its first field.
+type visitKey struct {
+	ptr uintptr
+	t   reflect.Type
+}
+
+// visited reports whether the pointer or map was already measured, and marks it as measured.
+func visited(v reflect.Value, vs *visitSet) bool {
+	key := visitKey{v.Pointer(), v.Type()}
+	if _, ok := vs.seen[key]; ok {
+		return true
+	}
+	if vs.seen == nil {
+		vs.seen = make(map[visitKey]struct{})
+	}
+	vs.seen[key] = struct{}{}
+	return false
+}
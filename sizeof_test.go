@@ -0,0 +1,125 @@
+package fulmo
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type sizeOfPoint struct {
+	X, Y int64
+}
+
+type sizeOfUser struct {
+	Name    string
+	Tags    []string
+	Attrs   map[string]int64
+	Friend  *sizeOfUser
+	Point   sizeOfPoint
+	Payload any
+}
+
+type sizeOfBlob struct {
+	n int64
+}
+
+func (b sizeOfBlob) SizeOf() int64 {
+	return b.n
+}
+
+type sizeOfHolder struct {
+	blob sizeOfBlob
+	ptr  *sizeOfBlob
+}
+
+func TestEstimateCost(t *testing.T) {
+	require.Equal(t, int64(8), EstimateCost(int64(1)))
+	require.Equal(t, int64(16), EstimateCost(sizeOfPoint{}))
+	require.Equal(t, int64(16+5), EstimateCost("hello"))
+	require.Equal(t, int64(24+10*8), EstimateCost(make([]int64, 3, 10)))
+	require.Equal(t, int64(24+2*16+3+4), EstimateCost([]string{"abc", "defg"}))
+	require.Equal(t, int64(8+16), EstimateCost(&sizeOfPoint{}))
+	require.Equal(t, int64(8), EstimateCost[*sizeOfPoint](nil))
+	require.Equal(t, int64(16+16), EstimateCost[any](sizeOfPoint{}), "values in interfaces should be boxed")
+	require.Equal(t, int64(16+24+1), EstimateCost[any]([]byte{1}))
+	require.Equal(t, int64(16), EstimateCost[any](nil))
+
+	m := map[int64]int64{1: 1, 2: 2}
+	require.Equal(t, int64(8+mapHeaderSize+(2*8/7+1)*(8+8+mapSlotOverhead)), EstimateCost(m))
+	var nilMap map[int64]int64
+	require.Equal(t, int64(8), EstimateCost(nilMap))
+}
+
+func TestEstimateCostDeep(t *testing.T) {
+	user := &sizeOfUser{
+		Name:    "alice",
+		Tags:    []string{"admin"},
+		Attrs:   map[string]int64{"age": 30},
+		Payload: []byte("payload"),
+	}
+	userSize := EstimateCost(sizeOfUser{})
+	want := 8 + userSize + 5 + // the pointer, the user and its name
+		(16 + 5) + // the tags
+		(mapHeaderSize + (8/7+1)*(16+8+mapSlotOverhead) + 3) + // the attrs
+		(24 + 7) // the payload
+	require.Equal(t, want, EstimateCost(user))
+
+	// cycles are only measured once
+	user.Friend = user
+	require.Equal(t, want, EstimateCost(user))
+
+	friend := &sizeOfUser{Name: "bob"}
+	user.Friend = friend
+	require.Equal(t, want+userSize+3, EstimateCost(user))
+}
+
+func TestEstimateCostSizer(t *testing.T) {
+	require.Equal(t, int64(1000), EstimateCost(sizeOfBlob{1000}))
+	require.Equal(t, int64(8+1000), EstimateCost(&sizeOfBlob{1000}), "the pointer should be added")
+	require.Equal(t, int64(16+1000), EstimateCost[any](sizeOfBlob{1000}))
+	require.Equal(t, int64(1000+8+2000), EstimateCost(sizeOfHolder{
+		blob: sizeOfBlob{1000},
+		ptr:  &sizeOfBlob{2000},
+	}), "nested Sizers should be measured, even in unexported fields")
+	require.Equal(t, int64(16), EstimateCost(sizeOfHolder{}))
+}
+
+type sizeOfNode struct {
+	Next *sizeOfNode
+	Name string
+}
+
+func TestEstimateCostConcurrent(t *testing.T) {
+	// the typeSizers of recursive types are built by many goroutines at once
+	node := sizeOfNode{Name: "a", Next: &sizeOfNode{Name: "b"}}
+	var wg sync.WaitGroup
+	for idx := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if idx%2 == 0 {
+				require.Equal(t, int64(24+1+24+1), EstimateCost(node))
+			} else {
+				require.Equal(t, int64(8+24+1+24+1), EstimateCost(&node))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestEstimateCostConfig(t *testing.T) {
+	c, err := NewCache(&Config[int, string]{
+		NumCounters:        100,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Synchronous:        true,
+		Cost:               EstimateCost[string],
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.Set(1, "0123456789", 0))
+	require.Equal(t, int64(100-16-10), c.RemainingCost())
+}
@@ -0,0 +1,242 @@
+package fulmo
+
+import (
+	"math"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pchchv/fulmo/helpers"
+)
+
+const (
+	// minChunkShift and maxChunkShift bound the chunk sizes of the slab classes,
+	// from 64B to 64KB in powers of two.
+	minChunkShift = 6
+	maxChunkShift = 16
+	// slabSize is the size of the slabs of the classes.
+	slabSize = 1 << 20
+	// largeClass holds the values bigger than the biggest chunk,
+	// each in an allocation of its own.
+	largeClass = maxChunkShift - minChunkShift + 2
+	// callocTag is the tag of the allocations of the slabs, see helpers.Leaks.
+	callocTag = "fulmo.ByteCache"
+)
+
+// slabRef locates a value stored in a slabAllocator. The zero slabRef is the empty value,
+// which takes no memory.
+type slabRef struct {
+	// n is the length of the value.
+	n uint32
+	// id is the chunk of the value in its class.
+	id uint32
+	// gen is the generation of the chunk when the value was stored,
+	// it tells stale refs apart once the chunk is freed.
+	gen uint32
+	// class is the size class of the chunk, 0 for the empty value.
+	class uint8
+}
+
+// slab is a manually allocated block of memory split into chunks of the same size.
+type slab struct {
+	mem  []byte
+	gens []uint32
+}
+
+// slabClass allocates the chunks of one size.
+type slabClass struct {
+	mu sync.RWMutex
+	// size is the size of the chunks, 0 for largeClass.
+	size  int
+	slabs []*slab
+	// free holds the ids of the free chunks.
+	free []uint32
+}
+
+// slabAllocator stores byte values outside of the Go heap, in slabs allocated
+// with helpers.Calloc. Only the slab headers and the generations of the chunks
+// are kept on the heap.
+//
+// Values are copied in and out, and a value is never read after its chunk
+// is freed: refs of freed chunks are stale and reads and frees of them are no-ops.
+type slabAllocator struct {
+	classes [largeClass + 1]slabClass
+	// allocated is the number of bytes allocated for the slabs.
+	allocated atomic.Int64
+	closed    atomic.Bool
+}
+
+func newSlabAllocator() *slabAllocator {
+	a := &slabAllocator{}
+	for shift := minChunkShift; shift <= maxChunkShift; shift++ {
+		a.classes[shift-minChunkShift+1].size = 1 << shift
+	}
+	return a
+}
+
+// classOf returns the class of the chunks that fit values of n bytes.
+func classOf(n int) uint8 {
+	switch {
+	case n == 0:
+		return 0
+	case n > 1<<maxChunkShift:
+		return largeClass
+	case n <= 1<<minChunkShift:
+		return 1
+	default:
+		return uint8(bits.Len(uint(n-1)) - minChunkShift + 1)
+	}
+}
+
+// put copies the value to a free chunk and returns its ref and the size of the chunk.
+// It returns false if the value is too big to be stored.
+func (a *slabAllocator) put(value []byte) (slabRef, int64, bool) {
+	if len(value) > math.MaxUint32 || a.closed.Load() {
+		return slabRef{}, 0, false
+	}
+
+	ref := slabRef{n: uint32(len(value)), class: classOf(len(value))}
+	if ref.class == 0 {
+		return ref, 0, true
+	}
+
+	sc := &a.classes[ref.class]
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if a.closed.Load() {
+		return slabRef{}, 0, false
+	}
+
+	if sc.size == 0 {
+		ref.id = a.putLarge(sc, len(value))
+	} else {
+		if len(sc.free) == 0 {
+			a.grow(sc)
+		}
+		ref.id = sc.free[len(sc.free)-1]
+		sc.free = sc.free[:len(sc.free)-1]
+	}
+	s, chunk := sc.chunk(ref.id)
+	ref.gen = s.gens[chunk]
+	copy(sc.mem(s, chunk), value)
+	return ref, int64(sc.chunkSize(s)), true
+}
+
+// grow adds a slab to the class and its chunks to the free chunks.
+// The caller must hold sc.mu.
+func (a *slabAllocator) grow(sc *slabClass) {
+	perSlab := slabSize / sc.size
+	first := len(sc.slabs) * perSlab
+	sc.slabs = append(sc.slabs, &slab{mem: helpers.Calloc(slabSize, callocTag), gens: make([]uint32, perSlab)})
+	a.allocated.Add(slabSize)
+	// push the chunks in reverse, so they are handed out in order
+	for id := first + perSlab - 1; id >= first; id-- {
+		sc.free = append(sc.free, uint32(id))
+	}
+}
+
+// putLarge allocates n bytes for a large value and returns the id of the allocation,
+// reusing the id of a released one if there's any.
+// The caller must hold sc.mu.
+func (a *slabAllocator) putLarge(sc *slabClass, n int) uint32 {
+	a.allocated.Add(int64(n))
+	if len(sc.free) > 0 {
+		id := sc.free[len(sc.free)-1]
+		sc.free = sc.free[:len(sc.free)-1]
+		sc.slabs[id].mem = helpers.Calloc(n, callocTag)
+		return id
+	}
+	sc.slabs = append(sc.slabs, &slab{mem: helpers.Calloc(n, callocTag), gens: make([]uint32, 1)})
+	return uint32(len(sc.slabs) - 1)
+}
+
+// get appends the value of the ref to dst.
+// It returns false if the chunk of the ref was freed.
+func (a *slabAllocator) get(ref slabRef, dst []byte) ([]byte, bool) {
+	if ref.class == 0 {
+		return dst, true
+	}
+
+	sc := &a.classes[ref.class]
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	if a.closed.Load() {
+		return dst, false
+	}
+
+	s, chunk := sc.chunk(ref.id)
+	if s.gens[chunk] != ref.gen {
+		return dst, false
+	}
+	return append(dst, sc.mem(s, chunk)[:ref.n]...), true
+}
+
+// free frees the chunk of the ref, unless it was already freed.
+// Chunks of the classes are kept for reuse, large values are released.
+func (a *slabAllocator) free(ref slabRef) {
+	if ref.class == 0 {
+		return
+	}
+
+	sc := &a.classes[ref.class]
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if a.closed.Load() {
+		return
+	}
+
+	s, chunk := sc.chunk(ref.id)
+	if s.gens[chunk] != ref.gen {
+		return
+	}
+	s.gens[chunk]++
+	if sc.size == 0 {
+		a.allocated.Add(-int64(len(s.mem)))
+		helpers.Free(s.mem)
+		s.mem = nil
+	}
+	sc.free = append(sc.free, ref.id)
+}
+
+// close releases all the slabs, the refs are stale afterwards.
+func (a *slabAllocator) close() {
+	a.closed.Store(true)
+	for idx := range a.classes {
+		sc := &a.classes[idx]
+		sc.mu.Lock()
+		for _, s := range sc.slabs {
+			if s.mem != nil {
+				a.allocated.Add(-int64(len(s.mem)))
+				helpers.Free(s.mem)
+				s.mem = nil
+			}
+		}
+		sc.slabs, sc.free = nil, nil
+		sc.mu.Unlock()
+	}
+}
+
+// chunk returns the slab of the chunk with the id and the index of the chunk in it.
+func (sc *slabClass) chunk(id uint32) (*slab, int) {
+	if sc.size == 0 {
+		return sc.slabs[id], 0
+	}
+	perSlab := uint32(slabSize / sc.size)
+	return sc.slabs[id/perSlab], int(id % perSlab)
+}
+
+// mem returns the memory of the chunk.
+func (sc *slabClass) mem(s *slab, chunk int) []byte {
+	if sc.size == 0 {
+		return s.mem
+	}
+	return s.mem[chunk*sc.size : (chunk+1)*sc.size]
+}
+
+// chunkSize returns the size of the chunks of the slab.
+func (sc *slabClass) chunkSize(s *slab) int {
+	if sc.size == 0 {
+		return len(s.mem)
+	}
+	return sc.size
+}
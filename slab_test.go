@@ -0,0 +1,94 @@
+package fulmo
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// inUse returns the number of chunks of the allocator that aren't free.
+func (a *slabAllocator) inUse() int {
+	n := 0
+	for idx := range a.classes {
+		sc := &a.classes[idx]
+		sc.mu.RLock()
+		if sc.size == 0 {
+			n += len(sc.slabs)
+		} else {
+			n += len(sc.slabs) * (slabSize / sc.size)
+		}
+		n -= len(sc.free)
+		sc.mu.RUnlock()
+	}
+	return n
+}
+
+func TestSlabClassOf(t *testing.T) {
+	for n, class := range map[int]uint8{
+		0:           0,
+		1:           1,
+		64:          1,
+		65:          2,
+		128:         2,
+		1000:        5,
+		1 << 16:     largeClass - 1,
+		1<<16 + 1:   largeClass,
+		100_000_000: largeClass,
+	} {
+		require.Equal(t, class, classOf(n), "n=%d", n)
+	}
+}
+
+func TestSlabAllocator(t *testing.T) {
+	a := newSlabAllocator()
+	small := bytes.Repeat([]byte{1}, 100)
+	ref, cost, ok := a.put(small)
+	require.True(t, ok)
+	require.Equal(t, int64(128), cost)
+	require.Equal(t, int64(slabSize), a.allocated.Load())
+
+	value, ok := a.get(ref, nil)
+	require.True(t, ok)
+	require.Equal(t, small, value)
+
+	a.free(ref)
+	_, ok = a.get(ref, nil)
+	require.False(t, ok, "freed chunks shouldn't be read")
+	require.Zero(t, a.inUse())
+
+	// the chunk is reused, the stale ref doesn't free it again
+	other := bytes.Repeat([]byte{2}, 120)
+	ref2, _, ok := a.put(other)
+	require.True(t, ok)
+	require.Equal(t, ref.id, ref2.id)
+	a.free(ref)
+	value, ok = a.get(ref2, nil)
+	require.True(t, ok)
+	require.Equal(t, other, value)
+	require.Equal(t, 1, a.inUse())
+
+	large := bytes.Repeat([]byte{3}, 1<<17)
+	ref3, cost, ok := a.put(large)
+	require.True(t, ok)
+	require.Equal(t, int64(1<<17), cost)
+	value, ok = a.get(ref3, nil)
+	require.True(t, ok)
+	require.Equal(t, large, value)
+	a.free(ref3)
+	require.Equal(t, int64(slabSize), a.allocated.Load(), "large values should be released")
+
+	empty, cost, ok := a.put(nil)
+	require.True(t, ok)
+	require.Zero(t, cost)
+	value, ok = a.get(empty, nil)
+	require.True(t, ok)
+	require.Empty(t, value)
+
+	a.close()
+	require.Zero(t, a.allocated.Load())
+	_, ok = a.get(ref2, nil)
+	require.False(t, ok)
+	_, _, ok = a.put(small)
+	require.False(t, ok)
+}
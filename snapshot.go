@@ -0,0 +1,499 @@
+package fulmo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/pchchv/fulmo/helpers"
+)
+
+const (
+	snapshotVersion byte = 1
+	// snapshotAdmission is the header flag marking that the admission state follows the entries.
+	snapshotAdmission byte = 1 << 0
+	// record tags separating the entries from the end of the entry list.
+	snapshotEnd   byte = 0
+	snapshotEntry byte = 1
+)
+
+var (
+	snapshotMagic = []byte("FULMOSNP")
+	// ErrKeysNotStored is returned by SaveTo when the cache doesn't keep the original keys.
+	ErrKeysNotStored = errors.New("StoreKeys must be set to save the cache")
+	// ErrBadSnapshot is returned by LoadFrom when the input isn't a valid snapshot.
+	ErrBadSnapshot = errors.New("invalid cache snapshot")
+	errClosed      = errors.New("cache is closed")
+)
+
+// Codec encodes keys and values for SaveTo and LoadFrom.
+type Codec[K Key, V any] interface {
+	EncodeKey(key K) ([]byte, error)
+	DecodeKey(data []byte) (K, error)
+	EncodeValue(value V) ([]byte, error)
+	DecodeValue(data []byte) (V, error)
+}
+
+// GobCodec is a Codec encoding keys and values with encoding/gob.
+type GobCodec[K Key, V any] struct{}
+
+func (GobCodec[K, V]) EncodeKey(key K) ([]byte, error) {
+	return gobEncode(key)
+}
+
+func (GobCodec[K, V]) DecodeKey(data []byte) (K, error) {
+	return gobDecode[K](data)
+}
+
+func (GobCodec[K, V]) EncodeValue(value V) ([]byte, error) {
+	return gobEncode(value)
+}
+
+func (GobCodec[K, V]) DecodeValue(data []byte) (V, error) {
+	return gobDecode[V](data)
+}
+
+// SnapshotOption configures SaveTo.
+type SnapshotOption func(*snapshotOptions)
+
+type snapshotOptions struct {
+	admission bool
+}
+
+// WithAdmissionState makes SaveTo also save the TinyLFU admission state,
+// the count-min sketch and the doorkeeper bloom filter, so that admission
+// decisions survive restarts. It's ignored for policies without TinyLFU.
+func WithAdmissionState() SnapshotOption {
+	return func(o *snapshotOptions) {
+		o.admission = true
+	}
+}
+
+// admissionSaver is implemented by policies whose TinyLFU state can be saved and restored.
+type admissionSaver interface {
+	// saveAdmission writes the TinyLFU state to w.
+	saveAdmission(w io.Writer) error
+	// loadAdmission replaces the TinyLFU state if it's compatible with the policy.
+	loadAdmission(t *tinyLFU) bool
+}
+
+type snapshotEntryData[K Key, V any] struct {
+	key   K
+	value V
+	cost  int64
+	ttl   time.Duration
+}
+
+// SaveTo writes the keys, values, costs and remaining TTLs of the cache to w.
+// The snapshot is versioned and checksummed and can be restored with LoadFrom.
+// SaveTo requires Config.StoreKeys, as the original keys are needed to restore
+// the items, and returns ErrKeysNotStored otherwise.
+//
+// Like Range, SaveTo doesn't correspond to any consistent snapshot of the whole
+// cache, concurrent writes may or may not be saved.
+func (c *Cache[K, V]) SaveTo(w io.Writer, codec Codec[K, V], opts ...SnapshotOption) error {
+	if c == nil || c.isClosed.Load() {
+		return errClosed
+	}
+
+	if !c.storeKeys {
+		return ErrKeysNotStored
+	}
+
+	var o snapshotOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	admission, ok := c.cachePolicy.(admissionSaver)
+	if !ok {
+		o.admission = false
+	}
+
+	crc := crc32.NewIEEE()
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+	var flags byte
+	if o.admission {
+		flags |= snapshotAdmission
+	}
+
+	now := c.clock.Now()
+	bw.Write(snapshotMagic)
+	bw.WriteByte(snapshotVersion)
+	bw.WriteByte(flags)
+	// the save time lets LoadFrom account for the time the snapshot was stored
+	bw.Write(binary.AppendVarint(nil, now.UnixNano()))
+
+	var err error
+	c.rangeItems(func(item storeItem[V]) bool {
+		if item.origKey == nil {
+			return true
+		}
+
+		var ttl time.Duration
+		if !item.expiration.IsZero() {
+			if ttl = item.expiration.Sub(now); ttl <= 0 {
+				// expired
+				return true
+			}
+		}
+
+		cost := c.cachePolicy.Cost(item.key)
+		if cost < 0 {
+			// not admitted by the policy (yet)
+			return true
+		}
+
+		if !c.ignoreInternalCost {
+			cost -= itemSize
+		}
+
+		err = writeSnapshotEntry(bw, codec, item.origKey.(K), item.value, cost, ttl)
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+
+	bw.WriteByte(snapshotEnd)
+	if o.admission {
+		if err := admission.saveAdmission(bw); err != nil {
+			return err
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	_, err = w.Write(binary.BigEndian.AppendUint32(nil, crc.Sum32()))
+	return err
+}
+
+// LoadFrom reads a snapshot written by SaveTo and inserts its items
+// through the normal admission path, preserving their costs and remaining TTLs.
+// Items that expired while the snapshot was stored are skipped.
+// The whole snapshot is read and its checksum verified before anything is inserted,
+// so a corrupted snapshot returns ErrBadSnapshot and leaves the cache untouched.
+//
+// If the snapshot contains the admission state and the policy is compatible with it
+// (uses TinyLFU with the same NumCounters), the admission state is restored as well.
+func (c *Cache[K, V]) LoadFrom(r io.Reader, codec Codec[K, V]) error {
+	if c == nil || c.isClosed.Load() {
+		return errClosed
+	}
+
+	sr := &snapshotReader{r: bufio.NewReader(r), crc: crc32.NewIEEE()}
+	header := make([]byte, len(snapshotMagic)+2)
+	if _, err := io.ReadFull(sr, header); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadSnapshot, err)
+	}
+
+	if !bytes.Equal(header[:len(snapshotMagic)], snapshotMagic) {
+		return fmt.Errorf("%w: bad magic", ErrBadSnapshot)
+	}
+
+	if version := header[len(snapshotMagic)]; version != snapshotVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrBadSnapshot, version)
+	}
+
+	savedAt, err := binary.ReadVarint(sr)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadSnapshot, err)
+	}
+	elapsed := c.clock.Now().Sub(time.Unix(0, savedAt))
+
+	var entries []snapshotEntryData[K, V]
+	for {
+		tag, err := sr.ReadByte()
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrBadSnapshot, err)
+		}
+
+		if tag == snapshotEnd {
+			break
+		}
+
+		if tag != snapshotEntry {
+			return fmt.Errorf("%w: bad record tag %d", ErrBadSnapshot, tag)
+		}
+
+		entry, err := readSnapshotEntry(sr, codec)
+		if err != nil {
+			return err
+		}
+
+		if entry.ttl != 0 {
+			if entry.ttl -= elapsed; entry.ttl <= 0 {
+				// expired while the snapshot was stored
+				continue
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	var admission *tinyLFU
+	if header[len(snapshotMagic)+1]&snapshotAdmission != 0 {
+		if admission, err = readTinyLFU(sr); err != nil {
+			return fmt.Errorf("%w: %v", ErrBadSnapshot, err)
+		}
+	}
+
+	sum := make([]byte, 4)
+	if _, err := io.ReadFull(sr.r, sum); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadSnapshot, err)
+	}
+
+	if binary.BigEndian.Uint32(sum) != sr.crc.Sum32() {
+		return fmt.Errorf("%w: checksum mismatch", ErrBadSnapshot)
+	}
+
+	if p, ok := c.cachePolicy.(admissionSaver); ok && admission != nil {
+		p.loadAdmission(admission)
+	}
+
+	for _, e := range entries {
+		if !c.set(e.key, e.value, setOptions{cost: e.cost, ttl: e.ttl, loaded: true}, nil) && !c.synchronous {
+			// the set buffer is full, let it drain and retry once.
+			// Synchronous sets are never dropped, only rejected by the policy
+			c.Wait()
+			c.set(e.key, e.value, setOptions{cost: e.cost, ttl: e.ttl, loaded: true}, nil)
+		}
+	}
+
+	c.Wait()
+	return nil
+}
+
+func writeSnapshotEntry[K Key, V any](w *bufio.Writer, codec Codec[K, V], key K, value V, cost int64, ttl time.Duration) error {
+	k, err := codec.EncodeKey(key)
+	if err != nil {
+		return fmt.Errorf("encoding key: %w", err)
+	}
+
+	v, err := codec.EncodeValue(value)
+	if err != nil {
+		return fmt.Errorf("encoding value: %w", err)
+	}
+
+	buf := make([]byte, 0, 1+4*binary.MaxVarintLen64)
+	buf = append(buf, snapshotEntry)
+	buf = binary.AppendUvarint(buf, uint64(len(k)))
+	w.Write(buf)
+	w.Write(k)
+	buf = binary.AppendUvarint(buf[:0], uint64(len(v)))
+	w.Write(buf)
+	w.Write(v)
+	buf = binary.AppendVarint(buf[:0], cost)
+	buf = binary.AppendVarint(buf, int64(ttl))
+	_, err = w.Write(buf)
+	return err
+}
+
+func readSnapshotEntry[K Key, V any](r *snapshotReader, codec Codec[K, V]) (e snapshotEntryData[K, V], err error) {
+	k, err := readSnapshotBytes(r)
+	if err != nil {
+		return e, fmt.Errorf("%w: %v", ErrBadSnapshot, err)
+	}
+
+	v, err := readSnapshotBytes(r)
+	if err != nil {
+		return e, fmt.Errorf("%w: %v", ErrBadSnapshot, err)
+	}
+
+	if e.cost, err = binary.ReadVarint(r); err != nil {
+		return e, fmt.Errorf("%w: %v", ErrBadSnapshot, err)
+	}
+
+	ttl, err := binary.ReadVarint(r)
+	if err != nil {
+		return e, fmt.Errorf("%w: %v", ErrBadSnapshot, err)
+	}
+	e.ttl = time.Duration(ttl)
+
+	if e.key, err = codec.DecodeKey(k); err != nil {
+		return e, fmt.Errorf("decoding key: %w", err)
+	}
+
+	if e.value, err = codec.DecodeValue(v); err != nil {
+		return e, fmt.Errorf("decoding value: %w", err)
+	}
+
+	return e, nil
+}
+
+// readSnapshotBytes reads a length-prefixed byte slice.
+func readSnapshotBytes(r *snapshotReader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	return readN(r, n)
+}
+
+// readN reads exactly n bytes from r.
+// The slice grows as the data arrives, so a corrupted length
+// fails with an EOF instead of a huge allocation.
+func readN(r io.Reader, n uint64) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(n)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// snapshotReader reads from r while computing the checksum of everything read.
+type snapshotReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+}
+
+func (s *snapshotReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.crc.Write(p[:n])
+	return n, err
+}
+
+func (s *snapshotReader) ReadByte() (byte, error) {
+	b, err := s.r.ReadByte()
+	if err == nil {
+		s.crc.Write([]byte{b})
+	}
+	return b, err
+}
+
+// writeTo writes the TinyLFU counters, seeds and doorkeeper to w.
+func (p *tinyLFU) writeTo(w io.Writer) error {
+	header := []int64{p.resetAt, p.incrs, int64(p.freq.mask)}
+	if err := binary.Write(w, binary.BigEndian, header); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.BigEndian, p.freq.seed); err != nil {
+		return err
+	}
+
+	for _, row := range p.freq.rows {
+		if _, err := w.Write(row); err != nil {
+			return err
+		}
+	}
+
+	door := p.door.JSONMarshal()
+	if err := binary.Write(w, binary.BigEndian, uint64(len(door))); err != nil {
+		return err
+	}
+
+	_, err := w.Write(door)
+	return err
+}
+
+// readTinyLFU reads a TinyLFU written by writeTo.
+func readTinyLFU(r io.Reader) (*tinyLFU, error) {
+	header := make([]int64, 3)
+	if err := binary.Read(r, binary.BigEndian, header); err != nil {
+		return nil, err
+	}
+
+	mask := uint64(header[2])
+	if mask == 0 || (mask+1)&mask != 0 || mask >= 1<<62 {
+		return nil, errors.New("bad sketch size")
+	}
+
+	p := &tinyLFU{
+		resetAt: header[0],
+		incrs:   header[1],
+		freq:    &cmSketch{mask: mask},
+	}
+	if err := binary.Read(r, binary.BigEndian, &p.freq.seed); err != nil {
+		return nil, err
+	}
+
+	for i := range p.freq.rows {
+		row, err := readN(r, (mask+1)/2)
+		if err != nil {
+			return nil, err
+		}
+		p.freq.rows[i] = row
+	}
+
+	var n uint64
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+
+	door, err := readN(r, n)
+	if err != nil {
+		return nil, err
+	}
+
+	bloom, err := helpers.JSONUnmarshal(door)
+	if err != nil {
+		return nil, err
+	}
+
+	p.door = bloom
+	return p, nil
+}
+
+// compatible reports whether other has the same dimensions as p,
+// so it can replace p without changing the memory usage and accuracy.
+func (p *tinyLFU) compatible(other *tinyLFU) bool {
+	return p.freq.mask == other.freq.mask &&
+		p.resetAt == other.resetAt &&
+		p.door.TotalSize() == other.door.TotalSize()
+}
+
+func (p *defaultPolicy[V]) saveAdmission(w io.Writer) error {
+	p.Lock()
+	defer p.Unlock()
+	return p.admit.writeTo(w)
+}
+
+func (p *defaultPolicy[V]) loadAdmission(t *tinyLFU) bool {
+	p.Lock()
+	defer p.Unlock()
+	if !p.admit.compatible(t) {
+		return false
+	}
+
+	p.admit = t
+	return true
+}
+
+func (p *wTinyLFUPolicy[V]) saveAdmission(w io.Writer) error {
+	p.Lock()
+	defer p.Unlock()
+	return p.admit.writeTo(w)
+}
+
+func (p *wTinyLFUPolicy[V]) loadAdmission(t *tinyLFU) bool {
+	p.Lock()
+	defer p.Unlock()
+	if !p.admit.compatible(t) {
+		return false
+	}
+
+	p.admit = t
+	return true
+}
+
+func gobEncode(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gobDecode[T any](data []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+	return v, err
+}
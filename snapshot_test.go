@@ -0,0 +1,220 @@
+package fulmo
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot(t *testing.T) {
+	c, err := NewCache(&Config[string, int]{
+		NumCounters: 100,
+		MaxCost:     1 << 20,
+		BufferItems: 64,
+		StoreKeys:   true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.Set("a", 1, 1))
+	require.True(t, c.Set("b", 2, 5))
+	require.True(t, c.SetWithTTL("c", 3, 1, time.Hour))
+	require.True(t, c.SetWithTTL("d", 4, 1, wait))
+	c.Wait()
+	time.Sleep(2 * wait)
+
+	var buf bytes.Buffer
+	require.NoError(t, c.SaveTo(&buf, GobCodec[string, int]{}))
+
+	r, err := NewCache(&Config[string, int]{
+		NumCounters: 100,
+		MaxCost:     1 << 20,
+		BufferItems: 64,
+		StoreKeys:   true,
+	})
+	require.NoError(t, err)
+	defer r.Close()
+	require.NoError(t, r.LoadFrom(&buf, GobCodec[string, int]{}))
+
+	for k, v := range map[string]int{"a": 1, "b": 2, "c": 3} {
+		val, ok := r.Get(k)
+		require.True(t, ok)
+		require.Equal(t, v, val)
+	}
+
+	// expired items aren't saved
+	_, ok := r.Get("d")
+	require.False(t, ok)
+
+	ttl, ok := r.GetTTL("c")
+	require.True(t, ok)
+	require.InDelta(t, time.Hour, ttl, float64(time.Second))
+
+	// costs are preserved
+	require.Equal(t, r.MaxCost()-7-3*itemSize, r.RemainingCost())
+}
+
+func TestSnapshotAdmission(t *testing.T) {
+	c, err := NewCache(&Config[string, int]{
+		NumCounters: 100,
+		MaxCost:     1 << 20,
+		BufferItems: 64,
+		StoreKeys:   true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.Set("a", 1, 1))
+	c.Wait()
+	policy := c.cachePolicy.(*defaultPolicy[int])
+	policy.Lock()
+	policy.admit.Push([]uint64{1, 2, 2, 3, 3, 3})
+	policy.Unlock()
+
+	var buf bytes.Buffer
+	require.NoError(t, c.SaveTo(&buf, GobCodec[string, int]{}, WithAdmissionState()))
+
+	r, err := NewCache(&Config[string, int]{
+		NumCounters: 100,
+		MaxCost:     1 << 20,
+		BufferItems: 64,
+		StoreKeys:   true,
+	})
+	require.NoError(t, err)
+	defer r.Close()
+	require.NoError(t, r.LoadFrom(&buf, GobCodec[string, int]{}))
+
+	restored := r.cachePolicy.(*defaultPolicy[int])
+	restored.Lock()
+	defer restored.Unlock()
+	require.Equal(t, int64(1), restored.admit.Estimate(1))
+	require.Equal(t, int64(2), restored.admit.Estimate(2))
+	require.Equal(t, int64(3), restored.admit.Estimate(3))
+}
+
+func TestSnapshotAdmissionIncompatible(t *testing.T) {
+	c, err := NewCache(&Config[string, int]{
+		NumCounters: 100,
+		MaxCost:     1 << 20,
+		BufferItems: 64,
+		StoreKeys:   true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	policy := c.cachePolicy.(*defaultPolicy[int])
+	policy.Lock()
+	policy.admit.Push([]uint64{1, 1, 1})
+	policy.Unlock()
+
+	var buf bytes.Buffer
+	require.NoError(t, c.SaveTo(&buf, GobCodec[string, int]{}, WithAdmissionState()))
+
+	r, err := NewCache(&Config[string, int]{
+		NumCounters: 1000,
+		MaxCost:     1 << 20,
+		BufferItems: 64,
+		StoreKeys:   true,
+	})
+	require.NoError(t, err)
+	defer r.Close()
+	require.NoError(t, r.LoadFrom(&buf, GobCodec[string, int]{}))
+
+	restored := r.cachePolicy.(*defaultPolicy[int])
+	restored.Lock()
+	defer restored.Unlock()
+	require.Equal(t, int64(0), restored.admit.Estimate(1))
+}
+
+func TestSnapshotCorrupted(t *testing.T) {
+	c, err := NewCache(&Config[string, int]{
+		NumCounters: 100,
+		MaxCost:     1 << 20,
+		BufferItems: 64,
+		StoreKeys:   true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	require.True(t, c.Set("a", 1, 1))
+	c.Wait()
+
+	var buf bytes.Buffer
+	require.NoError(t, c.SaveTo(&buf, GobCodec[string, int]{}))
+	data := buf.Bytes()
+
+	r, err := NewCache(&Config[string, int]{
+		NumCounters: 100,
+		MaxCost:     1 << 20,
+		BufferItems: 64,
+		StoreKeys:   true,
+	})
+	require.NoError(t, err)
+	defer r.Close()
+
+	corrupted := bytes.Clone(data)
+	corrupted[len(corrupted)-6] ^= 0xff
+	require.ErrorIs(t, r.LoadFrom(bytes.NewReader(corrupted), GobCodec[string, int]{}), ErrBadSnapshot)
+
+	require.ErrorIs(t, r.LoadFrom(bytes.NewReader(data[:len(data)-1]), GobCodec[string, int]{}), ErrBadSnapshot)
+	require.ErrorIs(t, r.LoadFrom(bytes.NewReader([]byte("garbage")), GobCodec[string, int]{}), ErrBadSnapshot)
+
+	version := bytes.Clone(data)
+	version[len(snapshotMagic)] = snapshotVersion + 1
+	require.ErrorIs(t, r.LoadFrom(bytes.NewReader(version), GobCodec[string, int]{}), ErrBadSnapshot)
+
+	// nothing was loaded
+	_, ok := r.Get("a")
+	require.False(t, ok)
+}
+
+func TestSnapshotWithoutKeys(t *testing.T) {
+	c, err := NewCache(&Config[string, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.ErrorIs(t, c.SaveTo(&buf, GobCodec[string, int]{}), ErrKeysNotStored)
+
+	c.Close()
+	require.Error(t, c.SaveTo(&buf, GobCodec[string, int]{}))
+	require.Error(t, c.LoadFrom(&buf, GobCodec[string, int]{}))
+}
+
+func TestSnapshotSynchronousReject(t *testing.T) {
+	c, err := NewCache(&Config[string, int]{
+		NumCounters: 100,
+		MaxCost:     1 << 20,
+		BufferItems: 64,
+		StoreKeys:   true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	require.True(t, c.Set("a", 1, 100))
+	c.Wait()
+	var buf bytes.Buffer
+	require.NoError(t, c.SaveTo(&buf, GobCodec[string, int]{}))
+
+	// the item is too big for the cache it's restored into
+	rejected := 0
+	r, err := NewCache(&Config[string, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		StoreKeys:          true,
+		Synchronous:        true,
+		Metrics:            true,
+		OnReject: func(*Item[int]) {
+			rejected++
+		},
+	})
+	require.NoError(t, err)
+	defer r.Close()
+	require.NoError(t, r.LoadFrom(&buf, GobCodec[string, int]{}))
+	require.Equal(t, 1, rejected, "rejected items shouldn't be set again")
+	require.Equal(t, uint64(1), r.Metrics.Removals(RemovalRejected))
+}
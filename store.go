@@ -1,19 +1,85 @@
 package fulmo
 
 import (
+	"bytes"
+	"cmp"
+	"slices"
 	"sync"
 	"time"
+
+	"github.com/pchchv/fulmo/clock"
 )
 
 const numShards uint64 = 256
 
+// slideRefreshRatio throttles the refreshes of sliding expirations:
+// an access only takes the write lock once the expiration can move
+// by at least 1/slideRefreshRatio of the sliding TTL.
+const slideRefreshRatio = 64
+
 type updateFn[V any] func(cur, prev V) bool
 
+// storeLookup identifies a key for the batch operations of the store.
+type storeLookup struct {
+	key      uint64
+	conflict uint64
+	origKey  any
+}
+
 type storeItem[V any] struct {
 	key        uint64
 	value      V
 	conflict   uint64
 	expiration time.Time
+	// slide is the sliding TTL the expiration is refreshed with on access,
+	// zero for items with an absolute expiration.
+	slide time.Duration
+	// written is when the value was last set in unix nanoseconds, see Config.RefreshAfter.
+	// It isn't a time.Time to keep the per-item memory overhead down.
+	written int64
+	// origKey is the original key, only kept when Config.StoreKeys is set.
+	origKey any
+}
+
+// matches reports whether the item belongs to the key with the given
+// conflict hash and original key.
+// Zero conflict hashes and nil original keys match any item.
+func (si *storeItem[V]) matches(conflict uint64, origKey any) bool {
+	if conflict != 0 && conflict != si.conflict {
+		return false
+	}
+	return keysEqual(si.origKey, origKey)
+}
+
+// expired reports whether the TTL of the item has passed at now.
+func (si storeItem[V]) expired(now time.Time) bool {
+	return !si.expiration.IsZero() && now.After(si.expiration)
+}
+
+// item returns the stored item as an Item, without its cost.
+func (si storeItem[V]) item() *Item[V] {
+	return &Item[V]{
+		Key:         si.key,
+		Conflict:    si.conflict,
+		Value:       si.value,
+		Expiration:  si.expiration,
+		OriginalKey: si.origKey,
+	}
+}
+
+// keysEqual compares two original keys.
+// Keys that aren't stored (nil) are equal to any key.
+func keysEqual(a, b any) bool {
+	if a == nil || b == nil {
+		return true
+	}
+
+	if ab, ok := a.([]byte); ok {
+		bb, ok := b.([]byte)
+		return ok && bytes.Equal(ab, bb)
+	}
+
+	return a == b
 }
 
 // store is the interface fulfilled by all hash map implementations in this file.
@@ -23,23 +89,54 @@ type storeItem[V any] struct {
 // Every store is safe for concurrent usage.
 type store[V any] interface {
 	// Get returns the value associated with the key parameter.
-	Get(uint64, uint64) (V, bool)
+	// The original key is only compared if it's not nil.
+	Get(key, conflict uint64, origKey any) (V, bool)
+	// Access works like Get, but also counts as an access of the item,
+	// pushing the expiration of items with a sliding TTL forward.
+	// It returns the whole item.
+	Access(key, conflict uint64, origKey any) (storeItem[V], bool)
 	// Expiration returns the expiration time for this key.
 	Expiration(uint64) time.Time
 	// Set adds the key-value pair to the Map or updates the value if it's
 	// already present. The key-value pair is passed as a pointer to an
 	// item object.
 	Set(*Item[V])
-	// Del deletes the key-value pair from the Map.
-	Del(uint64, uint64) (uint64, V)
+	// Del deletes the key-value pair from the Map and returns the deleted item.
+	// The original key is only compared if it's not nil.
+	Del(key, conflict uint64, origKey any) (storeItem[V], bool)
+	// DelExpired deletes the key-value pair from the Map only if its TTL
+	// has passed and returns the deleted item.
+	DelExpired(key, conflict uint64, origKey any) (storeItem[V], bool)
+	// HasExpired reports whether the key is present but its TTL has passed,
+	// taking only the read lock of its shard.
+	HasExpired(key, conflict uint64, origKey any) bool
 	// Update attempts to update the key with a new value and returns true if
 	// successful.
 	Update(*Item[V]) (V, bool)
 	// Cleanup removes items that have an expired TTL.
-	Cleanup(policy *defaultPolicy[V], onEvict func(item *Item[V]))
+	Cleanup(policy Policy[V], onEvict func(item *Item[V]))
 	// Clear clears all contents of the store.
 	Clear(onEvict func(item *Item[V]))
+	// Range calls f for every item in the store until f returns false.
+	// Items are copied shard by shard, so f is called without holding any lock
+	// and may modify the store.
+	Range(f func(item storeItem[V]) bool)
+	// Compute calls fn with the item of the key under the lock of its shard,
+	// then sets the returned value or deletes the key as fn asks.
+	// Missing and expired keys are passed to fn as not found and are left as they are.
+	// It returns the item fn was called with and whether it was found.
+	Compute(key, conflict uint64, origKey any, fn func(item storeItem[V], found bool) (V, Op)) (storeItem[V], bool)
+	// AccessMany works like Access for many keys, locking every shard once.
+	// The results are in the order of the lookups.
+	AccessMany(lookups []storeLookup) ([]storeItem[V], []bool)
+	// DelMany works like Del for many keys, locking every shard once.
+	// The results are in the order of the lookups.
+	DelMany(lookups []storeLookup) ([]storeItem[V], []bool)
 	SetShouldUpdateFn(f updateFn[V])
+	// SetClock sets the clock used to expire items.
+	SetClock(c clock.Clock)
+	// SetExpirationTick sets the resolution at which expired items are cleaned up.
+	SetExpirationTick(tick time.Duration)
 }
 
 // newStore returns the default store implementation.
@@ -50,14 +147,16 @@ func newStore[V any]() store[V] {
 type lockedMap[V any] struct {
 	sync.RWMutex
 	em           *expirationMap[V]
+	clock        clock.Clock
 	data         map[uint64]storeItem[V]
 	shouldUpdate updateFn[V]
 }
 
 func newLockedMap[V any](em *expirationMap[V]) *lockedMap[V] {
 	return &lockedMap[V]{
-		em:   em,
-		data: make(map[uint64]storeItem[V]),
+		em:    em,
+		clock: clock.System(),
+		data:  make(map[uint64]storeItem[V]),
 		shouldUpdate: func(cur, prev V) bool {
 			return true
 		},
@@ -78,7 +177,7 @@ func (m *lockedMap[V]) Set(i *Item[V]) {
 		// item existed already
 		// is needed to check the conflict key and reject the update if they do not match
 		// only after that the expiration map is updated
-		if i.Conflict != 0 && (i.Conflict != item.conflict) {
+		if !item.matches(i.Conflict, i.OriginalKey) {
 			return
 		}
 
@@ -86,7 +185,7 @@ func (m *lockedMap[V]) Set(i *Item[V]) {
 			return
 		}
 
-		m.em.update(i.Key, i.Conflict, item.expiration, i.Expiration)
+		m.em.update(i.Key, i.Conflict, i.Expiration)
 	} else {
 		// value is not in the map already
 		// there's no need to return anything
@@ -99,6 +198,9 @@ func (m *lockedMap[V]) Set(i *Item[V]) {
 		conflict:   i.Conflict,
 		value:      i.Value,
 		expiration: i.Expiration,
+		slide:      i.slide,
+		written:    m.clock.Now().UnixNano(),
+		origKey:    i.OriginalKey,
 	}
 }
 
@@ -117,6 +219,7 @@ func (m *lockedMap[V]) Clear(onEvict func(item *Item[V])) {
 			i.Key = si.key
 			i.Conflict = si.conflict
 			i.Value = si.value
+			i.OriginalKey = si.origKey
 			onEvict(i)
 		}
 	}
@@ -131,7 +234,7 @@ func (m *lockedMap[V]) Update(newItem *Item[V]) (V, bool) {
 		return zeroValue[V](), false
 	}
 
-	if newItem.Conflict != 0 && (newItem.Conflict != item.conflict) {
+	if !item.matches(newItem.Conflict, newItem.OriginalKey) {
 		return zeroValue[V](), false
 	}
 
@@ -139,59 +242,181 @@ func (m *lockedMap[V]) Update(newItem *Item[V]) (V, bool) {
 		return item.value, false
 	}
 
-	m.em.update(newItem.Key, newItem.Conflict, item.expiration, newItem.Expiration)
+	m.em.update(newItem.Key, newItem.Conflict, newItem.Expiration)
 	m.data[newItem.Key] = storeItem[V]{
 		key:        newItem.Key,
 		conflict:   newItem.Conflict,
 		value:      newItem.Value,
 		expiration: newItem.Expiration,
+		slide:      newItem.slide,
+		written:    m.clock.Now().UnixNano(),
+		origKey:    item.origKey,
 	}
 
 	return item.value, true
 }
 
-func (m *lockedMap[V]) Del(key, conflict uint64) (uint64, V) {
+func (m *lockedMap[V]) HasExpired(key, conflict uint64, origKey any) bool {
+	m.RLock()
+	defer m.RUnlock()
+	item, ok := m.data[key]
+	return ok && item.matches(conflict, origKey) && item.expired(m.clock.Now())
+}
+
+func (m *lockedMap[V]) DelExpired(key, conflict uint64, origKey any) (storeItem[V], bool) {
+	if !m.HasExpired(key, conflict, origKey) {
+		// most lookups of missing keys end here, without taking the write lock
+		return storeItem[V]{}, false
+	}
+
 	m.Lock()
 	defer m.Unlock()
 	item, ok := m.data[key]
-	if !ok {
-		return 0, zeroValue[V]()
+	if !ok || !item.matches(conflict, origKey) || !item.expired(m.clock.Now()) {
+		return storeItem[V]{}, false
+	}
+
+	m.em.del(key)
+	delete(m.data, key)
+	return item, true
+}
+
+func (m *lockedMap[V]) Del(key, conflict uint64, origKey any) (storeItem[V], bool) {
+	m.Lock()
+	defer m.Unlock()
+	return m.del(key, conflict, origKey)
+}
+
+// delMany deletes the lookups at the given indexes under a single lock.
+func (m *lockedMap[V]) delMany(lookups []storeLookup, idxs []int, items []storeItem[V], found []bool) {
+	m.Lock()
+	defer m.Unlock()
+	for _, i := range idxs {
+		items[i], found[i] = m.del(lookups[i].key, lookups[i].conflict, lookups[i].origKey)
 	}
+}
 
-	if conflict != 0 && (conflict != item.conflict) {
-		return 0, zeroValue[V]()
+// del deletes the key, the caller must hold the lock.
+func (m *lockedMap[V]) del(key, conflict uint64, origKey any) (storeItem[V], bool) {
+	item, ok := m.data[key]
+	if !ok || !item.matches(conflict, origKey) {
+		return storeItem[V]{}, false
 	}
 
 	if !item.expiration.IsZero() {
-		m.em.del(key, item.expiration)
+		m.em.del(key)
 	}
 
 	delete(m.data, key)
-	return item.conflict, item.value
+	return item, true
+}
+
+// snapshot returns a copy of all the items in the map.
+func (m *lockedMap[V]) snapshot() []storeItem[V] {
+	m.RLock()
+	defer m.RUnlock()
+	items := make([]storeItem[V], 0, len(m.data))
+	for _, item := range m.data {
+		items = append(items, item)
+	}
+	return items
 }
 
 func (m *lockedMap[V]) setShouldUpdateFn(f updateFn[V]) {
 	m.shouldUpdate = f
 }
 
-func (m *lockedMap[V]) get(key, conflict uint64) (V, bool) {
+func (m *lockedMap[V]) setClock(c clock.Clock) {
+	m.clock = c
+}
+
+func (m *lockedMap[V]) get(key, conflict uint64, origKey any) (V, bool) {
+	item, ok := m.lookup(key, conflict, origKey, false)
+	return item.value, ok
+}
+
+// lookup returns the item if it's present and not expired.
+// If access is true, the expiration of sliding items is pushed forward.
+func (m *lockedMap[V]) lookup(key, conflict uint64, origKey any, access bool) (storeItem[V], bool) {
 	m.RLock()
 	item, ok := m.data[key]
 	m.RUnlock()
-	if !ok {
-		return zeroValue[V](), false
+	if !ok || !item.matches(conflict, origKey) {
+		return storeItem[V]{}, false
 	}
 
-	if conflict != 0 && (conflict != item.conflict) {
-		return zeroValue[V](), false
+	// handle expired items
+	now := m.clock.Now()
+	if item.expired(now) {
+		return storeItem[V]{}, false
 	}
 
-	// handle expired items
-	if !item.expiration.IsZero() && time.Now().After(item.expiration) {
-		return zeroValue[V](), false
+	if access && item.slide > 0 && now.Add(item.slide).Sub(item.expiration) >= item.slide/slideRefreshRatio {
+		m.slide(key, conflict, now)
 	}
 
-	return item.value, true
+	return item, true
+}
+
+func (m *lockedMap[V]) Compute(key, conflict uint64, origKey any, fn func(item storeItem[V], found bool) (V, Op)) (storeItem[V], bool) {
+	m.Lock()
+	defer m.Unlock()
+	now := m.clock.Now()
+	item, ok := m.data[key]
+	if !ok || !item.matches(conflict, origKey) || item.expired(now) {
+		fn(storeItem[V]{}, false)
+		return storeItem[V]{}, false
+	}
+
+	value, op := fn(item, true)
+	switch op {
+	case OpSet:
+		// the expiration is kept, so the expiration map doesn't change
+		updated := item
+		updated.value, updated.written = value, now.UnixNano()
+		m.data[key] = updated
+	case OpDelete:
+		m.del(key, conflict, origKey)
+	}
+	return item, true
+}
+
+// lookupMany looks up the lookups at the given indexes under a single read lock.
+// Sliding items found are refreshed afterwards, like in lookup.
+func (m *lockedMap[V]) lookupMany(lookups []storeLookup, idxs []int, items []storeItem[V], found []bool) {
+	now := m.clock.Now()
+	m.RLock()
+	for _, i := range idxs {
+		item, ok := m.data[lookups[i].key]
+		if ok && item.matches(lookups[i].conflict, lookups[i].origKey) && !item.expired(now) {
+			items[i], found[i] = item, true
+		}
+	}
+	m.RUnlock()
+
+	for _, i := range idxs {
+		if item := items[i]; found[i] && item.slide > 0 && now.Add(item.slide).Sub(item.expiration) >= item.slide/slideRefreshRatio {
+			m.slide(item.key, item.conflict, now)
+		}
+	}
+}
+
+// slide pushes the expiration of a sliding item forward.
+// The expiration map isn't updated, the cleanup reschedules
+// the keys whose expiration moved when their old expiration is reached,
+// so a hot key costs a single reschedule per TTL.
+func (m *lockedMap[V]) slide(key, conflict uint64, now time.Time) {
+	m.Lock()
+	defer m.Unlock()
+	item, ok := m.data[key]
+	if !ok || !item.matches(conflict, nil) || item.slide <= 0 || item.expired(now) {
+		return
+	}
+
+	if expiration := now.Add(item.slide); expiration.After(item.expiration) {
+		item.expiration = expiration
+		m.data[key] = item
+	}
 }
 
 type shardedMap[V any] struct {
@@ -227,12 +452,35 @@ func (m *shardedMap[V]) SetShouldUpdateFn(f updateFn[V]) {
 	}
 }
 
-func (sm *shardedMap[V]) Get(key, conflict uint64) (V, bool) {
-	return sm.shards[key%numShards].get(key, conflict)
+func (sm *shardedMap[V]) SetClock(c clock.Clock) {
+	for i := range sm.shards {
+		sm.shards[i].setClock(c)
+	}
+	sm.expiryMap.setClock(c)
+}
+
+func (sm *shardedMap[V]) SetExpirationTick(tick time.Duration) {
+	sm.expiryMap.setTick(tick)
+}
+
+func (sm *shardedMap[V]) Get(key, conflict uint64, origKey any) (V, bool) {
+	return sm.shards[key%numShards].get(key, conflict, origKey)
+}
+
+func (sm *shardedMap[V]) Access(key, conflict uint64, origKey any) (storeItem[V], bool) {
+	return sm.shards[key%numShards].lookup(key, conflict, origKey, true)
+}
+
+func (sm *shardedMap[V]) DelExpired(key, conflict uint64, origKey any) (storeItem[V], bool) {
+	return sm.shards[key%numShards].DelExpired(key, conflict, origKey)
 }
 
-func (sm *shardedMap[V]) Del(key, conflict uint64) (uint64, V) {
-	return sm.shards[key%numShards].Del(key, conflict)
+func (sm *shardedMap[V]) HasExpired(key, conflict uint64, origKey any) bool {
+	return sm.shards[key%numShards].HasExpired(key, conflict, origKey)
+}
+
+func (sm *shardedMap[V]) Del(key, conflict uint64, origKey any) (storeItem[V], bool) {
+	return sm.shards[key%numShards].Del(key, conflict, origKey)
 }
 
 func (sm *shardedMap[V]) Clear(onEvict func(item *Item[V])) {
@@ -242,7 +490,59 @@ func (sm *shardedMap[V]) Clear(onEvict func(item *Item[V])) {
 	sm.expiryMap.clear()
 }
 
-func (sm *shardedMap[V]) Cleanup(policy *defaultPolicy[V], onEvict func(item *Item[V])) {
+func (sm *shardedMap[V]) Compute(key, conflict uint64, origKey any, fn func(item storeItem[V], found bool) (V, Op)) (storeItem[V], bool) {
+	return sm.shards[key%numShards].Compute(key, conflict, origKey, fn)
+}
+
+func (sm *shardedMap[V]) AccessMany(lookups []storeLookup) ([]storeItem[V], []bool) {
+	items, found := make([]storeItem[V], len(lookups)), make([]bool, len(lookups))
+	sm.byShard(lookups, func(shard *lockedMap[V], idxs []int) {
+		shard.lookupMany(lookups, idxs, items, found)
+	})
+	return items, found
+}
+
+func (sm *shardedMap[V]) DelMany(lookups []storeLookup) ([]storeItem[V], []bool) {
+	items, found := make([]storeItem[V], len(lookups)), make([]bool, len(lookups))
+	sm.byShard(lookups, func(shard *lockedMap[V], idxs []int) {
+		shard.delMany(lookups, idxs, items, found)
+	})
+	return items, found
+}
+
+// byShard calls f once for every shard holding some of the lookups,
+// with the indexes of those lookups.
+func (sm *shardedMap[V]) byShard(lookups []storeLookup, f func(shard *lockedMap[V], idxs []int)) {
+	idxs := make([]int, len(lookups))
+	for i := range idxs {
+		idxs[i] = i
+	}
+	slices.SortFunc(idxs, func(a, b int) int {
+		return cmp.Compare(lookups[a].key%numShards, lookups[b].key%numShards)
+	})
+
+	for start := 0; start < len(idxs); {
+		shard := lookups[idxs[start]].key % numShards
+		end := start + 1
+		for end < len(idxs) && lookups[idxs[end]].key%numShards == shard {
+			end++
+		}
+		f(sm.shards[shard], idxs[start:end])
+		start = end
+	}
+}
+
+func (sm *shardedMap[V]) Range(f func(item storeItem[V]) bool) {
+	for _, shard := range sm.shards {
+		for _, item := range shard.snapshot() {
+			if !f(item) {
+				return
+			}
+		}
+	}
+}
+
+func (sm *shardedMap[V]) Cleanup(policy Policy[V], onEvict func(item *Item[V])) {
 	sm.expiryMap.cleanup(sm, policy, onEvict)
 }
 
@@ -4,6 +4,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/pchchv/fulmo/clock/clocktest"
 	"github.com/pchchv/fulmo/helpers"
 	"github.com/stretchr/testify/require"
 )
@@ -21,11 +22,11 @@ func TestStoreUpdate(t *testing.T) {
 	_, ok := s.Update(&i)
 	require.True(t, ok)
 
-	val, ok := s.Get(key, conflict)
+	val, ok := s.Get(key, conflict, nil)
 	require.True(t, ok)
 	require.NotNil(t, val)
 
-	val, ok = s.Get(key, conflict)
+	val, ok = s.Get(key, conflict, nil)
 	require.True(t, ok)
 	require.Equal(t, 2, val)
 
@@ -33,7 +34,7 @@ func TestStoreUpdate(t *testing.T) {
 	_, ok = s.Update(&i)
 	require.True(t, ok)
 
-	val, ok = s.Get(key, conflict)
+	val, ok = s.Get(key, conflict, nil)
 	require.True(t, ok)
 	require.Equal(t, 3, val)
 
@@ -45,7 +46,7 @@ func TestStoreUpdate(t *testing.T) {
 	}
 	_, ok = s.Update(&i)
 	require.False(t, ok)
-	val, ok = s.Get(key, conflict)
+	val, ok = s.Get(key, conflict, nil)
 	require.False(t, ok)
 	require.Empty(t, val)
 }
@@ -82,7 +83,7 @@ func TestStoreCollision(t *testing.T) {
 		value:    1,
 	}
 	s.shards[1].Unlock()
-	val, ok := s.Get(1, 1)
+	val, ok := s.Get(1, 1, nil)
 	require.False(t, ok)
 	require.Empty(t, val)
 
@@ -92,22 +93,49 @@ func TestStoreCollision(t *testing.T) {
 		Value:    2,
 	}
 	s.Set(&i)
-	val, ok = s.Get(1, 0)
+	val, ok = s.Get(1, 0, nil)
 	require.True(t, ok)
 	require.NotEqual(t, 2, val)
 
 	_, ok = s.Update(&i)
 	require.False(t, ok)
-	val, ok = s.Get(1, 0)
+	val, ok = s.Get(1, 0, nil)
 	require.True(t, ok)
 	require.NotEqual(t, 2, val)
 
-	s.Del(1, 1)
-	val, ok = s.Get(1, 0)
+	s.Del(1, 1, nil)
+	val, ok = s.Get(1, 0, nil)
 	require.True(t, ok)
 	require.NotEmpty(t, val)
 }
 
+func TestStoreOriginalKey(t *testing.T) {
+	s := newStore[int]()
+	i := Item[int]{
+		Key:         1,
+		Value:       1,
+		OriginalKey: []byte("a"),
+	}
+	s.Set(&i)
+
+	val, ok := s.Get(1, 0, []byte("a"))
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	_, ok = s.Get(1, 0, []byte("b"))
+	require.False(t, ok)
+
+	// a colliding key neither updates nor deletes the stored item
+	_, ok = s.Update(&Item[int]{Key: 1, Value: 2, OriginalKey: []byte("b")})
+	require.False(t, ok)
+	_, ok = s.Del(1, 0, []byte("b"))
+	require.False(t, ok)
+
+	si, ok := s.Del(1, 0, []byte("a"))
+	require.True(t, ok)
+	require.Equal(t, 1, si.value)
+	require.Equal(t, []byte("a"), si.origKey)
+}
+
 func TestStoreExpiration(t *testing.T) {
 	s := newStore[int]()
 	key, conflict := helpers.KeyToHash(1)
@@ -119,16 +147,16 @@ func TestStoreExpiration(t *testing.T) {
 		Expiration: expiration,
 	}
 	s.Set(&i)
-	val, ok := s.Get(key, conflict)
+	val, ok := s.Get(key, conflict, nil)
 	require.True(t, ok)
 	require.Equal(t, 1, val)
 
 	ttl := s.Expiration(key)
 	require.Equal(t, expiration, ttl)
 
-	s.Del(key, conflict)
+	s.Del(key, conflict, nil)
 
-	_, ok = s.Get(key, conflict)
+	_, ok = s.Get(key, conflict, nil)
 	require.False(t, ok)
 	require.True(t, s.Expiration(key).IsZero())
 
@@ -152,7 +180,7 @@ func TestStoreClear(t *testing.T) {
 	s.Clear(nil)
 	for i := uint64(0); i < 1000; i++ {
 		key, conflict := helpers.KeyToHash(i)
-		val, ok := s.Get(key, conflict)
+		val, ok := s.Get(key, conflict, nil)
 		require.False(t, ok)
 		require.Empty(t, val)
 	}
@@ -167,13 +195,13 @@ func TestStoreSetGet(t *testing.T) {
 		Value:    2,
 	}
 	s.Set(&i)
-	val, ok := s.Get(key, conflict)
+	val, ok := s.Get(key, conflict, nil)
 	require.True(t, ok)
 	require.Equal(t, 2, val)
 
 	i.Value = 3
 	s.Set(&i)
-	val, ok = s.Get(key, conflict)
+	val, ok = s.Get(key, conflict, nil)
 	require.True(t, ok)
 	require.Equal(t, 3, val)
 
@@ -184,7 +212,7 @@ func TestStoreSetGet(t *testing.T) {
 		Value:    2,
 	}
 	s.Set(&i)
-	val, ok = s.Get(key, conflict)
+	val, ok = s.Get(key, conflict, nil)
 	require.True(t, ok)
 	require.Equal(t, 2, val)
 }
@@ -198,12 +226,103 @@ func TestStoreDel(t *testing.T) {
 		Value:    1,
 	}
 	s.Set(&i)
-	s.Del(key, conflict)
-	val, ok := s.Get(key, conflict)
+	s.Del(key, conflict, nil)
+	val, ok := s.Get(key, conflict, nil)
 	require.False(t, ok)
 	require.Empty(t, val)
 
-	s.Del(2, 0)
+	s.Del(2, 0, nil)
+}
+
+func TestStoreAccessDelMany(t *testing.T) {
+	s := newStore[int]()
+	lookups := make([]storeLookup, 100)
+	for n := range lookups {
+		key, conflict := helpers.KeyToHash(n)
+		lookups[n] = storeLookup{key: key, conflict: conflict}
+		if n%2 == 0 {
+			s.Set(&Item[int]{Key: key, Conflict: conflict, Value: n})
+		}
+	}
+	// a conflicting lookup isn't found
+	lookups = append(lookups, storeLookup{key: lookups[0].key, conflict: lookups[0].conflict + 1})
+
+	items, found := s.AccessMany(lookups)
+	require.Len(t, items, len(lookups))
+	for n := range 100 {
+		require.Equal(t, n%2 == 0, found[n], "key %d", n)
+		if found[n] {
+			require.Equal(t, n, items[n].value)
+		}
+	}
+	require.False(t, found[100])
+
+	items, found = s.DelMany(lookups[:10])
+	for n := range 10 {
+		require.Equal(t, n%2 == 0, found[n], "key %d", n)
+		if found[n] {
+			require.Equal(t, n, items[n].value)
+		}
+		_, ok := s.Get(lookups[n].key, lookups[n].conflict, nil)
+		require.False(t, ok)
+	}
+	_, ok := s.Get(lookups[10].key, lookups[10].conflict, nil)
+	require.True(t, ok)
+}
+
+func TestStoreDelExpired(t *testing.T) {
+	s := newStore[int]()
+	key, conflict := helpers.KeyToHash(1)
+	i := Item[int]{
+		Key:        key,
+		Conflict:   conflict,
+		Value:      1,
+		Expiration: time.Now().Add(time.Hour),
+	}
+	s.Set(&i)
+	_, ok := s.DelExpired(key, conflict, nil)
+	require.False(t, ok, "items that didn't expire are kept")
+
+	i.Expiration = time.Now().Add(-time.Second)
+	s.Update(&i)
+	_, ok = s.DelExpired(key, conflict+1, nil)
+	require.False(t, ok, "conflicting items are kept")
+
+	si, ok := s.DelExpired(key, conflict, nil)
+	require.True(t, ok)
+	require.Equal(t, 1, si.value)
+	require.True(t, s.Expiration(key).IsZero())
+
+	_, ok = s.DelExpired(2, 0, nil)
+	require.False(t, ok)
+}
+
+func TestStoreRange(t *testing.T) {
+	s := newStore[int]()
+	for i := 0; i < 100; i++ {
+		key, conflict := helpers.KeyToHash(i)
+		s.Set(&Item[int]{
+			Key:      key,
+			Conflict: conflict,
+			Value:    i,
+		})
+	}
+
+	seen := make(map[int]struct{})
+	s.Range(func(item storeItem[int]) bool {
+		seen[item.value] = struct{}{}
+		// modifying the store while ranging doesn't deadlock
+		s.Del(item.key, item.conflict, nil)
+		return true
+	})
+	require.Len(t, seen, 100)
+
+	count := 0
+	s.Range(func(item storeItem[int]) bool {
+		count++
+		return true
+	})
+	require.Zero(t, count)
 }
 
 func BenchmarkStoreGet(b *testing.B) {
@@ -218,7 +337,7 @@ func BenchmarkStoreGet(b *testing.B) {
 	b.SetBytes(1)
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
-			s.Get(key, conflict)
+			s.Get(key, conflict, nil)
 		}
 	})
 }
@@ -259,3 +378,18 @@ func BenchmarkStoreUpdate(b *testing.B) {
 		}
 	})
 }
+
+func TestStoreHasExpired(t *testing.T) {
+	clk := clocktest.NewFake(time.Unix(1000, 0))
+	s := newStore[int]()
+	s.SetClock(clk)
+	s.Set(&Item[int]{Key: 1, Conflict: 1, Value: 1, Expiration: clk.Now().Add(time.Second)})
+	s.Set(&Item[int]{Key: 2, Conflict: 2, Value: 2})
+	require.False(t, s.HasExpired(1, 1, nil))
+
+	clk.Advance(2 * time.Second)
+	require.True(t, s.HasExpired(1, 1, nil))
+	require.False(t, s.HasExpired(1, 2, nil), "the conflict hash should match")
+	require.False(t, s.HasExpired(2, 2, nil))
+	require.False(t, s.HasExpired(3, 3, nil))
+}
@@ -0,0 +1,153 @@
+package fulmo
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+)
+
+// tagIndex maps tags to the keys set with them, see WithTags.
+// Keys are added once they're stored and removed along with them,
+// so the index only holds keys present in the cache.
+type tagIndex struct {
+	sync.Mutex
+	// keys maps every tag to its keys and their conflict hashes.
+	keys map[string]map[uint64]uint64
+	// tags maps every tagged key to its tags.
+	tags map[uint64][]string
+}
+
+func newTagIndex() *tagIndex {
+	return &tagIndex{
+		keys: make(map[string]map[uint64]uint64),
+		tags: make(map[uint64][]string),
+	}
+}
+
+// set replaces the tags of the key.
+func (t *tagIndex) set(key, conflict uint64, tags []string) {
+	t.Lock()
+	defer t.Unlock()
+	t.remove(key)
+	if len(tags) == 0 {
+		return
+	}
+
+	t.tags[key] = tags
+	for _, tag := range tags {
+		keys, ok := t.keys[tag]
+		if !ok {
+			keys = make(map[uint64]uint64)
+			t.keys[tag] = keys
+		}
+		keys[key] = conflict
+	}
+}
+
+// del removes the key from the index.
+// It returns whether the key had any tags.
+func (t *tagIndex) del(key uint64) bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.remove(key)
+}
+
+// take removes the tag from the index and returns its keys.
+func (t *tagIndex) take(tag string) map[uint64]uint64 {
+	t.Lock()
+	defer t.Unlock()
+	keys := t.keys[tag]
+	// detach the keys of the tag first, as removing the keys updates them
+	delete(t.keys, tag)
+	for key := range keys {
+		t.remove(key)
+	}
+	return keys
+}
+
+func (t *tagIndex) clear() {
+	t.Lock()
+	defer t.Unlock()
+	clear(t.keys)
+	clear(t.tags)
+}
+
+// remove removes the key from the index and returns whether it was there.
+// The caller must hold the lock.
+func (t *tagIndex) remove(key uint64) bool {
+	tags, ok := t.tags[key]
+	if !ok {
+		return false
+	}
+
+	for _, tag := range tags {
+		delete(t.keys[tag], key)
+		if len(t.keys[tag]) == 0 {
+			delete(t.keys, tag)
+		}
+	}
+	delete(t.tags, key)
+	return true
+}
+
+// InvalidateTag deletes all the keys set with the tag, see WithTags.
+// It waits for the buffered sets to be applied first, so they're deleted too.
+// It returns the number of keys deleted.
+func (c *Cache[K, V]) InvalidateTag(tag string) int {
+	if c == nil || c.isClosed.Load() {
+		return 0
+	}
+
+	if !c.synchronous {
+		// index the buffered sets first
+		c.Wait()
+	}
+
+	keys := c.tags.take(tag)
+	if len(keys) == 0 {
+		return 0
+	}
+
+	lookups := make([]storeLookup, 0, len(keys))
+	for key, conflict := range keys {
+		lookups = append(lookups, storeLookup{key: key, conflict: conflict})
+	}
+	return c.delLookups(lookups)
+}
+
+// InvalidatePrefix deletes all the string or []byte keys starting with the prefix.
+// Like InvalidateTag, it waits for the buffered sets to be applied first.
+// It returns the number of keys deleted.
+//
+// As keys are only known by their hashes, it requires Config.StoreKeys,
+// otherwise no keys are deleted. It goes through every item of the cache,
+// so prefer InvalidateTag for frequent invalidations.
+func (c *Cache[K, V]) InvalidatePrefix(prefix string) int {
+	if c == nil || c.isClosed.Load() || !c.storeKeys {
+		return 0
+	}
+
+	if !c.synchronous {
+		// store the buffered sets first
+		c.Wait()
+	}
+
+	var lookups []storeLookup
+	c.rangeItems(func(item storeItem[V]) bool {
+		var match bool
+		switch key := item.origKey.(type) {
+		case string:
+			match = strings.HasPrefix(key, prefix)
+		case []byte:
+			match = bytes.HasPrefix(key, []byte(prefix))
+		}
+		if match {
+			lookups = append(lookups, storeLookup{key: item.key, conflict: item.conflict, origKey: item.origKey})
+		}
+		return true
+	})
+	if len(lookups) == 0 {
+		return 0
+	}
+	return c.delLookups(lookups)
+}
@@ -0,0 +1,125 @@
+package fulmo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pchchv/fulmo/clock/clocktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheInvalidateTag(t *testing.T) {
+	for _, synchronous := range []bool{false, true} {
+		var removed []RemovalCause
+		c, err := NewCache(&Config[int, int]{
+			NumCounters:        1000,
+			MaxCost:            1000,
+			BufferItems:        64,
+			IgnoreInternalCost: true,
+			Synchronous:        synchronous,
+			OnRemove: func(item *Item[int], cause RemovalCause) {
+				removed = append(removed, cause)
+			},
+		})
+		require.NoError(t, err)
+
+		c.SetWithOptions(1, 1, WithCost(1), WithTags("user:1"))
+		c.SetWithOptions(2, 2, WithCost(1), WithTags("user:1", "user:2"))
+		c.SetWithOptions(3, 3, WithCost(1), WithTags("user:2"))
+		c.SetWithOptions(4, 4, WithCost(1))
+
+		require.Equal(t, 2, c.InvalidateTag("user:1"), "buffered sets should be invalidated")
+		c.Wait()
+		_, found := c.GetMany([]int{1, 2, 3, 4})
+		require.Equal(t, []bool{false, false, true, true}, found)
+		require.Equal(t, []RemovalCause{RemovalExplicit, RemovalExplicit}, removed)
+		require.Equal(t, int64(1000-2), c.RemainingCost())
+
+		// invalidated keys are dropped from their other tags too
+		require.Equal(t, 1, c.InvalidateTag("user:2"))
+		require.Zero(t, c.InvalidateTag("user:2"))
+		require.Zero(t, c.InvalidateTag("missing"))
+
+		// setting a key again replaces its tags
+		c.SetWithOptions(5, 5, WithCost(1), WithTags("a"))
+		c.Wait()
+		c.SetWithOptions(5, 6, WithCost(1), WithTags("b"))
+		c.Wait()
+		require.Zero(t, c.InvalidateTag("a"))
+		require.Equal(t, 1, c.InvalidateTag("b"))
+
+		c.Close()
+	}
+}
+
+func TestCacheTagsCleanup(t *testing.T) {
+	clk := clocktest.NewFake(time.Now())
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            2,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Synchronous:        true,
+		Clock:              clk,
+		// leave the expiration to Get rather than the periodic cleanup
+		TtlTickerDuration: time.Hour,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// expired keys leave the index
+	c.SetWithOptions(1, 1, WithCost(1), WithTTL(time.Second), WithTags("t"))
+	clk.Advance(2 * time.Second)
+	_, ok := c.Get(1)
+	require.False(t, ok)
+	require.Empty(t, c.tags.tags)
+
+	// evicted keys leave the index
+	c.SetWithOptions(2, 2, WithCost(2), WithTags("t"))
+	c.tags.Lock()
+	require.Len(t, c.tags.keys["t"], 1)
+	c.tags.Unlock()
+	for key := 3; len(c.tags.tags) > 0 && key < 1000; key++ {
+		for range 10 {
+			c.Get(key)
+		}
+		c.SetWithOptions(key, key, WithCost(2))
+	}
+	require.Empty(t, c.tags.tags)
+	require.Empty(t, c.tags.keys)
+
+	// cleared keys leave the index
+	c.SetWithOptions(1000, 1000, WithCost(1), WithTags("t"))
+	c.Clear()
+	require.Empty(t, c.tags.tags)
+}
+
+func TestCacheInvalidatePrefix(t *testing.T) {
+	c, err := NewCache(&Config[string, int]{
+		NumCounters: 1000,
+		MaxCost:     1 << 20,
+		BufferItems: 64,
+		StoreKeys:   true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	c.Set("user:1:profile", 1, 1)
+	c.Set("user:1:posts", 2, 1)
+	c.Set("user:10:profile", 3, 1)
+	c.Set("post:1", 4, 1)
+	require.Equal(t, 2, c.InvalidatePrefix("user:1:"))
+	c.Wait()
+	require.ElementsMatch(t, []string{"user:10:profile", "post:1"}, c.Keys())
+
+	bc, err := NewCache(&Config[[]byte, int]{
+		NumCounters: 1000,
+		MaxCost:     1 << 20,
+		BufferItems: 64,
+	})
+	require.NoError(t, err)
+	defer bc.Close()
+	bc.Set([]byte("user:1"), 1, 1)
+	bc.Wait()
+	require.Zero(t, bc.InvalidatePrefix("user:"), "keys aren't known without StoreKeys")
+}
@@ -0,0 +1,84 @@
+package fulmo
+
+import "time"
+
+// SecondaryTier stores the items evicted from the cache for lack of room,
+// so that later misses can find them there, see Config.SecondaryTier.
+// Items are moved between the cache and the tier: an item found in the tier
+// is deleted from it once the cache admits it back, and a set of a key deletes it too.
+//
+// Every SecondaryTier implementation must be safe for concurrent usage.
+// Failures aren't reported to the cache, an item the tier fails
+// to store or to read back is simply a miss.
+type SecondaryTier[K Key, V any] interface {
+	// Put stores the item with the TTL it had left, zero meaning it doesn't expire.
+	Put(key K, value V, cost int64, ttl time.Duration)
+	// Get returns the item with the TTL it has left, without removing it.
+	Get(key K) (value V, cost int64, ttl time.Duration, ok bool)
+	// Del removes the item from the tier, if it's there.
+	Del(key K)
+}
+
+// demote moves an item evicted for lack of room to the secondary tier.
+func (c *Cache[K, V]) demote(i *Item[V]) {
+	if c.tier == nil {
+		return
+	}
+
+	key, ok := i.OriginalKey.(K)
+	if !ok {
+		return
+	}
+
+	var ttl time.Duration
+	if !i.Expiration.IsZero() {
+		if ttl = i.Expiration.Sub(c.clock.Now()); ttl <= 0 {
+			return
+		}
+	}
+
+	cost := i.Cost
+	if !c.ignoreInternalCost {
+		// the internal cost is added again when the item is promoted
+		cost = max(cost-itemSize, 0)
+	}
+	c.tier.Put(key, i.Value, cost, ttl)
+}
+
+// promote moves the item of the key from the secondary tier back to the cache.
+// The item is only deleted from the tier once it's admitted,
+// so it stays there if the set is dropped or rejected.
+func (c *Cache[K, V]) promote(key K) (V, bool) {
+	if c.tier == nil {
+		return zeroValue[V](), false
+	}
+
+	value, cost, ttl, ok := c.tier.Get(key)
+	if !ok {
+		return zeroValue[V](), false
+	}
+
+	c.set(key, value, setOptions{cost: cost, ttl: ttl, loaded: true, promoted: true}, nil)
+	return value, true
+}
+
+// dropDemoted removes the copy of the key from the secondary tier,
+// which a set of the key outdates whether or not the policy admits it.
+func (c *Cache[K, V]) dropDemoted(key K) {
+	if c.tier != nil {
+		c.tier.Del(key)
+	}
+}
+
+// dropDemotedItem removes the copy of a newly admitted item from the secondary tier:
+// the copy a promoted item was read from, or the previous value of the key
+// if it was demoted while the item was buffered.
+func (c *Cache[K, V]) dropDemotedItem(i *Item[V]) {
+	if c.tier == nil || i.ns != nil {
+		return
+	}
+
+	if key, ok := i.OriginalKey.(K); ok {
+		c.tier.Del(key)
+	}
+}
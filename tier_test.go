@@ -0,0 +1,181 @@
+package fulmo
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testTierItem struct {
+	value int
+	cost  int64
+	ttl   time.Duration
+}
+
+// testTier is an in-memory SecondaryTier.
+type testTier struct {
+	sync.Mutex
+	items map[int]testTierItem
+}
+
+func newTestTier() *testTier {
+	return &testTier{items: make(map[int]testTierItem)}
+}
+
+func (t *testTier) Put(key int, value int, cost int64, ttl time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+	t.items[key] = testTierItem{value, cost, ttl}
+}
+
+func (t *testTier) Get(key int) (int, int64, time.Duration, bool) {
+	t.Lock()
+	defer t.Unlock()
+	item, ok := t.items[key]
+	return item.value, item.cost, item.ttl, ok
+}
+
+func (t *testTier) Del(key int) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.items, key)
+}
+
+func (t *testTier) has(key int) bool {
+	t.Lock()
+	defer t.Unlock()
+	_, ok := t.items[key]
+	return ok
+}
+
+func TestCacheSecondaryTier(t *testing.T) {
+	tier := newTestTier()
+	c, err := NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     2 * (10 + itemSize),
+		BufferItems: 64,
+		StoreKeys:   true,
+		Synchronous: true,
+		Metrics:     true,
+		Cost: func(value int) int64 {
+			return 10
+		},
+		SecondaryTier: tier,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithTTL(1, 1, 0, time.Hour))
+	require.True(t, c.Set(2, 2, 0))
+	require.True(t, c.Set(3, 3, 0))
+	require.Len(t, tier.items, 1, "the victim should be demoted")
+	for key, item := range tier.items {
+		require.Equal(t, int64(10), item.cost, "the internal cost shouldn't be demoted")
+		if key == 1 {
+			require.InDelta(t, time.Hour, item.ttl, float64(time.Minute))
+		}
+	}
+
+	for _, key := range []int{1, 2, 3} {
+		val, ok := c.Get(key)
+		require.True(t, ok)
+		require.Equal(t, key, val)
+	}
+	require.Len(t, tier.items, 1)
+
+	// deleting a key deletes it from both tiers
+	for _, key := range []int{1, 2, 3} {
+		c.Del(key)
+	}
+	require.Empty(t, tier.items)
+	for _, key := range []int{1, 2, 3} {
+		_, ok := c.Get(key)
+		require.False(t, ok)
+	}
+
+	// newly admitted keys drop their outdated copies
+	tier.Put(4, 40, 10, 0)
+	require.True(t, c.Set(4, 4, 0))
+	require.False(t, tier.has(4))
+	val, _ := c.Get(4)
+	require.Equal(t, 4, val)
+}
+
+func TestCacheSecondaryTierSkipped(t *testing.T) {
+	tier := newTestTier()
+	evicted := make(map[any]bool)
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            2,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		StoreKeys:          true,
+		Synchronous:        true,
+		SecondaryTier:      tier,
+		OnRemove: func(item *Item[int], cause RemovalCause) {
+			if cause == RemovalCapacity {
+				evicted[item.OriginalKey] = true
+			}
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// items of namespaces and items with tags aren't demoted
+	c.Namespace("ns").Set(1, 1, 1)
+	c.SetWithOptions(2, 2, WithCost(1), WithTags("tag"))
+	for key := 3; !evicted[1] || !evicted[2]; key++ {
+		require.Less(t, key, 1000, "the items should eventually be evicted")
+		c.Set(key, key, 1)
+	}
+	// only plain items are left, the next sets demote them
+	c.Set(1000, 1000, 1)
+	c.Set(1001, 1001, 1)
+	require.NotEmpty(t, tier.items)
+	require.False(t, tier.has(1))
+	require.False(t, tier.has(2))
+
+	_, err = NewCache(&Config[int, int]{
+		NumCounters:   100,
+		MaxCost:       10,
+		BufferItems:   64,
+		SecondaryTier: tier,
+	})
+	require.Error(t, err, "SecondaryTier should require StoreKeys")
+}
+
+func TestCacheSecondaryTierRejected(t *testing.T) {
+	for _, synchronous := range []bool{false, true} {
+		tier := newTestTier()
+		c, err := NewCache(&Config[int, int]{
+			NumCounters:        100,
+			MaxCost:            10,
+			BufferItems:        64,
+			IgnoreInternalCost: true,
+			StoreKeys:          true,
+			Synchronous:        synchronous,
+			SecondaryTier:      tier,
+		})
+		require.NoError(t, err)
+		defer c.Close()
+
+		// a promoted item the policy rejects goes back to the tier
+		tier.Put(1, 42, 20, 0)
+		val, ok := c.Get(1)
+		require.True(t, ok)
+		require.Equal(t, 42, val)
+		c.Wait()
+		require.True(t, tier.has(1), "synchronous: %v", synchronous)
+		val, _ = c.Get(1)
+		require.Equal(t, 42, val)
+
+		// a set outdates the copy in the tier even if it's rejected
+		c.Set(1, 43, 20)
+		c.Wait()
+		_, ok = c.Get(1)
+		require.False(t, ok, "synchronous: %v", synchronous)
+		require.False(t, tier.has(1))
+	}
+}
@@ -1,28 +1,60 @@
 package fulmo
 
 import (
+	"math/bits"
 	"sync"
 	"time"
+
+	"github.com/pchchv/fulmo/clock"
+)
+
+const (
+	// wheelBits is the number of tick bits covered by each level of the timing wheel.
+	wheelBits  = 6
+	wheelSlots = 1 << wheelBits
+	wheelMask  = wheelSlots - 1
+	// wheelLevels is the number of levels of the timing wheel.
+	// Expirations further than wheelSlots^wheelLevels ticks away are kept in an overflow bucket.
+	wheelLevels = 6
+	// wheelMaxSteps is the number of ticks cleanup advances one by one.
+	// Bigger gaps (e.g. after the system time changed) rebuild the wheel instead.
+	wheelMaxSteps = wheelSlots * wheelSlots
 )
 
-// TODO: find the optimal value or make it configurable.
-var bucketDurationSecs int64 = 5
+// defaultTtlTick is the TTL expiration resolution used when none is configured.
+var defaultTtlTick = time.Second
 
-// bucket type is a map of key to conflict.
-type bucket map[uint64]uint64
+// bucket type is a set of keys.
+type bucket map[uint64]struct{}
+
+// wheelEntry is the position of a key in the timing wheel.
+type wheelEntry struct {
+	conflict uint64
+	// tick is the tick at (or after) which the key expires.
+	tick  int64
+	level int
+	slot  int
+}
 
-// expirationMap is a map of bucket number to the corresponding bucket.
+// expirationMap is a hierarchical timing wheel of keys with a TTL.
+// Level 0 has a slot per tick, every next level has slots wheelSlots times wider.
+// Keys are moved down the levels as the wheel advances,
+// so expiring them takes constant time regardless of the TTL.
 type expirationMap[V any] struct {
 	sync.RWMutex
-	buckets              map[int64]bucket
-	lastCleanedBucketNum int64
+	clock clock.Clock
+	tick  time.Duration
+	// current is the last tick that was cleaned up.
+	current  int64
+	entries  map[uint64]*wheelEntry
+	wheel    [wheelLevels][wheelSlots]bucket
+	overflow bucket
 }
 
 func newExpirationMap[V any]() *expirationMap[V] {
-	return &expirationMap[V]{
-		buckets:              make(map[int64]bucket),
-		lastCleanedBucketNum: cleanupBucket(time.Now()),
-	}
+	m := &expirationMap[V]{clock: clock.System(), tick: defaultTtlTick}
+	m.reset()
+	return m
 }
 
 // clear clears the expirationMap,
@@ -30,12 +62,35 @@ func newExpirationMap[V any]() *expirationMap[V] {
 func (m *expirationMap[V]) clear() {
 	if m != nil {
 		m.Lock()
-		m.buckets = make(map[int64]bucket)
-		m.lastCleanedBucketNum = cleanupBucket(time.Now())
+		m.reset()
 		m.Unlock()
 	}
 }
 
+// setTick changes the resolution of the timing wheel,
+// rescheduling the keys that are already in it.
+func (m *expirationMap[V]) setTick(tick time.Duration) {
+	if m == nil || tick <= 0 {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	m.reschedule(func() { m.tick = tick })
+}
+
+// setClock changes the clock driving the timing wheel,
+// rescheduling the keys that are already in it.
+func (m *expirationMap[V]) setClock(c clock.Clock) {
+	if m == nil || c == nil {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	m.reschedule(func() { m.clock = c })
+}
+
 func (m *expirationMap[_]) add(key, conflict uint64, expiration time.Time) {
 	if m == nil {
 		return
@@ -46,121 +101,208 @@ func (m *expirationMap[_]) add(key, conflict uint64, expiration time.Time) {
 		return
 	}
 
-	bucketNum := storageBucket(expiration)
 	m.Lock()
 	defer m.Unlock()
+	m.remove(key)
+	m.schedule(key, conflict, expiration)
+}
 
-	if b, ok := m.buckets[bucketNum]; ok {
-		b[key] = conflict
-	} else {
-		b = make(bucket)
-		m.buckets[bucketNum] = b
+func (m *expirationMap[_]) update(key, conflict uint64, expiration time.Time) {
+	if m == nil {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	m.remove(key)
+	// items that don't expire don't need to be in the expiration map
+	if !expiration.IsZero() {
+		m.schedule(key, conflict, expiration)
 	}
 }
 
-func (m *expirationMap[_]) update(key, conflict uint64, oldExpTime, newExpTime time.Time) {
+func (m *expirationMap[_]) del(key uint64) {
 	if m == nil {
 		return
 	}
 
 	m.Lock()
 	defer m.Unlock()
+	m.remove(key)
+}
 
-	oldBucketNum := storageBucket(oldExpTime)
-	oldBucket, ok := m.buckets[oldBucketNum]
-	if ok {
-		delete(oldBucket, key)
+// cleanup advances the wheel up to the current time and removes all the items
+// whose TTL has passed. It deletes those items from the store and the policy,
+// and calls the onEvict function on those items.
+// It returns the number of expired items.
+// This function is meant to be called periodically.
+func (m *expirationMap[V]) cleanup(store store[V], policy Policy[V], onEvict func(item *Item[V])) int {
+	if m == nil {
+		return 0
 	}
 
-	// items that don't expire don't need to be in the expiration map
-	if newExpTime.IsZero() {
-		return
+	m.Lock()
+	now := m.clock.Now()
+	expired := m.advance(now.UnixNano() / int64(m.tick))
+	m.Unlock()
+
+	count := 0
+	for key, conflict := range expired {
+		expr := store.Expiration(key)
+		// sanity check
+		// verify that the store agrees that this key is expired
+		if expr.After(now) {
+			m.add(key, conflict, expr)
+			continue
+		}
+
+		cost := policy.Cost(key)
+		policy.Del(key)
+		si, ok := store.Del(key, conflict, nil)
+		if !ok {
+			continue
+		}
+
+		count++
+		if onEvict != nil {
+			onEvict(&Item[V]{Key: key,
+				Conflict:    conflict,
+				Value:       si.value,
+				Cost:        cost,
+				Expiration:  expr,
+				OriginalKey: si.origKey,
+			})
+		}
 	}
 
-	newBucketNum := storageBucket(newExpTime)
-	newBucket, ok := m.buckets[newBucketNum]
-	if !ok {
-		newBucket = make(bucket)
-		m.buckets[newBucketNum] = newBucket
+	return count
+}
+
+func (m *expirationMap[_]) reset() {
+	m.entries = make(map[uint64]*wheelEntry)
+	m.wheel = [wheelLevels][wheelSlots]bucket{}
+	m.overflow = nil
+	m.current = m.clock.Now().UnixNano() / int64(m.tick)
+}
+
+// reschedule calls change, which may alter the tick or the clock,
+// and schedules the keys of the wheel again.
+// The caller must hold the lock.
+func (m *expirationMap[_]) reschedule(change func()) {
+	entries := m.entries
+	expirations := make(map[uint64]time.Time, len(entries))
+	for key, e := range entries {
+		expirations[key] = time.Unix(0, e.tick*int64(m.tick))
+	}
+
+	change()
+	m.reset()
+	for key, expiration := range expirations {
+		m.schedule(key, entries[key].conflict, expiration)
 	}
+}
 
-	newBucket[key] = conflict
+// schedule adds the key to the wheel. Keys that are already due
+// are scheduled for the next tick, as the current one was already cleaned up.
+// The caller must hold the lock.
+func (m *expirationMap[_]) schedule(key, conflict uint64, expiration time.Time) {
+	// round up, so keys are never expired early
+	tick := (expiration.UnixNano() + int64(m.tick) - 1) / int64(m.tick)
+	m.place(key, &wheelEntry{conflict: conflict, tick: max(tick, m.current+1)})
 }
 
-func (m *expirationMap[_]) del(key uint64, expiration time.Time) {
-	if m == nil {
-		return
+// place puts the entry into the slot of the lowest level that covers
+// the distance between the current tick and the entry's tick.
+// The caller must hold the lock.
+func (m *expirationMap[_]) place(key uint64, e *wheelEntry) {
+	// the level is the highest tick digit in which the entry differs from the current tick,
+	// as it's the digit that has to change before the entry can move down a level
+	e.level = 0
+	if diff := uint64(e.tick ^ m.current); diff != 0 {
+		e.level = (bits.Len64(diff) - 1) / wheelBits
 	}
 
-	bucketNum := storageBucket(expiration)
-	m.Lock()
-	defer m.Unlock()
-	if _, ok := m.buckets[bucketNum]; !ok {
+	b := &m.overflow
+	if e.level < wheelLevels {
+		e.slot = int(e.tick>>(e.level*wheelBits)) & wheelMask
+		b = &m.wheel[e.level][e.slot]
+	}
+
+	if *b == nil {
+		*b = make(bucket)
+	}
+	(*b)[key] = struct{}{}
+	m.entries[key] = e
+}
+
+// remove removes the key from the wheel.
+// The caller must hold the lock.
+func (m *expirationMap[_]) remove(key uint64) {
+	e, ok := m.entries[key]
+	if !ok {
 		return
 	}
 
-	delete(m.buckets[bucketNum], key)
+	if e.level < wheelLevels {
+		delete(m.wheel[e.level][e.slot], key)
+	} else {
+		delete(m.overflow, key)
+	}
+	delete(m.entries, key)
 }
 
-// cleanup removes all the items in the bucket that was just completed.
-// It deletes those items from the store,
-// and calls the onEvict function on those items.
-// This function is meant to be called periodically.
-func (m *expirationMap[V]) cleanup(store store[V], policy *defaultPolicy[V], onEvict func(item *Item[V])) int {
-	if m == nil {
-		return 0
+// advance moves the wheel to the given tick and returns the expired keys.
+// The caller must hold the lock.
+func (m *expirationMap[_]) advance(now int64) map[uint64]uint64 {
+	expired := make(map[uint64]uint64)
+	if now <= m.current {
+		return expired
 	}
 
-	m.Lock()
-	now := time.Now()
-	currentBucketNum := cleanupBucket(now)
-	// Clean up all buckets up to and including currentBucketNum,
-	// starting from (but not including) the last one that was cleaned up
-	var buckets []bucket
-	for bucketNum := m.lastCleanedBucketNum + 1; bucketNum <= currentBucketNum; bucketNum++ {
-		// with an empty bucket, don't need to add it to the Clean list
-		if b := m.buckets[bucketNum]; b != nil {
-			buckets = append(buckets, b)
+	if now-m.current > wheelMaxSteps {
+		// too far behind to step through every tick, reschedule everything instead
+		entries := m.entries
+		m.entries = make(map[uint64]*wheelEntry)
+		m.wheel = [wheelLevels][wheelSlots]bucket{}
+		m.overflow = nil
+		m.current = now
+		for key, e := range entries {
+			if e.tick <= now {
+				expired[key] = e.conflict
+			} else {
+				m.place(key, e)
+			}
 		}
-		delete(m.buckets, bucketNum)
+		return expired
 	}
-	m.lastCleanedBucketNum = currentBucketNum
-	m.Unlock()
 
-	for _, keys := range buckets {
-		for key, conflict := range keys {
-			expr := store.Expiration(key)
-			// sanity check
-			// verify that the store agrees that this key is expired
-			if expr.After(now) {
+	for m.current < now {
+		m.current++
+		// move the keys of the higher levels whose slot was reached down the wheel
+		for level := wheelLevels; level > 0; level-- {
+			if m.current&(1<<(level*wheelBits)-1) != 0 {
 				continue
 			}
 
-			cost := policy.Cost(key)
-			policy.Del(key)
-			_, value := store.Del(key, conflict)
-			if onEvict != nil {
-				onEvict(&Item[V]{Key: key,
-					Conflict:   conflict,
-					Value:      value,
-					Cost:       cost,
-					Expiration: expr,
-				})
+			b := &m.overflow
+			if level < wheelLevels {
+				b = &m.wheel[level][int(m.current>>(level*wheelBits))&wheelMask]
 			}
-		}
-	}
 
-	cleanedBucketsCount := len(buckets)
-	return cleanedBucketsCount
-}
+			keys := *b
+			*b = nil
+			for key := range keys {
+				m.place(key, m.entries[key])
+			}
+		}
 
-func storageBucket(t time.Time) int64 {
-	return (t.Unix() / bucketDurationSecs) + 1
-}
+		slot := &m.wheel[0][int(m.current)&wheelMask]
+		for key := range *slot {
+			expired[key] = m.entries[key].conflict
+			delete(m.entries, key)
+		}
+		*slot = nil
+	}
 
-func cleanupBucket(t time.Time) int64 {
-	// the bucket to cleanup is always behind the
-	// storage bucket by one so that no elements in that bucket
-	// (which might not have expired yet) are deleted
-	return storageBucket(t) - 1
+	return expired
 }
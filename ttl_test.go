@@ -13,6 +13,7 @@ import (
 func TestExpirationMapCleanup(t *testing.T) {
 	// create a new expiration map
 	em := newExpirationMap[int]()
+	em.setTick(10 * time.Millisecond)
 	// create a new store
 	s := newShardedMap[int]()
 	// create a new policy
@@ -20,11 +21,11 @@ func TestExpirationMapCleanup(t *testing.T) {
 
 	// add items to the store and expiration map
 	now := time.Now()
-	i1 := &Item[int]{Key: 1, Conflict: 1, Value: 100, Expiration: now.Add(1 * time.Second)}
+	i1 := &Item[int]{Key: 1, Conflict: 1, Value: 100, Expiration: now.Add(100 * time.Millisecond)}
 	s.Set(i1)
 	em.add(i1.Key, i1.Conflict, i1.Expiration)
 
-	i2 := &Item[int]{Key: 2, Conflict: 2, Value: 200, Expiration: now.Add(3 * time.Second)}
+	i2 := &Item[int]{Key: 2, Conflict: 2, Value: 200, Expiration: now.Add(300 * time.Millisecond)}
 	s.Set(i2)
 	em.add(i2.Key, i2.Conflict, i2.Expiration)
 
@@ -34,44 +35,117 @@ func TestExpirationMapCleanup(t *testing.T) {
 		evictedItems[item.Key] = item.Value
 	}
 
-	// 2ait for the first item to expire
-	time.Sleep(2 * time.Second)
+	// wait for the first item to expire
+	time.Sleep(200 * time.Millisecond)
 
 	// cleanup the expiration map
-	cleanedBucketsCount := em.cleanup(s, p, evictedItemsOnEvictFunc)
-	require.Equal(t, 1, cleanedBucketsCount, "cleanedBucketsCount should be 1 after first cleanup")
+	expiredCount := em.cleanup(s, p, evictedItemsOnEvictFunc)
+	require.Equal(t, 1, expiredCount, "expiredCount should be 1 after first cleanup")
 
 	// check that the first item was evicted
 	require.Equal(t, 1, len(evictedItems), "evictedItems should have 1 item")
 	require.Equal(t, 100, evictedItems[1], "evictedItems should have the first item")
-	_, ok := s.Get(i1.Key, i1.Conflict)
+	_, ok := s.Get(i1.Key, i1.Conflict, nil)
 	require.False(t, ok, "i1 should have been evicted")
 
 	// check that the second item is still in the store
-	_, ok = s.Get(i2.Key, i2.Conflict)
+	_, ok = s.Get(i2.Key, i2.Conflict, nil)
 	require.True(t, ok, "i2 should still be in the store")
 
 	// wait for the second item to expire
-	time.Sleep(2 * time.Second)
+	time.Sleep(200 * time.Millisecond)
 
 	// cleanup the expiration map
-	cleanedBucketsCount = em.cleanup(s, p, evictedItemsOnEvictFunc)
-	require.Equal(t, 1, cleanedBucketsCount, "cleanedBucketsCount should be 1 after second cleanup")
+	expiredCount = em.cleanup(s, p, evictedItemsOnEvictFunc)
+	require.Equal(t, 1, expiredCount, "expiredCount should be 1 after second cleanup")
 
 	// check that the second item was evicted
 	require.Equal(t, 2, len(evictedItems), "evictedItems should have 2 items")
 	require.Equal(t, 200, evictedItems[2], "evictedItems should have the second item")
-	_, ok = s.Get(i2.Key, i2.Conflict)
+	_, ok = s.Get(i2.Key, i2.Conflict, nil)
 	require.False(t, ok, "i2 should have been evicted")
 
-	t.Run("Miscalculation of buckets does not cause memory leaks", func(t *testing.T) {
-		// break lastCleanedBucketNum, this can happen if the system time is changed.
-		em.lastCleanedBucketNum = storageBucket(now.AddDate(-1, 0, 0))
+	t.Run("Clock changes do not cause memory leaks", func(t *testing.T) {
+		i3 := &Item[int]{Key: 3, Conflict: 3, Value: 300, Expiration: time.Now().Add(50 * time.Millisecond)}
+		s.Set(i3)
+		em.add(i3.Key, i3.Conflict, i3.Expiration)
 
-		cleanedBucketsCount = em.cleanup(s, p, evictedItemsOnEvictFunc)
-		require.Equal(t,
-			0, cleanedBucketsCount,
-			"cleanedBucketsCount should be 0 after cleanup with lastCleanedBucketNum change",
-		)
+		// break current, this can happen if the system time is changed.
+		em.Lock()
+		em.current -= int64(365 * 24 * time.Hour / em.tick)
+		em.Unlock()
+
+		time.Sleep(100 * time.Millisecond)
+		expiredCount = em.cleanup(s, p, evictedItemsOnEvictFunc)
+		require.Equal(t, 1, expiredCount)
+		require.Empty(t, em.entries)
 	})
 }
+
+func TestExpirationMapCascade(t *testing.T) {
+	em := newExpirationMap[int]()
+	em.Lock()
+	defer em.Unlock()
+	em.current = 0
+
+	deadlines := map[uint64]int64{
+		1: 1,
+		2: wheelSlots - 1,
+		3: wheelSlots,
+		4: wheelSlots + 5,
+		5: wheelSlots*wheelSlots + 3,
+		6: 1 << (wheelBits * wheelLevels),
+	}
+	for key, tick := range deadlines {
+		em.place(key, &wheelEntry{conflict: key, tick: tick})
+	}
+	require.Equal(t, 0, em.entries[2].level)
+	require.Equal(t, 1, em.entries[3].level)
+	require.Equal(t, 2, em.entries[5].level)
+	require.Equal(t, wheelLevels, em.entries[6].level)
+
+	// every key expires exactly at its tick, after moving down the levels
+	for em.current < deadlines[5] {
+		now := em.current + 1
+		for key := range em.advance(now) {
+			require.Equal(t, deadlines[key], now, "key %d expired at the wrong tick", key)
+			delete(deadlines, key)
+		}
+	}
+	require.Len(t, deadlines, 1)
+
+	// a big jump reschedules the keys without stepping through every tick
+	expired := em.advance(1<<(wheelBits*wheelLevels) + 1)
+	require.Equal(t, map[uint64]uint64{6: 6}, expired)
+	require.Empty(t, em.entries)
+}
+
+func TestExpirationMapUpdate(t *testing.T) {
+	em := newExpirationMap[int]()
+	now := time.Now()
+
+	em.add(1, 1, now.Add(time.Minute))
+	em.update(1, 1, now.Add(time.Hour))
+	em.Lock()
+	require.Len(t, em.entries, 1)
+	require.Equal(t, (now.Add(time.Hour).UnixNano()+int64(em.tick)-1)/int64(em.tick), em.entries[1].tick)
+	em.Unlock()
+
+	// keys without a TTL are removed
+	em.update(1, 1, time.Time{})
+	require.Empty(t, em.entries)
+
+	em.add(2, 2, now.Add(-time.Minute))
+	em.Lock()
+	require.Equal(t, em.current+1, em.entries[2].tick, "due keys should expire on the next tick")
+	em.Unlock()
+	em.del(2)
+	require.Empty(t, em.entries)
+
+	em.add(3, 3, now.Add(time.Hour))
+	em.setTick(time.Millisecond)
+	require.Equal(t, time.Millisecond, em.tick)
+	require.Contains(t, em.entries, uint64(3))
+	em.clear()
+	require.Empty(t, em.entries)
+}
@@ -0,0 +1,256 @@
+package fulmo
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pchchv/fulmo/clock"
+)
+
+// defaultWriteBackoff is the wait before the first retry of a failed write.
+const defaultWriteBackoff = 100 * time.Millisecond
+
+// maxWriteBackoffShift caps the doubling of the wait between retries.
+const maxWriteBackoffShift = 10
+
+// Write is a set or a delete of a key passed to a Writer.
+type Write[K Key, V any] struct {
+	Key   K
+	Value V
+	// Deleted is true for deletes, their Value is the zero value.
+	Deleted bool
+}
+
+// Writer propagates the sets and deletes of the cache to a backing store,
+// see Config.Writer.
+//
+// Every Writer implementation must be safe for concurrent usage.
+type Writer[K Key, V any] interface {
+	// Write applies the writes to the backing store, in order.
+	// If it fails, the whole batch is retried, so Write should be idempotent.
+	Write(ctx context.Context, writes []Write[K, V]) error
+}
+
+// pendingWrite is a write-behind write waiting to be flushed.
+type pendingWrite[K Key, V any] struct {
+	Write[K, V]
+	// key is the key of the write, as returned by comparableKey.
+	key any
+	// attempts is the number of times the write failed.
+	attempts int
+}
+
+// writer passes the writes of the cache to the Writer,
+// either right away or buffered and coalesced by key.
+type writer[K Key, V any] struct {
+	w       Writer[K, V]
+	behind  time.Duration
+	retries int
+	backoff time.Duration
+	onError func(writes []Write[K, V], err error)
+	clock   Clock
+	// ticker triggers the flushes of processItems, it's nil for write-through.
+	ticker clock.Ticker
+	// flushMu serializes the flushes, so the writes of a key reach the Writer in order.
+	flushMu sync.Mutex
+	mu      sync.Mutex
+	pending []pendingWrite[K, V]
+	// index maps the keys to their write in pending.
+	index map[any]int
+	// failures is the number of flushes that failed in a row.
+	failures int
+	// retryAt is when pending writes can be flushed again after a failure.
+	retryAt time.Time
+}
+
+func newWriter[K Key, V any](config *Config[K, V], clk Clock) *writer[K, V] {
+	if config.Writer == nil {
+		return nil
+	}
+
+	wr := &writer[K, V]{
+		w:       config.Writer,
+		behind:  config.WriteBehind,
+		retries: config.WriteRetries,
+		backoff: config.WriteBackoff,
+		onError: config.OnWriteError,
+		clock:   clk,
+		index:   make(map[any]int),
+	}
+	if wr.backoff == 0 {
+		wr.backoff = defaultWriteBackoff
+	}
+	if wr.behind > 0 {
+		wr.ticker = clk.NewTicker(wr.behind)
+	}
+	return wr
+}
+
+// write passes the writes to the Writer right away for write-through,
+// retrying failures, or buffers them for write-behind.
+// It returns false if the writes failed for good.
+func (wr *writer[K, V]) write(writes []Write[K, V]) bool {
+	if wr.behind > 0 {
+		wr.enqueue(writes)
+		return true
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := wr.w.Write(context.Background(), writes)
+		if err == nil {
+			return true
+		}
+		if attempt >= wr.retries {
+			wr.failed(writes, err)
+			return false
+		}
+		wr.sleep(wr.delay(attempt))
+	}
+}
+
+// enqueue buffers the writes, replacing the pending writes of the same keys.
+func (wr *writer[K, V]) enqueue(writes []Write[K, V]) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	for _, w := range writes {
+		pw := pendingWrite[K, V]{Write: w, key: comparableKey(w.Key)}
+		if idx, ok := wr.index[pw.key]; ok {
+			wr.pending[idx] = pw
+			continue
+		}
+		wr.index[pw.key] = len(wr.pending)
+		wr.pending = append(wr.pending, pw)
+	}
+}
+
+// flush passes the pending writes to the Writer in one batch.
+// Unless force is set, nothing is flushed while failed writes wait for their retry.
+// If the Writer fails, the writes stay pending unless they ran out of retries,
+// or newer writes of their keys were buffered in the meantime.
+// It returns the error of the Writer.
+func (wr *writer[K, V]) flush(force bool) error {
+	wr.flushMu.Lock()
+	defer wr.flushMu.Unlock()
+
+	wr.mu.Lock()
+	if len(wr.pending) == 0 || (!force && wr.clock.Now().Before(wr.retryAt)) {
+		wr.mu.Unlock()
+		return nil
+	}
+	pending := wr.pending
+	wr.pending = nil
+	clear(wr.index)
+	wr.mu.Unlock()
+
+	writes := make([]Write[K, V], len(pending))
+	for idx, pw := range pending {
+		writes[idx] = pw.Write
+	}
+	err := wr.w.Write(context.Background(), writes)
+
+	wr.mu.Lock()
+	if err == nil {
+		wr.failures = 0
+		wr.mu.Unlock()
+		return nil
+	}
+
+	var givenUp []Write[K, V]
+	wr.retryAt = wr.clock.Now().Add(wr.delay(wr.failures))
+	wr.failures++
+	for _, pw := range pending {
+		pw.attempts++
+		if _, ok := wr.index[pw.key]; ok {
+			// a newer write of the key replaces the failed one
+			continue
+		}
+		if pw.attempts > wr.retries {
+			givenUp = append(givenUp, pw.Write)
+			continue
+		}
+		wr.index[pw.key] = len(wr.pending)
+		wr.pending = append(wr.pending, pw)
+	}
+	wr.mu.Unlock()
+
+	if len(givenUp) > 0 {
+		wr.failed(givenUp, err)
+	}
+	return err
+}
+
+// close flushes the pending writes once. The writes that fail aren't retried
+// but passed to OnWriteError, so closing doesn't wait for a backing store that's down.
+func (wr *writer[K, V]) close() {
+	if wr.ticker != nil {
+		wr.ticker.Stop()
+	}
+
+	err := wr.flush(true)
+	if err == nil {
+		return
+	}
+
+	wr.mu.Lock()
+	pending := wr.pending
+	wr.pending = nil
+	clear(wr.index)
+	wr.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	writes := make([]Write[K, V], len(pending))
+	for idx, pw := range pending {
+		writes[idx] = pw.Write
+	}
+	wr.failed(writes, err)
+}
+
+// ticks returns the channel of the flushes of processItems,
+// or nil if the writes aren't buffered.
+func (wr *writer[K, V]) ticks() <-chan time.Time {
+	if wr == nil || wr.ticker == nil {
+		return nil
+	}
+	return wr.ticker.C()
+}
+
+// delay returns the wait before the retry that follows the given number of failures.
+func (wr *writer[K, V]) delay(failures int) time.Duration {
+	return wr.backoff << min(failures, maxWriteBackoffShift)
+}
+
+// sleep waits for d on the clock of the cache.
+func (wr *writer[K, V]) sleep(d time.Duration) {
+	t := wr.clock.NewTicker(d)
+	defer t.Stop()
+	<-t.C()
+}
+
+// failed reports writes given up on.
+func (wr *writer[K, V]) failed(writes []Write[K, V], err error) {
+	if wr.onError != nil {
+		wr.onError(writes, err)
+	}
+}
+
+// write passes the writes to Config.Writer, if set.
+// It returns false if the writes failed for good.
+func (c *Cache[K, V]) write(writes ...Write[K, V]) bool {
+	if c.writer == nil || len(writes) == 0 {
+		return true
+	}
+	return c.writer.write(writes)
+}
+
+// Flush passes the writes buffered for Config.WriteBehind to the Writer right away,
+// even if failed writes are waiting for their retry. It returns the error of the Writer,
+// in which case the writes stay buffered to be retried, like the periodic flushes do.
+func (c *Cache[K, V]) Flush() error {
+	if c == nil || c.writer == nil || c.isClosed.Load() {
+		return nil
+	}
+	return c.writer.flush(true)
+}
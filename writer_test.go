@@ -0,0 +1,321 @@
+package fulmo
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pchchv/fulmo/clock/clocktest"
+	"github.com/stretchr/testify/require"
+)
+
+// testWriter records the batches it's passed and fails the first fails of them.
+type testWriter struct {
+	sync.Mutex
+	batches [][]Write[int, int]
+	fails   int
+}
+
+func (w *testWriter) Write(_ context.Context, writes []Write[int, int]) error {
+	w.Lock()
+	defer w.Unlock()
+	if w.fails > 0 {
+		w.fails--
+		return errors.New("backing store is down")
+	}
+	w.batches = append(w.batches, writes)
+	return nil
+}
+
+func (w *testWriter) written() [][]Write[int, int] {
+	w.Lock()
+	defer w.Unlock()
+	return w.batches
+}
+
+func (w *testWriter) fail(n int) {
+	w.Lock()
+	defer w.Unlock()
+	w.fails = n
+}
+
+func TestWriterWriteThrough(t *testing.T) {
+	w := &testWriter{}
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Writer:             w,
+		WriteBackoff:       time.Millisecond,
+		Synchronous:        true,
+		Loader: func(ctx context.Context, key int) (int, int64, time.Duration, error) {
+			return key, 1, 0, nil
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.Set(1, 10, 1))
+	c.Del(1)
+	c.SetMany([]Entry[int, int]{{Key: 2, Value: 20, Cost: 1}, {Key: 3, Value: 30, Cost: 1}})
+	c.DelMany([]int{2})
+	require.True(t, c.CompareAndSwap(3, 30, 31, 1))
+	require.False(t, c.CompareAndSwap(3, 30, 32, 1))
+	require.Equal(t, [][]Write[int, int]{
+		{{Key: 1, Value: 10}},
+		{{Key: 1, Deleted: true}},
+		{{Key: 2, Value: 20}, {Key: 3, Value: 30}},
+		{{Key: 2, Deleted: true}},
+		{{Key: 3, Value: 31}},
+	}, w.written())
+
+	// values read from elsewhere and keys of namespaces aren't written
+	_, err = c.GetOrLoad(context.Background(), 4)
+	require.NoError(t, err)
+	c.Namespace("ns").Set(5, 50, 1)
+	c.Namespace("ns").Del(5)
+	require.Len(t, w.written(), 5)
+}
+
+func TestWriterWriteThroughFailure(t *testing.T) {
+	w := &testWriter{}
+	var failed []Write[int, int]
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Writer:             w,
+		WriteBackoff:       time.Millisecond,
+		Synchronous:        true,
+		WriteRetries:       1,
+		OnWriteError: func(writes []Write[int, int], err error) {
+			require.Error(t, err)
+			failed = append(failed, writes...)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	w.fail(1)
+	require.True(t, c.Set(1, 10, 1), "the write should be retried")
+
+	w.fail(2)
+	require.False(t, c.Set(1, 11, 1))
+	require.Equal(t, []Write[int, int]{{Key: 1, Value: 11}}, failed)
+	val, _ := c.Get(1)
+	require.Equal(t, 10, val, "a value that wasn't written shouldn't be cached")
+
+	w.fail(2)
+	require.Equal(t, SetWriteFailed, c.SetWithResult(2, 20, 1, 0).Status)
+	require.Equal(t, "write failed", SetWriteFailed.String())
+
+	w.fail(2)
+	c.Del(1)
+	_, ok := c.Get(1)
+	require.False(t, ok, "deletes should remove the key even if the write failed")
+
+	require.True(t, c.Set(3, 30, 1))
+	w.fail(2)
+	_, ok = c.Compute(3, func(old int, found bool) (int, int64, Op) {
+		return old + 1, 1, OpSet
+	})
+	require.False(t, ok)
+	_, ok = c.Get(3)
+	require.False(t, ok, "a computed value that wasn't written shouldn't be cached")
+}
+
+func TestWriterWriteBehind(t *testing.T) {
+	w := &testWriter{}
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Writer:             w,
+		WriteBackoff:       time.Millisecond,
+		Synchronous:        true,
+		WriteBehind:        time.Hour,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	c.Set(1, 10, 1)
+	c.Set(1, 11, 1)
+	c.Set(2, 20, 1)
+	c.Del(2)
+	c.Set(3, 30, 1)
+	val, ok := c.Get(1)
+	require.True(t, ok, "write-behind shouldn't delay the cache")
+	require.Equal(t, 11, val)
+	require.Empty(t, w.written())
+
+	require.NoError(t, c.Flush())
+	require.Equal(t, [][]Write[int, int]{
+		{{Key: 1, Value: 11}, {Key: 2, Deleted: true}, {Key: 3, Value: 30}},
+	}, w.written(), "the writes should be coalesced by key")
+	require.NoError(t, c.Flush())
+	require.Len(t, w.written(), 1)
+
+	c.Set(4, 40, 1)
+	c.Close()
+	require.Equal(t, []Write[int, int]{{Key: 4, Value: 40}}, w.written()[1], "Close should flush the writes")
+}
+
+func TestWriterWriteBehindCollisions(t *testing.T) {
+	w := &testWriter{}
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Writer:             w,
+		WriteBackoff:       time.Millisecond,
+		Synchronous:        true,
+		WriteBehind:        time.Hour,
+		KeyToHash: func(key int) (uint64, uint64) {
+			// every key collides
+			return 1, 0
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	c.Set(1, 10, 1)
+	c.Set(11, 110, 1)
+	require.NoError(t, c.Flush())
+	require.Equal(t, [][]Write[int, int]{
+		{{Key: 1, Value: 10}, {Key: 11, Value: 110}},
+	}, w.written(), "writes of colliding keys shouldn't be coalesced")
+}
+
+func TestWriterWriteBehindRetry(t *testing.T) {
+	w := &testWriter{}
+	clk := clocktest.NewFake(time.Now())
+	var failed []Write[int, int]
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Writer:             w,
+		WriteBackoff:       time.Millisecond,
+		Synchronous:        true,
+		Clock:              clk,
+		WriteBehind:        time.Second,
+		WriteRetries:       2,
+		OnWriteError: func(writes []Write[int, int], err error) {
+			failed = append(failed, writes...)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	w.fail(3)
+	c.Set(1, 10, 1)
+	c.Set(2, 20, 1)
+	require.Error(t, c.Flush())
+	c.Set(1, 11, 1)
+	require.Error(t, c.Flush())
+	require.Error(t, c.Flush())
+	require.Equal(t, []Write[int, int]{{Key: 2, Value: 20}}, failed, "writes should run out of retries")
+	require.NoError(t, c.Flush())
+	require.Equal(t, [][]Write[int, int]{{{Key: 1, Value: 11}}}, w.written(),
+		"newer writes should replace the failed ones")
+
+	// the periodic flushes back off after failures
+	w.fail(1)
+	c.Set(3, 30, 1)
+	clk.Advance(time.Second)
+	require.Eventually(t, func() bool {
+		c.writer.mu.Lock()
+		defer c.writer.mu.Unlock()
+		return c.writer.failures == 1
+	}, time.Second, time.Millisecond)
+	require.Len(t, w.written(), 1)
+	clk.Advance(time.Second)
+	require.Eventually(t, func() bool {
+		return len(w.written()) == 2
+	}, time.Second, time.Millisecond)
+	require.Equal(t, []Write[int, int]{{Key: 3, Value: 30}}, w.written()[1])
+}
+
+func TestWriterWriteThroughBackoff(t *testing.T) {
+	w := &testWriter{}
+	clk := clocktest.NewFake(time.Now())
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Writer:             w,
+		WriteRetries:       1,
+		WriteBackoff:       time.Hour,
+		Synchronous:        true,
+		Clock:              clk,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// the retry waits on the clock of the cache
+	w.fail(1)
+	done := make(chan bool)
+	go func() {
+		done <- c.Set(1, 10, 1)
+	}()
+	var ok bool
+	require.Eventually(t, func() bool {
+		clk.Advance(time.Hour)
+		select {
+		case ok = <-done:
+			return true
+		default:
+			return false
+		}
+	}, time.Second, time.Millisecond)
+	require.True(t, ok)
+	require.Equal(t, [][]Write[int, int]{{{Key: 1, Value: 10}}}, w.written())
+}
+
+func TestWriterWriteBehindClose(t *testing.T) {
+	w := &testWriter{}
+	var failed []Write[int, int]
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Writer:             w,
+		WriteBehind:        time.Hour,
+		WriteRetries:       10,
+		WriteBackoff:       time.Hour,
+		Synchronous:        true,
+		OnWriteError: func(writes []Write[int, int], err error) {
+			failed = append(failed, writes...)
+		},
+	})
+	require.NoError(t, err)
+
+	// Close doesn't wait to retry the writes that fail
+	w.fail(100)
+	c.Set(1, 10, 1)
+	c.Close()
+	require.Equal(t, []Write[int, int]{{Key: 1, Value: 10}}, failed)
+	require.Empty(t, w.written())
+}
+
+func TestWriterConfig(t *testing.T) {
+	for _, config := range []Config[int, int]{
+		{WriteBehind: time.Second},
+		{Writer: &testWriter{}, WriteBehind: -1},
+		{Writer: &testWriter{}, WriteRetries: -1},
+		{Writer: &testWriter{}, WriteBackoff: -1},
+	} {
+		config.NumCounters, config.MaxCost, config.BufferItems = 100, 10, 64
+		_, err := NewCache(&config)
+		require.Error(t, err)
+	}
+}
@@ -0,0 +1,479 @@
+package fulmo
+
+import (
+	"container/list"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// wWindowRatio is the initial share of MaxCost given to the admission window.
+	wWindowRatio = 0.01
+	// wMaxWindowRatio is the largest share of MaxCost the window can grow to.
+	wMaxWindowRatio = 0.8
+	// wProtectedRatio is the share of the main space reserved for the protected segment.
+	wProtectedRatio = 0.8
+	// climbStepRatio is the initial hill climbing step as a share of MaxCost.
+	climbStepRatio = 0.0625
+	// climbStepDecay shrinks the step after every adaptation so the window size converges.
+	climbStepDecay = 0.98
+	// climbRestartThreshold is the hit rate change that restarts the climb with a full step.
+	climbRestartThreshold = 0.05
+)
+
+// wRegion is the segment of the W-TinyLFU policy an entry lives in.
+type wRegion byte
+
+const (
+	regionWindow wRegion = iota
+	regionProbation
+	regionProtected
+)
+
+type wEntry struct {
+	key    uint64
+	cost   int64
+	region wRegion
+}
+
+// wTinyLFUPolicy is a Policy implementing Window TinyLFU.
+// New items are admitted into a small LRU window. Items leaving the window
+// become candidates for the main space, a segmented LRU split into probation
+// and protected segments, and are only let in if TinyLFU estimates them to be
+// accessed more often than the main space's LRU victim.
+// The window size is adapted with hill climbing driven by the observed hit rate.
+type wTinyLFUPolicy[V any] struct {
+	sync.Mutex
+	// NOTE: maxCost is the first word to keep it 64-bit aligned for atomic usage.
+	maxCost   int64
+	isClosed  bool
+	metrics   *Metrics
+	admit     *tinyLFU
+	entries   map[uint64]*list.Element
+	window    *list.List
+	probation *list.List
+	protected *list.List
+	// costs of the entries in each segment.
+	windowCost    int64
+	probationCost int64
+	protectedCost int64
+	// windowMax is the current target cost of the window.
+	windowMax int64
+	climber   *hillClimber
+	stop      chan struct{}
+	done      chan struct{}
+	itemsCh   chan []uint64
+}
+
+// NewWTinyLFUPolicy returns a Window TinyLFU policy for use as Config.Policy.
+// It behaves better than the default policy on recency-heavy workloads,
+// as new keys are kept in the window long enough to build up frequency.
+// numCounters and maxCost have the same meaning as in Config.
+func NewWTinyLFUPolicy[V any](numCounters, maxCost int64) Policy[V] {
+	return newWTinyLFUPolicy[V](numCounters, maxCost)
+}
+
+func newWTinyLFUPolicy[V any](numCounters, maxCost int64) *wTinyLFUPolicy[V] {
+	p := &wTinyLFUPolicy[V]{
+		maxCost:   maxCost,
+		admit:     newTinyLFU(numCounters),
+		entries:   make(map[uint64]*list.Element),
+		window:    list.New(),
+		probation: list.New(),
+		protected: list.New(),
+		windowMax: int64(float64(maxCost) * wWindowRatio),
+		climber:   newHillClimber(numCounters),
+		itemsCh:   make(chan []uint64, 3),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	go p.processItems()
+	return p
+}
+
+func (p *wTinyLFUPolicy[V]) Close() {
+	if p.isClosed {
+		return
+	}
+
+	// block until the p.processItems goroutine returns
+	p.stop <- struct{}{}
+	<-p.done
+	close(p.stop)
+	close(p.done)
+	close(p.itemsCh)
+	p.isClosed = true
+}
+
+func (p *wTinyLFUPolicy[V]) Clear() {
+	p.Lock()
+	p.admit.clear()
+	p.entries = make(map[uint64]*list.Element)
+	p.window.Init()
+	p.probation.Init()
+	p.protected.Init()
+	p.windowCost, p.probationCost, p.protectedCost = 0, 0, 0
+	p.windowMax = int64(float64(p.MaxCost()) * wWindowRatio)
+	p.climber.reset()
+	p.Unlock()
+}
+
+func (p *wTinyLFUPolicy[V]) Update(key uint64, cost int64) {
+	p.Lock()
+	p.updateIfHas(key, cost)
+	p.Unlock()
+}
+
+func (p *wTinyLFUPolicy[V]) Cap() int64 {
+	p.Lock()
+	capacity := p.MaxCost() - p.used()
+	p.Unlock()
+	return capacity
+}
+
+func (p *wTinyLFUPolicy[V]) Has(key uint64) bool {
+	p.Lock()
+	_, exists := p.entries[key]
+	p.Unlock()
+	return exists
+}
+
+func (p *wTinyLFUPolicy[V]) Del(key uint64) {
+	p.Lock()
+	if e, ok := p.entries[key]; ok {
+		p.evict(e)
+	}
+	p.Unlock()
+}
+
+func (p *wTinyLFUPolicy[V]) Cost(key uint64) int64 {
+	p.Lock()
+	defer p.Unlock()
+	if e, ok := p.entries[key]; ok {
+		return e.Value.(*wEntry).cost
+	}
+	return -1
+}
+
+func (p *wTinyLFUPolicy[V]) MaxCost() int64 {
+	if p == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&p.maxCost)
+}
+
+func (p *wTinyLFUPolicy[V]) UpdateMaxCost(maxCost int64) {
+	if p == nil {
+		return
+	}
+
+	p.Lock()
+	// keep the window at the same share of the cache
+	if prev := p.MaxCost(); prev > 0 {
+		p.windowMax = int64(float64(p.windowMax) / float64(prev) * float64(maxCost))
+	}
+	atomic.StoreInt64(&p.maxCost, maxCost)
+	p.Unlock()
+}
+
+func (p *wTinyLFUPolicy[V]) CollectMetrics(metrics *Metrics) {
+	p.metrics = metrics
+}
+
+func (p *wTinyLFUPolicy[V]) Push(keys []uint64) bool {
+	if p.isClosed {
+		return false
+	}
+
+	if len(keys) == 0 {
+		return true
+	}
+
+	select {
+	case p.itemsCh <- keys:
+		p.metrics.add(keepGets, keys[0], uint64(len(keys)))
+		return true
+	default:
+		p.metrics.add(dropGets, keys[0], uint64(len(keys)))
+		return false
+	}
+}
+
+// Add admits the item into the window and moves the window's overflow
+// into the main space through the TinyLFU filter.
+// It returns the list of victims that have been evicted and
+// a boolean indicating whether the incoming item was accepted.
+// New items are always accepted, as the window keeps at least the most
+// recent item, so they get a chance to build up frequency before competing
+// for the main space.
+func (p *wTinyLFUPolicy[V]) Add(key uint64, cost int64) ([]*Item[V], bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	// cannot add an item bigger than entire cache
+	if cost > p.MaxCost() {
+		return nil, false
+	}
+
+	// an update does not count as an addition
+	if p.updateIfHas(key, cost) {
+		return nil, false
+	}
+
+	p.entries[key] = p.window.PushFront(&wEntry{key: key, cost: cost, region: regionWindow})
+	p.windowCost += cost
+	p.metrics.add(costAdd, key, uint64(cost))
+
+	// move the window's overflow into probation,
+	// the moved entries are candidates for the main space
+	var candidates []*list.Element
+	for p.windowCost > p.windowMax && p.window.Len() > 1 {
+		candidates = append(candidates, p.move(p.window.Back(), regionProbation))
+	}
+
+	var victims []*Item[V]
+	for p.used() > p.MaxCost() {
+		// skip candidates that were already evicted
+		for len(candidates) > 0 && p.entries[candidates[0].Value.(*wEntry).key] != candidates[0] {
+			candidates = candidates[1:]
+		}
+
+		victim := p.mainVictim()
+		var evicted *list.Element
+		switch {
+		case len(candidates) == 0 && victim == nil:
+			// the main space is empty, so the window itself is over capacity
+			evicted = p.window.Back()
+		case len(candidates) == 0:
+			evicted = victim
+		case victim == nil || victim == candidates[0]:
+			evicted, candidates = candidates[0], candidates[1:]
+		case p.admit.Estimate(candidates[0].Value.(*wEntry).key) > p.admit.Estimate(victim.Value.(*wEntry).key):
+			evicted = victim
+		default:
+			evicted, candidates = candidates[0], candidates[1:]
+		}
+
+		entry := evicted.Value.(*wEntry)
+		p.evict(evicted)
+		victims = append(victims, &Item[V]{
+			Key:      entry.key,
+			Conflict: 0,
+			Cost:     entry.cost,
+		})
+	}
+
+	return victims, true
+}
+
+func (p *wTinyLFUPolicy[V]) evictOverflow() []*Item[V] {
+	p.Lock()
+	defer p.Unlock()
+
+	var victims []*Item[V]
+	for p.used() > p.MaxCost() {
+		// evict from the main space first, the window holds the most recent items
+		e := p.mainVictim()
+		if e == nil {
+			e = p.window.Back()
+		}
+		if e == nil {
+			break
+		}
+
+		entry := e.Value.(*wEntry)
+		p.evict(e)
+		victims = append(victims, &Item[V]{
+			Key:      entry.key,
+			Conflict: 0,
+			Cost:     entry.cost,
+		})
+	}
+	return victims
+}
+
+func (p *wTinyLFUPolicy[V]) processItems() {
+	for {
+		select {
+		case items := <-p.itemsCh:
+			p.Lock()
+			for _, key := range items {
+				p.access(key)
+			}
+			p.Unlock()
+		case <-p.stop:
+			p.done <- struct{}{}
+			return
+		}
+	}
+}
+
+// access records a read of the key, promoting it within its segment
+// and feeding the hill climber with the outcome.
+func (p *wTinyLFUPolicy[V]) access(key uint64) {
+	p.admit.Increment(key)
+	e, hit := p.entries[key]
+	if delta, ok := p.climber.record(hit); ok {
+		p.resizeWindow(delta)
+	}
+
+	if !hit {
+		return
+	}
+
+	switch e.Value.(*wEntry).region {
+	case regionWindow:
+		p.window.MoveToFront(e)
+	case regionProtected:
+		p.protected.MoveToFront(e)
+	case regionProbation:
+		p.move(e, regionProtected)
+		// demote the protected segment's LRU entries once it outgrows its share
+		protectedMax := int64(float64(p.MaxCost()-p.windowMax) * wProtectedRatio)
+		for p.protectedCost > protectedMax && p.protected.Len() > 1 {
+			p.move(p.protected.Back(), regionProbation)
+		}
+	}
+}
+
+// resizeWindow grows or shrinks the window target by the given share of MaxCost.
+// Entries are moved between segments lazily on the next Add.
+func (p *wTinyLFUPolicy[V]) resizeWindow(delta float64) {
+	maxCost := float64(p.MaxCost())
+	windowMax := float64(p.windowMax) + delta*maxCost
+	p.windowMax = int64(math.Max(0, math.Min(windowMax, maxCost*wMaxWindowRatio)))
+}
+
+func (p *wTinyLFUPolicy[V]) used() int64 {
+	return p.windowCost + p.probationCost + p.protectedCost
+}
+
+// mainVictim returns the LRU entry of the main space,
+// preferring probation over protected.
+func (p *wTinyLFUPolicy[V]) mainVictim() *list.Element {
+	if e := p.probation.Back(); e != nil {
+		return e
+	}
+	return p.protected.Back()
+}
+
+func (p *wTinyLFUPolicy[V]) segment(region wRegion) (*list.List, *int64) {
+	switch region {
+	case regionWindow:
+		return p.window, &p.windowCost
+	case regionProbation:
+		return p.probation, &p.probationCost
+	default:
+		return p.protected, &p.protectedCost
+	}
+}
+
+// move puts the entry at the front of the target segment
+// and returns its new list element.
+func (p *wTinyLFUPolicy[V]) move(e *list.Element, region wRegion) *list.Element {
+	entry := e.Value.(*wEntry)
+	from, fromCost := p.segment(entry.region)
+	from.Remove(e)
+	*fromCost -= entry.cost
+
+	entry.region = region
+	to, toCost := p.segment(region)
+	moved := to.PushFront(entry)
+	p.entries[entry.key] = moved
+	*toCost += entry.cost
+	return moved
+}
+
+func (p *wTinyLFUPolicy[V]) evict(e *list.Element) {
+	entry := e.Value.(*wEntry)
+	l, cost := p.segment(entry.region)
+	l.Remove(e)
+	*cost -= entry.cost
+	delete(p.entries, entry.key)
+	p.metrics.add(costEvict, entry.key, uint64(entry.cost))
+	p.metrics.add(keyEvict, entry.key, 1)
+}
+
+func (p *wTinyLFUPolicy[V]) updateIfHas(key uint64, cost int64) bool {
+	e, ok := p.entries[key]
+	if !ok {
+		return false
+	}
+
+	// update the cost of an existing key,
+	// but don't worry about evicting
+	// evictions will be handled the next time a new item is added
+	entry := e.Value.(*wEntry)
+	p.metrics.add(keyUpdate, key, 1)
+	if entry.cost > cost {
+		diff := entry.cost - cost
+		p.metrics.add(costAdd, key, ^(uint64(diff) - 1))
+	} else if cost > entry.cost {
+		diff := cost - entry.cost
+		p.metrics.add(costAdd, key, uint64(diff))
+	}
+
+	_, segmentCost := p.segment(entry.region)
+	*segmentCost += cost - entry.cost
+	entry.cost = cost
+	return true
+}
+
+// hillClimber adapts the window size by watching the hit rate
+// over fixed size samples of accesses and stepping in the direction
+// that improved it the last time.
+// hillClimber is NOT thread-safe.
+type hillClimber struct {
+	hits        int64
+	misses      int64
+	sampleSize  int64
+	prevHitRate float64
+	step        float64
+}
+
+func newHillClimber(sampleSize int64) *hillClimber {
+	return &hillClimber{
+		sampleSize: sampleSize,
+		step:       climbStepRatio,
+	}
+}
+
+// record counts an access and, once a sample is complete,
+// returns the window size change as a share of MaxCost.
+func (c *hillClimber) record(hit bool) (float64, bool) {
+	if hit {
+		c.hits++
+	} else {
+		c.misses++
+	}
+
+	if c.hits+c.misses < c.sampleSize {
+		return 0, false
+	}
+
+	hitRate := float64(c.hits) / float64(c.hits+c.misses)
+	delta := hitRate - c.prevHitRate
+	amount := c.step
+	if delta < 0 {
+		// the last step made things worse, go back
+		amount = -amount
+	}
+
+	if math.Abs(delta) >= climbRestartThreshold {
+		c.step = math.Copysign(climbStepRatio, amount)
+	} else {
+		c.step = amount * climbStepDecay
+	}
+
+	c.prevHitRate = hitRate
+	c.hits, c.misses = 0, 0
+	return amount, true
+}
+
+func (c *hillClimber) reset() {
+	c.hits, c.misses = 0, 0
+	c.prevHitRate = 0
+	c.step = climbStepRatio
+}
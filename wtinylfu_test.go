@@ -0,0 +1,183 @@
+package fulmo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWTinyLFUAdd(t *testing.T) {
+	p := newWTinyLFUPolicy[int](100, 100)
+	defer p.Close()
+
+	victims, added := p.Add(1, 101)
+	require.Nil(t, victims)
+	require.False(t, added)
+
+	for i := uint64(1); i <= 10; i++ {
+		victims, added = p.Add(i, 10)
+		require.Empty(t, victims)
+		require.True(t, added)
+	}
+	require.Equal(t, int64(0), p.Cap())
+
+	// the window holds a single item, the rest moved to probation
+	require.Equal(t, 1, p.window.Len())
+	require.Equal(t, 9, p.probation.Len())
+	require.Equal(t, regionWindow, p.entries[10].Value.(*wEntry).region)
+
+	// an update does not count as an addition
+	victims, added = p.Add(10, 5)
+	require.Nil(t, victims)
+	require.False(t, added)
+	require.Equal(t, int64(5), p.Cap())
+}
+
+func TestWTinyLFUAdmission(t *testing.T) {
+	p := newWTinyLFUPolicy[int](100, 100)
+	defer p.Close()
+
+	for i := uint64(1); i <= 10; i++ {
+		p.Add(i, 10)
+	}
+
+	// make the probation LRU victim popular
+	p.Lock()
+	for i := 0; i < 5; i++ {
+		p.access(1)
+	}
+	p.Unlock()
+	require.Equal(t, regionProtected, p.entries[1].Value.(*wEntry).region)
+
+	// the candidate pushed out of the window (10) is less popular
+	// than the probation victim (2), so it gets evicted
+	p.Lock()
+	for i := 0; i < 3; i++ {
+		p.admit.Increment(2)
+	}
+	p.Unlock()
+	victims, added := p.Add(11, 10)
+	require.True(t, added)
+	require.Len(t, victims, 1)
+	require.Equal(t, uint64(10), victims[0].Key)
+	require.True(t, p.Has(2))
+	require.True(t, p.Has(11))
+
+	// a popular candidate wins against the victim
+	p.Lock()
+	for i := 0; i < 5; i++ {
+		p.admit.Increment(11)
+	}
+	p.Unlock()
+	victims, added = p.Add(12, 10)
+	require.True(t, added)
+	require.Len(t, victims, 1)
+	require.NotEqual(t, uint64(11), victims[0].Key)
+	require.True(t, p.Has(11))
+}
+
+func TestWTinyLFUWindow(t *testing.T) {
+	p := newWTinyLFUPolicy[int](100, 100)
+	defer p.Close()
+
+	p.Add(1, 50)
+	p.Add(2, 50)
+	p.Lock()
+	for i := 0; i < 6; i++ {
+		p.admit.Increment(1)
+	}
+	for i := 0; i < 3; i++ {
+		p.admit.Increment(2)
+	}
+	p.Unlock()
+
+	// the incoming item is admitted into the window without any frequency,
+	// the window's previous item competes for the main space instead
+	victims, added := p.Add(3, 50)
+	require.True(t, added)
+	require.True(t, p.Has(3))
+	require.Len(t, victims, 1)
+	require.Equal(t, uint64(2), victims[0].Key)
+	require.Equal(t, int64(0), p.Cap())
+}
+
+func TestWTinyLFUPolicy(t *testing.T) {
+	p := newWTinyLFUPolicy[int](100, 10)
+	defer p.Close()
+
+	p.Add(1, 2)
+	require.True(t, p.Has(1))
+	require.Equal(t, int64(2), p.Cost(1))
+	require.Equal(t, int64(-1), p.Cost(2))
+
+	p.Update(1, 3)
+	require.Equal(t, int64(3), p.Cost(1))
+	require.Equal(t, int64(7), p.Cap())
+
+	p.Del(1)
+	require.False(t, p.Has(1))
+	require.Equal(t, int64(10), p.Cap())
+
+	p.Add(2, 2)
+	p.UpdateMaxCost(20)
+	require.Equal(t, int64(20), p.MaxCost())
+	p.Clear()
+	require.False(t, p.Has(2))
+	require.Equal(t, int64(20), p.Cap())
+}
+
+func TestWTinyLFUPushAfterClose(t *testing.T) {
+	p := newWTinyLFUPolicy[int](100, 10)
+	require.True(t, p.Push([]uint64{}))
+	p.Close()
+	p.Close()
+	require.False(t, p.Push([]uint64{1, 2}))
+}
+
+func TestHillClimber(t *testing.T) {
+	c := newHillClimber(4)
+	for i := 0; i < 3; i++ {
+		_, ok := c.record(true)
+		require.False(t, ok)
+	}
+
+	// the first sample always climbs in the initial direction
+	delta, ok := c.record(false)
+	require.True(t, ok)
+	require.Equal(t, climbStepRatio, delta)
+
+	// a worse hit rate reverses the direction
+	for i := 0; i < 3; i++ {
+		c.record(false)
+	}
+	delta, ok = c.record(false)
+	require.True(t, ok)
+	require.Less(t, delta, 0.0)
+
+	c.reset()
+	require.Equal(t, climbStepRatio, c.step)
+	require.Zero(t, c.prevHitRate)
+}
+
+func TestCacheWTinyLFU(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		Policy:             NewWTinyLFUPolicy[int](1000, 10),
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 20; i++ {
+		c.Set(i, i, 1)
+		c.Wait()
+	}
+	require.Equal(t, int64(0), c.RemainingCost())
+	require.Equal(t, uint64(10), c.Metrics.KeysEvicted())
+
+	// the most recent key is always in the window
+	val, ok := c.Get(19)
+	require.True(t, ok)
+	require.Equal(t, 19, val)
+}